@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Access log formats, see SNAPSHOT_ACCESS_LOG.
+const (
+	accessLogOff      = "off"
+	accessLogCommon   = "common"
+	accessLogCombined = "combined"
+	accessLogTimed    = "timed"
+)
+
+// accessLogTimeFormat is the layout of the request time in the Common Log
+// Format.
+const accessLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// accessLogOutput is where access logs are written, separately from the
+// application logs so that they can be routed independently.
+var accessLogOutput io.Writer = os.Stdout
+
+// Type accessLogWriter is a response writer which records the status and size
+// of the response for the access log.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WriteHeader records the status and writes it to the underlying response.
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the size of the body and writes it to the underlying response.
+func (w *accessLogWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+
+	return n, err
+}
+
+// Flush flushes the underlying response, if it can be, for streamed responses.
+func (w *accessLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack takes over the connection of the underlying response, for WebSocket
+// upgrades, which are logged with the 101 status.
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	w.status = http.StatusSwitchingProtocols
+
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the underlying response, for http.ResponseController.
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withAccessLog wraps a handler, writing a line for every request in the
+// Common or Combined Log Format, or in the Combined Log Format followed by the
+// time taken to respond in microseconds if timed. When access logging is off,
+// the handler is returned as-is.
+func withAccessLog(next http.Handler) http.Handler {
+	if conf.AccessLog == accessLogOff {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &accessLogWriter{ResponseWriter: w}
+
+		next.ServeHTTP(recorder, r)
+
+		fmt.Fprint(accessLogOutput, accessLogLine(r, recorder.status,
+			recorder.bytes, start, time.Since(start)))
+	})
+}
+
+// accessLogLine formats the access log line of a request.
+// It returns the line, including its trailing newline.
+func accessLogLine(r *http.Request, status int, bytes int64, start time.Time,
+	duration time.Duration) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	user := "-"
+	if username, _, ok := r.BasicAuth(); ok && username != "" {
+		user = username
+	}
+
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	size := "-"
+	if bytes > 0 {
+		size = strconv.FormatInt(bytes, 10)
+	}
+
+	line := fmt.Sprintf("%s - %s [%s] %q %d %s", accessLogValue(host), user,
+		start.Format(accessLogTimeFormat),
+		fmt.Sprintf("%s %s %s", r.Method, r.RequestURI, r.Proto), status, size)
+
+	if conf.AccessLog == accessLogCombined || conf.AccessLog == accessLogTimed {
+		line += fmt.Sprintf(" %q %q", accessLogValue(r.Referer()),
+			accessLogValue(r.UserAgent()))
+	}
+
+	if conf.AccessLog == accessLogTimed {
+		line += fmt.Sprintf(" %d", duration.Microseconds())
+	}
+
+	return line + "\n"
+}
+
+// accessLogValue replaces an empty value in the access log with "-".
+func accessLogValue(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	return value
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestAccessLogLine(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{
+			format: accessLogCommon,
+			want: `^127\.0\.0\.1 - - \[[^\]]+\] "GET /snapshot\.cgi HTTP/1\.1" ` +
+				`200 \d+\n$`,
+		},
+		{
+			format: accessLogCombined,
+			want: `^127\.0\.0\.1 - - \[[^\]]+\] "GET /snapshot\.cgi HTTP/1\.1" ` +
+				`200 \d+ "-" "test-agent"\n$`,
+		},
+		{
+			format: accessLogTimed,
+			want: `^127\.0\.0\.1 - - \[[^\]]+\] "GET /snapshot\.cgi HTTP/1\.1" ` +
+				`200 \d+ "-" "test-agent" \d+\n$`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			aircam := newFakeAirCam(t, "ubnt", "secret")
+			c := newTestCamera(t, aircam, map[string]string{
+				"SNAPSHOT_ACCESS_LOG": tt.format,
+			})
+			server := newTestServer(t, c)
+
+			var output bytes.Buffer
+			previous := accessLogOutput
+			accessLogOutput = &output
+			t.Cleanup(func() { accessLogOutput = previous })
+
+			logged := httptest.NewServer(withAccessLog(server.Config.Handler))
+			t.Cleanup(logged.Close)
+
+			request, err := http.NewRequest(http.MethodGet,
+				logged.URL+"/snapshot.cgi", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("User-Agent", "test-agent")
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d", response.StatusCode,
+					http.StatusOK)
+			}
+
+			if !regexp.MustCompile(tt.want).MatchString(output.String()) {
+				t.Errorf("access log = %q, want match for %q", output.String(),
+					tt.want)
+			}
+		})
+	}
+}
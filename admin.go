@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handleRelogin is the handler function for the /admin/relogin route, which
+// logs in to the camera immediately and replaces its session, such as after
+// rotating the camera password. It responds with 200 on success and 500 with
+// the error otherwise.
+func (c *camera) handleRelogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.logger("admin").InfoContext(r.Context(), "Forcing login", "remote",
+		r.RemoteAddr)
+
+	if err := c.session.Refresh(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte("OK\n"))
+}
+
+// handleReloadTLS is the handler function for the /admin/reload-tls route,
+// which reloads the client certificate and CA files, such as after rotating
+// them, see reloadTLS. It responds with 200 and the expiry of the reloaded
+// certificates as JSON on success, and 500 with the error otherwise, keeping
+// the current TLS configuration.
+func handleReloadTLS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger("admin").InfoContext(r.Context(), "Reloading TLS configuration",
+		"remote", r.RemoteAddr)
+
+	result, err := reloadTLS()
+	if err != nil {
+		logger("admin").ErrorContext(r.Context(),
+			"TLS reload failed, keeping current configuration", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
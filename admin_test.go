@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate expiring at notAfter
+// and its key as PEM files in a directory.
+// It returns the paths of the certificate and key.
+func writeTestCertificate(t *testing.T, dir string,
+	notAfter time.Time) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "aircam"},
+		NotBefore:             notAfter.Add(-48 * time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY",
+		Bytes: keyDER})
+
+	if err := os.WriteFile(certPath, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certPath, keyPath
+}
+
+func TestReloadTLS(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	certPath, keyPath := writeTestCertificate(t, dir, notAfter)
+
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, map[string]string{
+		"SNAPSHOT_CA_FILE":     certPath,
+		"SNAPSHOT_CLIENT_CERT": certPath,
+		"SNAPSHOT_CLIENT_KEY":  keyPath,
+	})
+
+	previous := cameras
+	cameras = []*camera{c}
+	t.Cleanup(func() { cameras = previous })
+
+	t.Run("method", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		handleReloadTLS(recorder, httptest.NewRequest(http.MethodGet,
+			"/admin/reload-tls", nil))
+
+		if recorder.Code != http.StatusMethodNotAllowed {
+			t.Errorf("status = %d, want %d", recorder.Code,
+				http.StatusMethodNotAllowed)
+		}
+	})
+
+	t.Run("rotated", func(t *testing.T) {
+		rotated := notAfter.Add(24 * time.Hour)
+		writeTestCertificate(t, dir, rotated)
+		client := c.httpClient()
+
+		recorder := httptest.NewRecorder()
+		handleReloadTLS(recorder, httptest.NewRequest(http.MethodPost,
+			"/admin/reload-tls", nil))
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d: %s", recorder.Code, http.StatusOK,
+				recorder.Body)
+		}
+
+		var result tlsReload
+		if err := json.NewDecoder(recorder.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+
+		if result.ClientCertNotAfter == nil ||
+			!result.ClientCertNotAfter.Equal(rotated) {
+			t.Errorf("clientCertNotAfter = %v, want %v",
+				result.ClientCertNotAfter, rotated)
+		}
+
+		if len(result.Cameras) != 1 || result.Cameras[0].CANotAfter == nil ||
+			!result.Cameras[0].CANotAfter.Equal(rotated) {
+			t.Errorf("cameras = %+v, want caNotAfter %v", result.Cameras,
+				rotated)
+		}
+
+		if c.httpClient() == client {
+			t.Error("client was not replaced")
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		client := c.httpClient()
+		if err := os.WriteFile(certPath, []byte("invalid"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+		handleReloadTLS(recorder, httptest.NewRequest(http.MethodPost,
+			"/admin/reload-tls", nil))
+
+		if recorder.Code != http.StatusInternalServerError {
+			t.Errorf("status = %d, want %d", recorder.Code,
+				http.StatusInternalServerError)
+		}
+
+		if c.httpClient() != client {
+			t.Error("client was replaced despite invalid certificates")
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		writeTestCertificate(t, dir, time.Now().Add(-time.Hour))
+
+		recorder := httptest.NewRecorder()
+		handleReloadTLS(recorder, httptest.NewRequest(http.MethodPost,
+			"/admin/reload-tls", nil))
+
+		if recorder.Code != http.StatusInternalServerError {
+			t.Errorf("status = %d, want %d", recorder.Code,
+				http.StatusInternalServerError)
+		}
+	})
+}
+
+func TestAdminRoutesRequireCredentials(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		auth       bool
+		wantStatus int
+	}{
+		{name: "no credentials configured", wantStatus: http.StatusNotFound},
+		{
+			name: "unauthenticated",
+			env: map[string]string{
+				"SNAPSHOT_PROXY_USER": "proxy",
+				"SNAPSHOT_PROXY_PASS": "hunter2",
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "authenticated",
+			env: map[string]string{
+				"SNAPSHOT_PROXY_USER": "proxy",
+				"SNAPSHOT_PROXY_PASS": "hunter2",
+			},
+			auth:       true,
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aircam := newFakeAirCam(t, "ubnt", "secret")
+			server := newTestServer(t, newTestCamera(t, aircam, tt.env))
+
+			request, err := http.NewRequest(http.MethodPost,
+				server.URL+"/admin/relogin", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.auth {
+				request.SetBasicAuth("proxy", "hunter2")
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+
+			if response.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", response.StatusCode,
+					tt.wantStatus)
+			}
+		})
+	}
+}
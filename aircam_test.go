@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// testJPEG is a minimal complete JPEG, recognized by its SOI and EOI markers,
+// served by the fake AirCam as its snapshot.
+var testJPEG = append(append(bytes.Clone(jpegSOI),
+	bytes.Repeat([]byte{0x00}, 64)...), jpegEOI...)
+
+// fakeLoginToken is the value of the hidden token input on the login page of
+// the fake AirCam, if it has one.
+const fakeLoginToken = "c2VjcmV0LXRva2Vu"
+
+// Type fakeAirCam is an HTTP server emulating the login and snapshot endpoints
+// of an AirCam. GET / sets a new session cookie, POST /login.cgi validates the
+// multipart login form and activates the session, and GET /snapshot.cgi, or
+// /cgi-bin/snapshot.cgi as on some firmware, serves the image only when
+// presented with an active session, otherwise redirecting to the login page
+// like the AirCam does. GET /status.cgi serves JSON to an
+// active session, setting the session cookie again and echoing it in
+// X-Session like some firmware does, and GET /stall.cgi never responds until the request is abandoned, signalling
+// on stalled and abandoned as it does.
+type fakeAirCam struct {
+	*httptest.Server
+
+	username string
+	password string
+
+	// Name of the password field of the login form, which is rendered again
+	// after rejected credentials if rejectWithForm is set, rather than
+	// redirecting to /login.cgi
+	passwordField  string
+	rejectWithForm bool
+
+	// Whether GET / omits the session cookie, as broken firmware does
+	omitCookie bool
+
+	// Name of a hidden token input rendered on the login page, which must be
+	// submitted with the login form, if set
+	tokenField string
+
+	// Status of the responses to logins and snapshots, if set, rather than
+	// the normal responses
+	loginStatus    int
+	snapshotStatus int
+
+	// Signalled when a request to /stall.cgi arrives, and when it is abandoned
+	stalled   chan struct{}
+	abandoned chan struct{}
+
+	mutex     sync.Mutex
+	image     []byte
+	sessions  map[string]bool
+	issued    int
+	rebooted  bool
+	attempts  int
+	logins    int
+	snapshots int
+
+	// Number of snapshot requests still to fail with 503 before the image is
+	// served again, as with a transient fault of the AirCam
+	snapshotFailures int
+
+	// Path of the most recent snapshot served
+	snapshotPath string
+
+	// Headers of every request received, in order
+	headers []http.Header
+}
+
+// newFakeAirCam starts a fake AirCam accepting a username and password, which
+// is closed when the test ends.
+func newFakeAirCam(t testing.TB, username, password string) *fakeAirCam {
+	t.Helper()
+
+	a := &fakeAirCam{
+		username:      username,
+		password:      password,
+		passwordField: "password",
+		image:         testJPEG,
+		sessions:      map[string]bool{},
+		stalled:       make(chan struct{}, 8),
+		abandoned:     make(chan struct{}, 8),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", a.handleRoot)
+	mux.HandleFunc("GET /login.cgi", a.handleLoginPage)
+	mux.HandleFunc("POST /login.cgi", a.handleLogin)
+	mux.HandleFunc("GET /snapshot.cgi", a.handleSnapshot)
+	mux.HandleFunc("GET /cgi-bin/snapshot.cgi", a.handleSnapshot)
+	mux.HandleFunc("GET /status.cgi", a.handleStatus)
+	mux.HandleFunc("GET /stall.cgi", func(w http.ResponseWriter,
+		r *http.Request) {
+		trySend(a.stalled)
+		<-r.Context().Done()
+		trySend(a.abandoned)
+	})
+
+	a.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			a.mutex.Lock()
+			a.headers = append(a.headers, r.Header.Clone())
+			a.mutex.Unlock()
+
+			mux.ServeHTTP(w, r)
+		}))
+	t.Cleanup(a.Close)
+
+	return a
+}
+
+// resetConnection resets the connection of a request rather than responding,
+// so that the client sees the connection reset by peer.
+func resetConnection(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// trySend signals on a channel without blocking, dropping the signal if the
+// channel is full.
+func trySend(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// setImage replaces the image served as the snapshot.
+func (a *fakeAirCam) setImage(image []byte) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.image = image
+}
+
+// expireSessions expires every session, as the AirCam does after 15 minutes
+// of inactivity or a reboot.
+func (a *fakeAirCam) expireSessions() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.sessions = map[string]bool{}
+}
+
+// reboot expires every session, and resets the connections of snapshot
+// requests until the next login begins, as the connection drops while the
+// AirCam reboots.
+func (a *fakeAirCam) reboot() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.sessions = map[string]bool{}
+	a.rebooted = true
+}
+
+// counts retrieves the number of successful logins and served snapshots.
+func (a *fakeAirCam) counts() (int, int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.logins, a.snapshots
+}
+
+// active checks whether a request carries an active session cookie.
+func (a *fakeAirCam) active(r *http.Request) bool {
+	cookie, err := r.Cookie("AIROS_SESSIONID")
+	if err != nil {
+		return false
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.sessions[cookie.Value]
+}
+
+// handleRoot sets a new, not yet active, session cookie and renders the login
+// page, which also means the AirCam finished rebooting.
+func (a *fakeAirCam) handleRoot(w http.ResponseWriter, r *http.Request) {
+	a.mutex.Lock()
+	a.rebooted = false
+	a.issued++
+	value := fmt.Sprintf("session%d", a.issued)
+	a.sessions[value] = false
+	a.mutex.Unlock()
+
+	if !a.omitCookie {
+		http.SetCookie(w, &http.Cookie{Name: "AIROS_SESSIONID", Value: value})
+	}
+
+	a.handleLoginPage(w, r)
+}
+
+// handleLoginPage renders the login form.
+func (a *fakeAirCam) handleLoginPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprint(w, `<form method="post" action="/login.cgi">`)
+	if a.tokenField != "" {
+		fmt.Fprintf(w, `<input type="hidden" name="%s" value="%s">`,
+			a.tokenField, fakeLoginToken)
+	}
+	fmt.Fprintf(w, `<input name="username"><input type="password" name="%s">`+
+		`</form>`, a.passwordField)
+}
+
+// handleLogin validates the multipart login form, activating the session
+// cookie and redirecting to the snapshot if the credentials are accepted.
+func (a *fakeAirCam) handleLogin(w http.ResponseWriter, r *http.Request) {
+	a.mutex.Lock()
+	a.attempts++
+	a.mutex.Unlock()
+
+	if a.loginStatus != 0 {
+		http.Error(w, http.StatusText(a.loginStatus), a.loginStatus)
+		return
+	}
+
+	cookie, err := r.Cookie("AIROS_SESSIONID")
+	if err != nil {
+		http.Error(w, "missing session cookie", http.StatusBadRequest)
+		return
+	}
+
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+
+	if r.FormValue("uri") == "" || r.FormValue("Submit") == "" {
+		http.Error(w, "missing uri or Submit", http.StatusBadRequest)
+		return
+	}
+
+	if a.tokenField != "" && r.FormValue(a.tokenField) != fakeLoginToken {
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return
+	}
+
+	if r.FormValue("username") != a.username ||
+		r.FormValue(a.passwordField) != a.password {
+		if a.rejectWithForm {
+			a.handleLoginPage(w, r)
+			return
+		}
+
+		http.Redirect(w, r, "/login.cgi", http.StatusFound)
+		return
+	}
+
+	a.mutex.Lock()
+	a.sessions[cookie.Value] = true
+	a.logins++
+	a.mutex.Unlock()
+
+	http.Redirect(w, r, r.FormValue("uri"), http.StatusFound)
+}
+
+// handleSnapshot serves the image to an active session, redirecting to the
+// login page otherwise.
+func (a *fakeAirCam) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	a.mutex.Lock()
+	rebooted := a.rebooted
+	a.mutex.Unlock()
+
+	if rebooted {
+		resetConnection(w)
+		return
+	}
+
+	if !a.active(r) {
+		http.Redirect(w, r, "/login.cgi", http.StatusFound)
+		return
+	}
+
+	if a.snapshotStatus != 0 {
+		http.Error(w, http.StatusText(a.snapshotStatus), a.snapshotStatus)
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.snapshotFailures > 0 {
+		a.snapshotFailures--
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+		return
+	}
+
+	a.snapshots++
+	a.snapshotPath = r.URL.Path
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Write(a.image)
+}
+
+// handleStatus serves the status of the AirCam as JSON to an active session,
+// redirecting to the login page otherwise.
+func (a *fakeAirCam) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !a.active(r) {
+		http.Redirect(w, r, "/login.cgi", http.StatusFound)
+		return
+	}
+
+	cookie, _ := r.Cookie("AIROS_SESSIONID")
+	http.SetCookie(w, cookie)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Firmware", "AirCam v1.1.5")
+	w.Header().Set("X-Session", cookie.Value)
+	w.Header().Set("Connection", "X-Hop")
+	w.Header().Set("X-Hop", "1")
+	fmt.Fprint(w, `{"status":"ok"}`)
+}
+
+// setTestConfig replaces the configuration with one loaded from environment
+// variables, restoring the previous configuration when the test ends.
+func setTestConfig(t testing.TB, env map[string]string) {
+	t.Helper()
+
+	loaded, err := loadConfig(func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	previous := conf
+	conf = loaded
+	t.Cleanup(func() { conf = previous })
+}
+
+// newTestCamera configures a single camera for a fake AirCam with its
+// credentials, and any other environment variables.
+// It returns the camera, which is not logged in.
+func newTestCamera(t testing.TB, aircam *fakeAirCam,
+	env map[string]string) *camera {
+	t.Helper()
+
+	merged := map[string]string{
+		"SNAPSHOT_URL":      aircam.URL,
+		"SNAPSHOT_USERNAME": aircam.username,
+		"SNAPSHOT_PASSWORD": aircam.password,
+	}
+	for name, value := range env {
+		merged[name] = value
+	}
+
+	setTestConfig(t, merged)
+
+	cameras, err := newCameras()
+	if err != nil {
+		t.Fatalf("newCameras() error = %v", err)
+	}
+
+	return cameras[0]
+}
+
+// newTestServer logs a camera in and serves its routes, marking startup as
+// finished, until the test ends.
+// It returns the server.
+func newTestServer(t *testing.T, c *camera) *httptest.Server {
+	t.Helper()
+
+	sessionCookie, err := c.login(context.Background())
+	if err != nil {
+		t.Fatalf("login() error = %v", err)
+	}
+	c.session.Set(sessionCookie)
+
+	ready.Store(true)
+	t.Cleanup(func() { ready.Store(false) })
+
+	mux := http.NewServeMux()
+	c.registerRoutes(mux)
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server
+}
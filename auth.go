@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// requireAuth wraps a handler with HTTP Basic Auth using the configured proxy
+// credentials. When no proxy credentials are configured, the handler is
+// returned as-is.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	if conf.ProxyUser == "" {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+
+		// Compare both credentials in constant time, without short circuiting,
+		// so that response timing does not reveal which one was wrong.
+		userMatch := subtle.ConstantTimeCompare([]byte(username),
+			[]byte(conf.ProxyUser))
+		passMatch := subtle.ConstantTimeCompare([]byte(password),
+			[]byte(conf.ProxyPass))
+
+		if !ok || userMatch&passMatch != 1 {
+			logger("auth").WarnContext(r.Context(), "Unauthorized request",
+				"remote", r.RemoteAddr, "path", r.URL.Path)
+			w.Header().Set("WWW-Authenticate",
+				`Basic realm="aircam-snapshot", charset="UTF-8"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized),
+				http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
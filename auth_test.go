@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRequireAuth(t *testing.T) {
+	credentials := map[string]string{
+		"SNAPSHOT_PROXY_USER": "proxy",
+		"SNAPSHOT_PROXY_PASS": "hunter2",
+	}
+
+	tests := []struct {
+		name       string
+		env        map[string]string
+		username   string
+		password   string
+		wantStatus int
+	}{
+		{name: "no credentials configured", wantStatus: http.StatusOK},
+		{name: "authorized", env: credentials, username: "proxy",
+			password: "hunter2", wantStatus: http.StatusOK},
+		{name: "no credentials", env: credentials,
+			wantStatus: http.StatusUnauthorized},
+		{name: "wrong password", env: credentials, username: "proxy",
+			password: "hunter3", wantStatus: http.StatusUnauthorized},
+		{name: "wrong username", env: credentials, username: "admin",
+			password: "hunter2", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aircam := newFakeAirCam(t, "ubnt", "secret")
+			server := newTestServer(t, newTestCamera(t, aircam, tt.env))
+
+			request, err := http.NewRequest(http.MethodGet,
+				server.URL+"/snapshot.cgi", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.username != "" {
+				request.SetBasicAuth(tt.username, tt.password)
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+
+			if response.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", response.StatusCode,
+					tt.wantStatus)
+			}
+
+			unauthorized := tt.wantStatus == http.StatusUnauthorized
+			challenge := response.Header.Get("WWW-Authenticate")
+			if unauthorized != (challenge != "") {
+				t.Errorf("WWW-Authenticate = %q for status %d", challenge,
+					response.StatusCode)
+			}
+
+			if _, snapshots := aircam.counts(); unauthorized && snapshots != 0 {
+				t.Errorf("snapshots = %d, want 0 for unauthorized requests",
+					snapshots)
+			}
+		})
+	}
+}
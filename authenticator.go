@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Modes of authenticating with the AirCam, see SNAPSHOT_AUTH_MODE.
+const (
+	authModeForm   = "form"
+	authModeDigest = "digest"
+)
+
+// Type authenticator authenticates requests to a camera, either with the
+// session cookie of the form login or by HTTP Digest authentication, so that
+// requests do not depend on which is in use.
+type authenticator interface {
+	// login establishes a session with the camera.
+	// It returns the session cookie, and any errors encountered during login.
+	login(ctx context.Context) (*http.Cookie, error)
+
+	// do makes a request to the camera, authenticated by the session cookie.
+	// It returns the response, and any errors encountered during the request.
+	do(client httpDoer, request *http.Request,
+		sessionCookie *http.Cookie) (*http.Response, error)
+}
+
+// newAuthenticator creates the authenticator of a camera for the configured
+// SNAPSHOT_AUTH_MODE.
+func newAuthenticator(c *camera) authenticator {
+	if conf.AuthMode == authModeDigest {
+		return &digestAuthenticator{camera: c}
+	}
+
+	return formAuthenticator{camera: c}
+}
+
+// Type formAuthenticator authenticates requests with the session cookie
+// obtained by submitting the login form of the AirCam.
+type formAuthenticator struct {
+	camera *camera
+}
+
+// login submits the login form of the camera.
+// It returns the session cookie, and any errors encountered during login.
+func (a formAuthenticator) login(ctx context.Context) (*http.Cookie, error) {
+	return a.camera.formLogin(ctx)
+}
+
+// do makes a request to the camera with the session cookie.
+// It returns the response, and any errors encountered during the request.
+func (a formAuthenticator) do(client httpDoer, request *http.Request,
+	sessionCookie *http.Cookie) (*http.Response, error) {
+	request.AddCookie(sessionCookie)
+
+	return client.Do(request)
+}
+
+// digestSession stands in for the session cookie of cameras authenticated by
+// HTTP Digest, which have no session, so that they are treated as logged in
+// once their credentials are accepted. It is never sent to the camera.
+var digestSession = &http.Cookie{Name: "digest"}
+
+// Type digestChallenge represents the parameters of a Digest challenge from
+// the WWW-Authenticate header of a 401 response.
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+}
+
+// Type digestAuthenticator authenticates requests by responding to the HTTP
+// Digest challenge of the camera. The most recent challenge is reused for later
+// requests, so that only a stale nonce costs an extra round trip.
+type digestAuthenticator struct {
+	camera *camera
+
+	mutex     sync.Mutex
+	challenge *digestChallenge
+	count     int
+}
+
+// login checks the credentials of the camera with a Digest authenticated
+// request to its snapshot path, as there is no session to establish. Any
+// response other than a rejected challenge, or a 401 without one, accepts the
+// credentials.
+// It returns the stand-in session cookie, and ErrInvalidCredentials if the
+// credentials were rejected.
+func (a *digestAuthenticator) login(ctx context.Context) (*http.Cookie, error) {
+	c := a.camera
+	username, _ := c.credentials()
+	c.logger("login").InfoContext(ctx, "Checking Digest credentials",
+		"username", username)
+
+	request, err := http.NewRequest(http.MethodGet, c.endpoint(c.path, ""),
+		nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrLoginFailed, err)
+	}
+
+	response, err := a.do(c.httpClient(), request, digestSession)
+	if errors.Is(err, ErrInvalidCredentials) {
+		c.logger("login").ErrorContext(ctx, "Credentials rejected")
+		return nil, err
+	} else if err != nil {
+		c.logger("login").ErrorContext(ctx, "Error making login request",
+			"error", err)
+		return nil, fmt.Errorf("%w: %w", ErrLoginFailed, upstreamTimeout(err))
+	}
+	response.Body.Close()
+
+	if response.StatusCode == http.StatusUnauthorized {
+		c.logger("login").ErrorContext(ctx,
+			"Credentials rejected without a Digest challenge")
+		return nil, ErrInvalidCredentials
+	}
+
+	return digestSession, nil
+}
+
+// do makes a request to the camera with the answer to the most recent Digest
+// challenge, answering a new challenge and retrying once if the camera
+// responds with one, such as when the nonce of the previous one expired.
+// Requests with a body which can not be replayed are not retried.
+// It returns the response, and ErrInvalidCredentials if the camera still
+// rejects the answered challenge.
+func (a *digestAuthenticator) do(client httpDoer, request *http.Request,
+	_ *http.Cookie) (*http.Response, error) {
+	a.authorize(request)
+
+	response, err := client.Do(request)
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+
+	challenge, ok := parseDigestChallenge(
+		response.Header.Values("WWW-Authenticate"))
+	if !ok {
+		return response, nil
+	}
+
+	retry := request.Clone(request.Context())
+	if request.Body != nil {
+		if request.GetBody == nil {
+			return response, nil
+		}
+
+		if retry.Body, err = request.GetBody(); err != nil {
+			return response, nil
+		}
+	}
+
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+
+	a.mutex.Lock()
+	a.challenge = &challenge
+	a.count = 0
+	a.mutex.Unlock()
+
+	a.authorize(retry)
+
+	response, err = client.Do(retry)
+	if err == nil && response.StatusCode == http.StatusUnauthorized {
+		response.Body.Close()
+		return nil, ErrInvalidCredentials
+	}
+
+	return response, err
+}
+
+// authorize adds the answer to the most recent Digest challenge, if any, to the
+// Authorization header of a request.
+func (a *digestAuthenticator) authorize(request *http.Request) {
+	a.mutex.Lock()
+	challenge := a.challenge
+	a.count++
+	count := a.count
+	a.mutex.Unlock()
+
+	if challenge == nil {
+		return
+	}
+
+	username, password := a.camera.credentials()
+	request.Header.Set("Authorization", challenge.answer(username, password,
+		request.Method, request.URL.RequestURI(), count))
+}
+
+// answer computes the Authorization header answering the challenge for a
+// request, as defined by RFC 7616.
+func (challenge *digestChallenge) answer(username, password, method,
+	uri string, count int) string {
+	newHash := md5.New
+	if strings.HasPrefix(strings.ToUpper(challenge.algorithm), "SHA-256") {
+		newHash = sha256.New
+	}
+
+	digest := func(values ...string) string {
+		return hashHex(newHash(), strings.Join(values, ":"))
+	}
+
+	cnonce := make([]byte, 8)
+	rand.Read(cnonce)
+	clientNonce := hex.EncodeToString(cnonce)
+	nc := fmt.Sprintf("%08x", count)
+
+	ha1 := digest(username, challenge.realm, password)
+	if strings.HasSuffix(strings.ToLower(challenge.algorithm), "-sess") {
+		ha1 = digest(ha1, challenge.nonce, clientNonce)
+	}
+	ha2 := digest(method, uri)
+
+	fields := []string{
+		fmt.Sprintf("username=%q", username),
+		fmt.Sprintf("realm=%q", challenge.realm),
+		fmt.Sprintf("nonce=%q", challenge.nonce),
+		fmt.Sprintf("uri=%q", uri),
+	}
+
+	if challenge.qop != "" {
+		fields = append(fields,
+			fmt.Sprintf("response=%q", digest(ha1, challenge.nonce, nc,
+				clientNonce, challenge.qop, ha2)),
+			"qop="+challenge.qop, "nc="+nc, fmt.Sprintf("cnonce=%q", clientNonce))
+	} else {
+		fields = append(fields,
+			fmt.Sprintf("response=%q", digest(ha1, challenge.nonce, ha2)))
+	}
+
+	if challenge.algorithm != "" {
+		fields = append(fields, "algorithm="+challenge.algorithm)
+	}
+
+	if challenge.opaque != "" {
+		fields = append(fields, fmt.Sprintf("opaque=%q", challenge.opaque))
+	}
+
+	return "Digest " + strings.Join(fields, ", ")
+}
+
+// hashHex hashes a value, encoding the sum in lowercase hex.
+func hashHex(h hash.Hash, value string) string {
+	h.Write([]byte(value))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// parseDigestChallenge parses the Digest challenge from the WWW-Authenticate
+// headers of a response, choosing the auth quality of protection if offered.
+// It returns the challenge, and whether a Digest challenge was found.
+func parseDigestChallenge(headers []string) (digestChallenge, bool) {
+	for _, header := range headers {
+		scheme, params, _ := strings.Cut(strings.TrimSpace(header), " ")
+		if !strings.EqualFold(scheme, "Digest") {
+			continue
+		}
+
+		var challenge digestChallenge
+		for key, value := range parseAuthParams(params) {
+			switch key {
+			case "realm":
+				challenge.realm = value
+			case "nonce":
+				challenge.nonce = value
+			case "opaque":
+				challenge.opaque = value
+			case "algorithm":
+				challenge.algorithm = value
+			case "qop":
+				for _, qop := range strings.Split(value, ",") {
+					if strings.TrimSpace(qop) == "auth" {
+						challenge.qop = "auth"
+					}
+				}
+			}
+		}
+
+		return challenge, challenge.nonce != ""
+	}
+
+	return digestChallenge{}, false
+}
+
+// parseAuthParams parses the comma separated key=value parameters of an
+// authentication challenge, where values may be quoted strings containing
+// commas and escaped quotes.
+// It returns the parameters by lowercase key.
+func parseAuthParams(params string) map[string]string {
+	parsed := map[string]string{}
+
+	for params != "" {
+		key, rest, found := strings.Cut(params, "=")
+		if !found {
+			break
+		}
+
+		key = strings.ToLower(strings.Trim(key, " ,"))
+		rest = strings.TrimLeft(rest, " ")
+
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				value.WriteByte(rest[i])
+			}
+			params = rest[min(i+1, len(rest)):]
+		} else {
+			token, remaining, _ := strings.Cut(rest, ",")
+			value.WriteString(strings.TrimSpace(token))
+			params = remaining
+		}
+
+		parsed[key] = value.String()
+		params = strings.TrimLeft(params, " ,")
+	}
+
+	return parsed
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Type fakeDigestCamera is an HTTP server emulating firmware which
+// authenticates the snapshot endpoint with HTTP Digest, challenging any
+// request without a valid answer to its current nonce with a 401.
+type fakeDigestCamera struct {
+	*httptest.Server
+
+	username string
+	password string
+
+	mutex      sync.Mutex
+	nonce      int
+	challenges int
+	snapshots  int
+}
+
+// newFakeDigestCamera starts a fake Digest camera accepting a username and
+// password, which is closed when the test ends.
+func newFakeDigestCamera(t *testing.T, username,
+	password string) *fakeDigestCamera {
+	t.Helper()
+
+	d := &fakeDigestCamera{username: username, password: password, nonce: 1}
+	d.Server = httptest.NewServer(http.HandlerFunc(d.handleSnapshot))
+	t.Cleanup(d.Close)
+
+	return d
+}
+
+// handleSnapshot serves the snapshot to a request answering the current
+// challenge, and challenges any other request.
+func (d *fakeDigestCamera) handleSnapshot(w http.ResponseWriter,
+	r *http.Request) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	nonce := fmt.Sprintf("nonce%d", d.nonce)
+	if !d.answered(r, nonce) {
+		d.challenges++
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+			`Digest realm="AirCam", qop="auth", nonce=%q, opaque="c2Vzc2lvbg=="`,
+			nonce))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	d.snapshots++
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Write(testJPEG)
+}
+
+// answered checks whether a request answers the challenge with a nonce, as
+// defined by RFC 7616 for MD5 with the auth quality of protection.
+func (d *fakeDigestCamera) answered(r *http.Request, nonce string) bool {
+	scheme, params, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if scheme != "Digest" {
+		return false
+	}
+
+	answer := parseAuthParams(params)
+	if answer["username"] != d.username || answer["nonce"] != nonce ||
+		answer["uri"] != r.URL.RequestURI() || answer["qop"] != "auth" ||
+		answer["opaque"] != "c2Vzc2lvbg==" {
+		return false
+	}
+
+	md5Hex := func(values ...string) string {
+		sum := md5.Sum([]byte(strings.Join(values, ":")))
+		return hex.EncodeToString(sum[:])
+	}
+
+	ha1 := md5Hex(d.username, "AirCam", d.password)
+	ha2 := md5Hex(r.Method, r.URL.RequestURI())
+
+	return answer["response"] == md5Hex(ha1, nonce, answer["nc"],
+		answer["cnonce"], "auth", ha2)
+}
+
+// expireNonce replaces the nonce of the challenge, so that answers to the
+// previous one are challenged again.
+func (d *fakeDigestCamera) expireNonce() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.nonce++
+}
+
+// counts retrieves the number of challenges issued and served snapshots.
+func (d *fakeDigestCamera) counts() (int, int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.challenges, d.snapshots
+}
+
+func TestDigestChallengeFlow(t *testing.T) {
+	digestCamera := newFakeDigestCamera(t, "ubnt", "secret")
+	setTestConfig(t, map[string]string{
+		"SNAPSHOT_URL":           digestCamera.URL,
+		"SNAPSHOT_USERNAME":      "ubnt",
+		"SNAPSHOT_PASSWORD":      "secret",
+		"SNAPSHOT_AUTH_MODE":     "digest",
+		"SNAPSHOT_FETCH_RETRIES": "0",
+	})
+
+	cameras, err := newCameras()
+	if err != nil {
+		t.Fatalf("newCameras() error = %v", err)
+	}
+	c := cameras[0]
+
+	sessionCookie, err := c.login(context.Background())
+	if err != nil {
+		t.Fatalf("login() error = %v", err)
+	}
+	c.session.Set(sessionCookie)
+
+	// The login answers the first challenge, which later snapshots reuse
+	// without being challenged again until the nonce expires
+	fetch := func(wantChallenges, wantSnapshots int) {
+		t.Helper()
+
+		image, _, err := c.fetchImage(context.Background(), nil)
+		if err != nil {
+			t.Fatalf("fetchImage() error = %v", err)
+		}
+
+		if !bytes.Equal(image, testJPEG) {
+			t.Errorf("fetchImage() = %x, want %x", image, testJPEG)
+		}
+
+		challenges, snapshots := digestCamera.counts()
+		if challenges != wantChallenges || snapshots != wantSnapshots {
+			t.Errorf("challenges, snapshots = %d, %d, want %d, %d", challenges,
+				snapshots, wantChallenges, wantSnapshots)
+		}
+	}
+
+	fetch(1, 2)
+	fetch(1, 3)
+
+	digestCamera.expireNonce()
+	fetch(2, 4)
+}
+
+func TestDigestChallengeRejected(t *testing.T) {
+	digestCamera := newFakeDigestCamera(t, "ubnt", "secret")
+	setTestConfig(t, map[string]string{
+		"SNAPSHOT_URL":       digestCamera.URL,
+		"SNAPSHOT_USERNAME":  "ubnt",
+		"SNAPSHOT_PASSWORD":  "wrong",
+		"SNAPSHOT_AUTH_MODE": "digest",
+	})
+
+	cameras, err := newCameras()
+	if err != nil {
+		t.Fatalf("newCameras() error = %v", err)
+	}
+
+	_, err = cameras[0].login(context.Background())
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("login() error = %v, want %v", err, ErrInvalidCredentials)
+	}
+
+	// The answered challenge is challenged again, rather than retried further
+	if challenges, snapshots := digestCamera.counts(); challenges != 2 ||
+		snapshots != 0 {
+		t.Errorf("challenges, snapshots = %d, %d, want 2, 0", challenges,
+			snapshots)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen indicates that snapshots are not being fetched from the
+// AirCam, as the circuit breaker opened after repeated failures.
+var errCircuitOpen = errors.New("Image - Circuit breaker open")
+
+// States of a circuit breaker. A closed breaker lets every fetch through, an
+// open breaker fails fetches immediately for the cooldown, and a half-open
+// breaker lets a single probe through to decide whether to close again.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// Type breaker represents the circuit breaker of a camera, which stops
+// snapshot fetches from piling up against an AirCam which is offline.
+type breaker struct {
+	mutex    sync.Mutex
+	state    string
+	failures int
+	opened   time.Time
+	probing  bool
+}
+
+// allowFetch checks whether the circuit breaker of the camera lets an upstream
+// fetch through, moving an open breaker to half-open once the cooldown has
+// passed to let a single probe through.
+// It returns whether the fetch can be made.
+func (c *camera) allowFetch() bool {
+	if conf.BreakerThreshold == 0 {
+		return true
+	}
+
+	b := &c.breaker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.opened) < conf.BreakerCooldown {
+			return false
+		}
+
+		c.transitionBreaker(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+
+		b.probing = true
+	}
+
+	return true
+}
+
+// recordFetch records the result of an upstream fetch in the circuit breaker
+// of the camera, opening it after the threshold of consecutive failures, or
+// immediately if the probe of a half-open breaker failed. Cancelled fetches,
+// and fetches which never reached the AirCam as every fetch slot was busy or
+// the camera was not logged in, say nothing about the AirCam and are ignored.
+func (c *camera) recordFetch(err error) {
+	if conf.BreakerThreshold == 0 {
+		return
+	}
+
+	b := &c.breaker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.probing = false
+
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, errFetchesBusy),
+		errors.Is(err, ErrLoginCooldown), errors.Is(err, ErrNotLoggedIn):
+	case err == nil:
+		b.failures = 0
+		c.transitionBreaker(breakerClosed)
+	case b.state == breakerHalfOpen:
+		b.opened = time.Now()
+		c.transitionBreaker(breakerOpen)
+	default:
+		b.failures++
+		if b.failures >= conf.BreakerThreshold {
+			b.opened = time.Now()
+			c.transitionBreaker(breakerOpen)
+		}
+	}
+}
+
+// transitionBreaker moves the circuit breaker of the camera to a new state,
+// logging the transition, and must be called with the breaker lock held.
+func (c *camera) transitionBreaker(state string) {
+	b := &c.breaker
+	if b.state == "" {
+		b.state = breakerClosed
+	}
+
+	if b.state == state {
+		return
+	}
+
+	c.logger("breaker").Warn("Circuit breaker state changed", "from", b.state,
+		"to", state, "failures", b.failures)
+	b.state = state
+}
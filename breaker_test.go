@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBreakerIgnoresLocalErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantOpen bool
+	}{
+		{name: "cancelled", err: context.Canceled},
+		{name: "fetches busy", err: errFetchesBusy},
+		{name: "login cooldown", err: ErrLoginCooldown},
+		{name: "not logged in", err: ErrNotLoggedIn},
+		{name: "upstream timeout", err: ErrUpstreamTimeout, wantOpen: true},
+	}
+
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCamera(t, aircam, map[string]string{
+				"SNAPSHOT_BREAKER_THRESHOLD": "2",
+			})
+
+			for range 5 {
+				c.recordFetch(tt.err)
+			}
+
+			if got := !c.allowFetch(); got != tt.wantOpen {
+				t.Errorf("breaker open = %v, want %v", got, tt.wantOpen)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// wsSendBuffer is the number of frames queued for a WebSocket client before it
+// is considered too slow and dropped.
+const wsSendBuffer = 4
+
+// Type broadcaster fans out frames from a single fetch loop per camera to every
+// connected WebSocket client. The loop runs only while there are clients.
+type broadcaster struct {
+	mutex   sync.Mutex
+	clients map[chan []byte]struct{}
+
+	// Closed to stop the running fetch loop
+	stop chan struct{}
+}
+
+// subscribe adds a client to the broadcast of the camera, starting the fetch
+// loop if it is the first client.
+// It returns the channel the client receives frames on, which is closed if
+// the client falls too far behind.
+func (c *camera) subscribe() chan []byte {
+	b := &c.broadcast
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.clients) == 0 {
+		b.clients = map[chan []byte]struct{}{}
+		b.stop = make(chan struct{})
+		go c.broadcastFrames(b.stop)
+	}
+
+	frames := make(chan []byte, wsSendBuffer)
+	b.clients[frames] = struct{}{}
+
+	return frames
+}
+
+// unsubscribe removes a client from the broadcast of the camera, stopping the
+// fetch loop if it was the last client.
+func (c *camera) unsubscribe(frames chan []byte) {
+	b := &c.broadcast
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.clients[frames]; !ok {
+		return
+	}
+
+	delete(b.clients, frames)
+	close(frames)
+
+	if len(b.clients) == 0 {
+		close(b.stop)
+	}
+}
+
+// broadcastFrames fetches a frame at the configured stream FPS and queues it
+// for every client, until stopped. A client whose queue is full is dropped
+// rather than blocking delivery to the others.
+func (c *camera) broadcastFrames(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second / time.Duration(conf.StreamFPS))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		// Retrieve the frame, skipping it if the fetch failed
+		f, err := c.getFrame(context.Background(), nil)
+		if err != nil {
+			continue
+		}
+
+		// Check again under the lock, as the clients may have left during the
+		// fetch and been replaced by clients of a new loop
+		b := &c.broadcast
+		b.mutex.Lock()
+		select {
+		case <-stop:
+			b.mutex.Unlock()
+			return
+		default:
+		}
+
+		for frames := range b.clients {
+			select {
+			case frames <- f.image:
+			default:
+				c.logger("websocket").Warn("Dropping slow client")
+				delete(b.clients, frames)
+				close(frames)
+			}
+		}
+
+		// Stop if every client was dropped
+		if len(b.clients) == 0 {
+			close(stop)
+		}
+		b.mutex.Unlock()
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Type frame represents a processed image retrieved from a camera, along with
+// the time it was fetched from, and captured by, the AirCam, and whether it is
+// a stale frame served in place of one which could not be fetched.
+type frame struct {
+	image    []byte
+	fetched  time.Time
+	captured time.Time
+	stale    bool
+}
+
+// getFrame retrieves a frame from the camera, serving the most recently
+// fetched frame if it is younger than the cache TTL. Concurrent requests which
+// miss the cache are collapsed into a single request to the AirCam, whose
+// result is shared between them, unless the circuit breaker is open. The shared
+// request is made with the context of the request which started it, and is
+// retried by any other request still waiting if that context is cancelled.
+// It returns the frame, and any errors encountered during retrieval.
+func (c *camera) getFrame(ctx context.Context, query url.Values) (*frame,
+	error) {
+	// Frames are keyed by the upstream URL, see snapshotURL
+	key := c.snapshotURL(query)
+
+	c.cacheMutex.Lock()
+	cached, ok := c.cache[key]
+	c.cacheMutex.Unlock()
+
+	if ok && time.Since(cached.fetched) < conf.CacheTTL {
+		c.stats.hits.Add(1)
+		cacheHits.WithLabelValues(c.label()).Inc()
+		return cached, nil
+	}
+
+	c.stats.misses.Add(1)
+	cacheMisses.WithLabelValues(c.label()).Inc()
+
+	for {
+		results := c.flight.DoChan(key, func() (interface{}, error) {
+			if !c.allowFetch() {
+				return nil, errCircuitOpen
+			}
+
+			c.stats.fetches.Add(1)
+
+			f, err := c.loadFrame(ctx, query)
+			c.recordFetch(err)
+			c.recordStatus(err)
+			if err != nil {
+				return nil, err
+			}
+
+			c.cacheFrame(key, f)
+			c.bufferFrame(f)
+
+			return f, nil
+		})
+
+		var result singleflight.Result
+		select {
+		case result = <-results:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if errors.Is(result.Err, context.Canceled) && ctx.Err() == nil {
+			continue
+		} else if result.Err != nil {
+			return nil, result.Err
+		}
+
+		return result.Val.(*frame), nil
+	}
+}
+
+// getFrameOrStale retrieves a frame from the camera like getFrame, but serves
+// the last frame successfully fetched for the same query instead of failing,
+// if it is younger than SNAPSHOT_STALE_MAX, to smooth over momentary failures.
+// It returns the frame, and any errors encountered during retrieval if there is
+// no recent enough frame to serve instead.
+func (c *camera) getFrameOrStale(ctx context.Context, query url.Values) (*frame,
+	error) {
+	f, err := c.getFrame(ctx, query)
+	if err == nil || errors.Is(err, context.Canceled) || conf.StaleMax == 0 {
+		return f, err
+	}
+
+	c.cacheMutex.Lock()
+	cached, ok := c.cache[c.snapshotURL(query)]
+	c.cacheMutex.Unlock()
+
+	if !ok || time.Since(cached.fetched) >= conf.StaleMax {
+		return nil, err
+	}
+
+	c.logger("image").WarnContext(ctx, "Serving stale frame", "age",
+		time.Since(cached.fetched), "error", err)
+
+	stale := *cached
+	stale.stale = true
+
+	return &stale, nil
+}
+
+// cacheFrame stores a frame in the cache of the camera, evicting any frames
+// which are no longer fresh, or recent enough to serve as a stale frame, so
+// that the cache does not grow without bound.
+func (c *camera) cacheFrame(key string, f *frame) {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	if c.cache == nil {
+		c.cache = map[string]*frame{}
+	}
+
+	for cachedKey, cached := range c.cache {
+		if time.Since(cached.fetched) >= max(conf.CacheTTL, conf.StaleMax) {
+			delete(c.cache, cachedKey)
+		}
+	}
+
+	c.cache[key] = f
+}
+
+// Type cacheStats counts the requests for frames of a camera since the last
+// stats log, and the upstream fetches made to serve them.
+type cacheStats struct {
+	hits    atomic.Int64
+	misses  atomic.Int64
+	fetches atomic.Int64
+}
+
+// logCacheStats runs every stats interval and logs the cache hit ratio of the
+// camera, and the number of upstream fetches avoided by the cache and by
+// sharing fetches, over the interval.
+func (c *camera) logCacheStats(ticker *time.Ticker) {
+	for range ticker.C {
+		hits := c.stats.hits.Swap(0)
+		misses := c.stats.misses.Swap(0)
+		fetches := c.stats.fetches.Swap(0)
+
+		var ratio float64
+		if hits+misses > 0 {
+			ratio = float64(hits) / float64(hits+misses)
+		}
+
+		c.logger("cache").Info("Cache stats", "hits", hits, "misses", misses,
+			"hit_ratio", ratio, "fetches_avoided", max(0, hits+misses-fetches))
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCacheIgnoresUnforwardedParams(t *testing.T) {
+	tests := []struct {
+		name          string
+		queries       []string
+		wantSnapshots int
+	}{
+		{
+			name:          "cache busters",
+			queries:       []string{"?t=123", "?t=456", "", "?_=789&t=1"},
+			wantSnapshots: 1,
+		},
+		{
+			name:          "parameter order",
+			queries:       []string{"?res=2&rotate=1", "?rotate=1&res=2&t=1"},
+			wantSnapshots: 1,
+		},
+		{
+			name:          "forwarded parameters",
+			queries:       []string{"?res=1", "?res=2&t=1"},
+			wantSnapshots: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aircam := newFakeAirCam(t, "ubnt", "secret")
+			c := newTestCamera(t, aircam, map[string]string{
+				"SNAPSHOT_CACHE_TTL":      "1m",
+				"SNAPSHOT_FORWARD_PARAMS": "res,rotate",
+			})
+			server := newTestServer(t, c)
+
+			for _, query := range tt.queries {
+				response, err := http.Get(server.URL + "/snapshot.cgi" + query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				response.Body.Close()
+
+				if response.StatusCode != http.StatusOK {
+					t.Fatalf("GET %s status = %d, want %d", query,
+						response.StatusCode, http.StatusOK)
+				}
+			}
+
+			if _, snapshots := aircam.counts(); snapshots != tt.wantSnapshots {
+				t.Errorf("snapshots = %d, want %d", snapshots, tt.wantSnapshots)
+			}
+		})
+	}
+}
+
+func TestServeStaleFrame(t *testing.T) {
+	tests := []struct {
+		name      string
+		age       time.Duration
+		fail      bool
+		wantStale bool
+		want      int
+	}{
+		{name: "fresh", age: 2 * time.Second, want: http.StatusOK},
+		{name: "stale", age: 2 * time.Second, fail: true, wantStale: true,
+			want: http.StatusOK},
+		{name: "too stale", age: 10 * time.Second, fail: true,
+			want: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aircam := newFakeAirCam(t, "ubnt", "secret")
+			c := newTestCamera(t, aircam, map[string]string{
+				"SNAPSHOT_CACHE_TTL":     "1s",
+				"SNAPSHOT_STALE_MAX":     "5s",
+				"SNAPSHOT_FETCH_RETRIES": "0",
+			})
+			server := newTestServer(t, c)
+
+			response, err := http.Get(server.URL + "/snapshot.cgi")
+			if err != nil {
+				t.Fatalf("GET /snapshot.cgi error = %v", err)
+			}
+			response.Body.Close()
+
+			// Age the cached frame past its TTL rather than waiting for it
+			c.cacheMutex.Lock()
+			for _, cached := range c.cache {
+				cached.fetched = time.Now().Add(-tt.age)
+			}
+			c.cacheMutex.Unlock()
+
+			if tt.fail {
+				aircam.snapshotStatus = http.StatusServiceUnavailable
+			}
+
+			response, err = http.Get(server.URL + "/snapshot.cgi")
+			if err != nil {
+				t.Fatalf("GET /snapshot.cgi error = %v", err)
+			}
+			defer response.Body.Close()
+
+			if response.StatusCode != tt.want {
+				t.Errorf("GET /snapshot.cgi status = %d, want %d",
+					response.StatusCode, tt.want)
+			}
+
+			stale := response.Header.Get("X-Snapshot-Stale") == "true"
+			if stale != tt.wantStale {
+				t.Errorf("GET /snapshot.cgi stale = %t, want %t", stale,
+					tt.wantStale)
+			}
+		})
+	}
+}
+
+func TestConditionalSnapshot(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, nil)
+	server := newTestServer(t, c)
+
+	response, err := http.Get(server.URL + "/snapshot.cgi")
+	if err != nil {
+		t.Fatalf("GET /snapshot.cgi error = %v", err)
+	}
+	response.Body.Close()
+
+	etag := response.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("GET /snapshot.cgi has no ETag")
+	}
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		want        int
+	}{
+		{name: "matching", ifNoneMatch: etag, want: http.StatusNotModified},
+		{name: "matching in list", ifNoneMatch: `"other", ` + etag,
+			want: http.StatusNotModified},
+		{name: "weak matching", ifNoneMatch: "W/" + etag,
+			want: http.StatusNotModified},
+		{name: "non-matching", ifNoneMatch: `"other"`, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodGet,
+				server.URL+"/snapshot.cgi", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("If-None-Match", tt.ifNoneMatch)
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatalf("GET /snapshot.cgi error = %v", err)
+			}
+			defer response.Body.Close()
+
+			if response.StatusCode != tt.want {
+				t.Errorf("GET /snapshot.cgi status = %d, want %d",
+					response.StatusCode, tt.want)
+			}
+
+			body, _ := io.ReadAll(response.Body)
+			wantBody := testJPEG
+			if tt.want == http.StatusNotModified {
+				wantBody = nil
+			}
+
+			if !bytes.Equal(body, wantBody) {
+				t.Errorf("GET /snapshot.cgi body = %x, want %x", body, wantBody)
+			}
+
+			if got := response.Header.Get("ETag"); got != etag {
+				t.Errorf("GET /snapshot.cgi ETag = %s, want %s", got, etag)
+			}
+		})
+	}
+}
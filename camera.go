@@ -0,0 +1,851 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
+)
+
+// Type camera represents a single AirCam and its authenticated session.
+// Cameras are either defined in the SNAPSHOT_CONFIG file, or by the
+// SNAPSHOT_URL, SNAPSHOT_LOGIN_URL, SNAPSHOT_RTSP_URL, SNAPSHOT_USERNAME,
+// SNAPSHOT_PASSWORD, SNAPSHOT_IGNORE_SSL, and SNAPSHOT_CA_FILE environment
+// variables when it is not set.
+type camera struct {
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	LoginURL  string `json:"loginUrl"`
+	RTSPURL   string `json:"rtspUrl"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	IgnoreSSL bool   `json:"ignoreSSL"`
+	CAFile    string `json:"caFile"`
+
+	// Overrides of SNAPSHOT_RATE_LIMIT, SNAPSHOT_RATE_BURST, and
+	// SNAPSHOT_MAX_CONCURRENT_FETCHES for the camera, or nil to use them
+	RateLimit            *float64 `json:"rateLimit"`
+	RateBurst            *int     `json:"rateBurst"`
+	MaxConcurrentFetches *int     `json:"maxConcurrentFetches"`
+
+	// Guards the URLs, credentials, HTTP client, and limits of the camera,
+	// which are replaced when the camera config is reloaded
+	upstreamMutex sync.RWMutex
+
+	// Parsed URLs of the AirCam which endpoint URLs are resolved against, the
+	// login URL being the camera URL in use unless another is configured. A
+	// camera with failover URLs uses one of them at a time, see failover.
+	baseURLs     []*url.URL
+	baseURL      *url.URL
+	loginBaseURL *url.URL
+
+	// Session cookies of the failover URLs not currently in use, as each URL
+	// issues its own session
+	urlSessions map[*url.URL]*http.Cookie
+
+	// Path of the snapshot endpoint on the AirCam
+	path string
+
+	// HTTP client for the camera, configured with its TLS settings, which is
+	// a fake client returning canned responses in tests
+	client httpDoer
+
+	// Authenticator of requests to the AirCam, by form login or Digest
+	auth authenticator
+
+	// Session with the AirCam, shared by all handlers for the camera and
+	// refreshed by whichever handler first notices that it has expired.
+	session session
+
+	// Whether there has been recent access to snapshots
+	recentActivity atomic.Bool
+
+	// Whether the camera appears to be rebooting, after its connection was
+	// lost and until a request succeeds again
+	rebooting atomic.Bool
+
+	// Cached result of the most recent health check
+	healthChecked time.Time
+	healthErr     error
+	healthMutex   sync.Mutex
+
+	// Recently fetched frames, keyed by upstream URL, and the in-flight fetches
+	// which populate them
+	cache      map[string]*frame
+	cacheMutex sync.Mutex
+	flight     singleflight.Group
+	stats      cacheStats
+
+	// Circuit breaker of upstream fetches
+	breaker breaker
+
+	// Most recently fetched frames, served by the /frames.zip route
+	frames frameBuffer
+
+	// Broadcast of frames to WebSocket clients
+	broadcast broadcaster
+
+	// RTSP session of the RTSP source, kept open between snapshots
+	rtsp rtspSession
+
+	// Rate limiter of snapshot requests, or nil if unlimited
+	limiter *rate.Limiter
+
+	// Rate limiters of snapshot requests from each client IP
+	clientLimiters clientLimiters
+
+	// Slots of the concurrent fetches from the AirCam, or nil if unlimited
+	fetches chan struct{}
+
+	// Number of fetches in flight, and when a fetch last started or finished
+	// in Unix nanoseconds, checked by the watchdog
+	fetching      atomic.Int64
+	fetchProgress atomic.Int64
+
+	// Outcome of recent upstream fetches and the number of logins made to
+	// replace the session, reported by the /debug route
+	status   fetchStatus
+	relogins atomic.Int64
+}
+
+// newCameras creates the cameras to proxy, which are loaded from the config
+// file if defined, otherwise it is the single camera defined by environment
+// variables.
+// It returns the cameras, and any errors encountered loading the config file.
+func newCameras() ([]*camera, error) {
+	cameras := []*camera{{
+		URL:       conf.URL,
+		LoginURL:  conf.LoginURL,
+		RTSPURL:   conf.RTSPURL,
+		Username:  conf.Username,
+		Password:  conf.Password,
+		IgnoreSSL: conf.IgnoreSSL,
+		CAFile:    conf.CAFile,
+	}}
+
+	if conf.Config != "" {
+		var err error
+		cameras, err = loadCameras(conf.Config)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid camera config in SNAPSHOT_CONFIG: %s",
+				err)
+		}
+	}
+
+	// Create the HTTP client and session of each camera
+	for _, c := range cameras {
+		var roots *x509.CertPool
+		if c.CAFile != "" {
+			var err error
+			roots, _, err = loadCAFile(c.CAFile)
+
+			if err != nil {
+				return nil, fmt.Errorf("Invalid CA file for camera %q: %s", c.Name,
+					err)
+			}
+		}
+
+		// Parse the URL and any failover URLs, of which the first is used
+		// until it becomes unreachable
+		c.baseURLs = nil
+		for _, rawURL := range splitURLs(c.URL) {
+			baseURL, err := url.Parse(rawURL)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid URL for camera %q: %s", c.Name,
+					err)
+			}
+
+			c.baseURLs = append(c.baseURLs, baseURL)
+		}
+
+		// The RTSP source has no camera URL
+		if len(c.baseURLs) == 0 {
+			c.baseURLs = []*url.URL{{}}
+		}
+
+		c.baseURL = c.baseURLs[0]
+		c.loginBaseURL = c.baseURL
+
+		if c.LoginURL != "" {
+			var err error
+			c.loginBaseURL, err = url.Parse(c.LoginURL)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid login URL for camera %q: %s",
+					c.Name, err)
+			}
+		}
+
+		c.path = conf.CameraPath
+		c.client = newClient(c.IgnoreSSL, roots)
+		c.auth = newAuthenticator(c)
+		c.session.login = c.relogin
+
+		rateLimit, rateBurst, maxFetches := c.limits()
+		if rateLimit > 0 {
+			c.limiter = rate.NewLimiter(rate.Limit(rateLimit), rateBurst)
+		}
+
+		if maxFetches > 0 {
+			c.fetches = make(chan struct{}, maxFetches)
+		}
+	}
+
+	return cameras, nil
+}
+
+// limits determines the rate limit, burst, and maximum concurrent fetches of
+// the camera, from its overrides in the config file or the global settings.
+// It returns the limits, which are 0 when unlimited.
+func (c *camera) limits() (float64, int, int) {
+	rateLimit, rateBurst := conf.RateLimit, conf.RateBurst
+	maxFetches := conf.MaxConcurrentFetches
+
+	if c.RateLimit != nil {
+		rateLimit = *c.RateLimit
+	}
+	if c.RateBurst != nil {
+		rateBurst = *c.RateBurst
+	}
+	if c.MaxConcurrentFetches != nil {
+		maxFetches = *c.MaxConcurrentFetches
+	}
+
+	return rateLimit, rateBurst, maxFetches
+}
+
+// cameraNamePattern matches the names of cameras, which form the route prefix of
+// their handlers and the label of their metrics.
+var cameraNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// loadCameras reads the camera definitions from a JSON config file, which
+// contains a list of objects with name, url, username, password, and ignoreSSL
+// fields.
+// It returns the cameras, and any errors encountered reading or validating the
+// file.
+func loadCameras(path string) ([]*camera, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cameras []*camera
+	if err := json.Unmarshal(data, &cameras); err != nil {
+		return nil, err
+	}
+
+	if len(cameras) == 0 {
+		return nil, errors.New("no cameras defined")
+	}
+
+	// Validate each camera, ensuring names are usable and unique as they form
+	// the route prefix of the camera's handlers.
+	names := map[string]bool{}
+	for i, c := range cameras {
+		switch {
+		case !cameraNamePattern.MatchString(c.Name) ||
+			strings.Trim(c.Name, ".") == "":
+			return nil, fmt.Errorf("camera %d has invalid name %q, which must "+
+				"consist of letters, digits, '.', '_', or '-', and not only '.'",
+				i, c.Name)
+		case names[c.Name]:
+			return nil, fmt.Errorf("camera %q is defined more than once", c.Name)
+		case strings.TrimSpace(c.Username) == "" ||
+			strings.TrimSpace(c.Password) == "":
+			return nil, fmt.Errorf("camera %q requires username and password",
+				c.Name)
+		case c.RateLimit != nil && *c.RateLimit < 0:
+			return nil, fmt.Errorf("camera %q has invalid rateLimit: must be "+
+				"non-negative", c.Name)
+		case c.RateBurst != nil && *c.RateBurst <= 0:
+			return nil, fmt.Errorf("camera %q has invalid rateBurst: must be "+
+				"positive", c.Name)
+		case c.MaxConcurrentFetches != nil && *c.MaxConcurrentFetches < 0:
+			return nil, fmt.Errorf("camera %q has invalid maxConcurrentFetches: "+
+				"must be non-negative", c.Name)
+		}
+
+		// The RTSP source uses the RTSP stream URL rather than the camera URL
+		if conf.Source == sourceRTSP {
+			c.RTSPURL = strings.TrimSpace(c.RTSPURL)
+			if err := validateRTSPURL(c.RTSPURL); err != nil {
+				return nil, fmt.Errorf("camera %q has invalid rtspUrl: %s",
+					c.Name, err)
+			}
+
+			names[c.Name] = true
+			continue
+		}
+
+		c.URL = strings.TrimSpace(c.URL)
+		if err := validateURLs(c.URL); err != nil {
+			return nil, fmt.Errorf("camera %q has invalid url: %s", c.Name, err)
+		}
+
+		c.LoginURL = strings.TrimSpace(c.LoginURL)
+		if c.LoginURL != "" {
+			if err := validateURL(c.LoginURL); err != nil {
+				return nil, fmt.Errorf("camera %q has invalid loginUrl: %s",
+					c.Name, err)
+			}
+		}
+
+		names[c.Name] = true
+	}
+
+	return cameras, nil
+}
+
+// Type httpDoer makes HTTP requests, which is satisfied by *http.Client, so that
+// requests to a camera can be made by a fake client returning canned responses.
+type httpDoer interface {
+	Do(request *http.Request) (*http.Response, error)
+}
+
+// withoutRedirects returns a copy of an HTTP client which does not follow
+// redirects, returning the redirect response instead. Clients other than
+// *http.Client are returned as-is.
+func withoutRedirects(client httpDoer) httpDoer {
+	httpClient, ok := client.(*http.Client)
+	if !ok {
+		return client
+	}
+
+	unfollowed := *httpClient
+	unfollowed.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	return &unfollowed
+}
+
+// withoutTimeout returns a copy of an HTTP client without its overall request
+// timeout, for continuous responses. Clients other than *http.Client are
+// returned as-is.
+func withoutTimeout(client httpDoer) httpDoer {
+	httpClient, ok := client.(*http.Client)
+	if !ok {
+		return client
+	}
+
+	unbounded := *httpClient
+	unbounded.Timeout = 0
+
+	return &unbounded
+}
+
+// newClient creates an HTTP client with its own transport, so that each camera
+// can have different TLS settings. Certificates are verified against roots, or
+// the system roots if nil.
+func newClient(ignoreSSL bool, roots *x509.CertPool) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	// Set the ignore SSL setting, root CAs, and any client certificate in the
+	// HTTP client
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: ignoreSSL,
+		RootCAs:            roots,
+		Certificates:       conf.clientCertificates,
+	}
+
+	// Bound the whole request, as well as connection establishment, by the
+	// timeout so that a hung AirCam can not block handlers forever.
+	transport.DialContext = (&net.Dialer{
+		Timeout:   conf.Timeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = conf.Timeout
+
+	// Bound waiting for the response headers by the timeout too, which still
+	// applies to continuous responses the overall timeout is lifted for
+	transport.ResponseHeaderTimeout = conf.Timeout
+
+	// Route requests through the configured proxy, keeping the proxy from the
+	// environment of the default transport if there is none
+	if conf.NoUpstreamProxy {
+		transport.Proxy = nil
+	} else if conf.UpstreamProxy != nil {
+		transport.Proxy = http.ProxyURL(conf.UpstreamProxy)
+	}
+
+	// Keep enough idle connections to the AirCam warm that frequent polling
+	// does not open a new connection, and TLS handshake, for every request.
+	transport.MaxIdleConns = conf.MaxIdleConns
+	transport.MaxIdleConnsPerHost = conf.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = conf.IdleConnTimeout
+
+	return &http.Client{
+		Transport: headerTransport{transport},
+		Timeout:   conf.Timeout,
+	}
+}
+
+// Type headerTransport is an HTTP transport which sets the configured
+// User-Agent and upstream headers on every request to the AirCam.
+type headerTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip sets the headers on a copy of the request, as a transport must not
+// modify the request, and sends it with the underlying transport.
+func (t headerTransport) RoundTrip(request *http.Request) (*http.Response,
+	error) {
+	request = request.Clone(request.Context())
+	request.Header.Set("User-Agent", conf.UserAgent)
+
+	for name, values := range conf.UpstreamHeaders {
+		request.Header[name] = values
+	}
+
+	return t.base.RoundTrip(request)
+}
+
+// CloseIdleConnections closes the idle connections of the underlying
+// transport, so that http.Client.CloseIdleConnections reaches it.
+func (t headerTransport) CloseIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// loadCAFile reads a PEM file of CA certificates, such as the self-signed
+// certificate of an AirCam, to verify the camera against.
+// It returns the pool of certificates, the earliest time at which one of them
+// expires, and any errors encountered reading or parsing the file or if it
+// contains no certificates.
+func loadCAFile(path string) (*x509.CertPool, time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	roots := x509.NewCertPool()
+	var notAfter time.Time
+	for block, rest := pem.Decode(data); block != nil; block, rest =
+		pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		roots.AddCert(certificate)
+		if notAfter.IsZero() || certificate.NotAfter.Before(notAfter) {
+			notAfter = certificate.NotAfter
+		}
+	}
+
+	if notAfter.IsZero() {
+		return nil, time.Time{}, errors.New("no PEM certificates found")
+	}
+
+	return roots, notAfter, nil
+}
+
+// endpoint builds the URL of an endpoint on the AirCam by resolving its path
+// against the camera URL, see resolveEndpoint.
+// It returns the URL with the raw query appended, if any.
+func (c *camera) endpoint(path string, rawQuery string) string {
+	c.upstreamMutex.RLock()
+	defer c.upstreamMutex.RUnlock()
+
+	return resolveEndpoint(c.baseURL, path, rawQuery)
+}
+
+// loginEndpoint builds the URL of a login endpoint on the AirCam by resolving
+// its path against the login URL of the camera, see resolveEndpoint.
+// It returns the URL.
+func (c *camera) loginEndpoint(path string) string {
+	c.upstreamMutex.RLock()
+	defer c.upstreamMutex.RUnlock()
+
+	return resolveEndpoint(c.loginBaseURL, path, "")
+}
+
+// activeURL retrieves the URL of the AirCam currently in use, which is the
+// first URL of the camera unless it failed over to another.
+func (c *camera) activeURL() *url.URL {
+	c.upstreamMutex.RLock()
+	defer c.upstreamMutex.RUnlock()
+
+	return c.baseURL
+}
+
+// urlCount retrieves the number of URLs of the camera, including the failover
+// URLs.
+func (c *camera) urlCount() int {
+	c.upstreamMutex.RLock()
+	defer c.upstreamMutex.RUnlock()
+
+	return len(c.baseURLs)
+}
+
+// failover switches the camera from an unreachable URL to the next of its
+// URLs, wrapping around to the first, keeping the session of the unreachable
+// URL for when the camera switches back to it. The next URL is used with its
+// own session, if it has one, until it becomes unreachable in turn, so that
+// failover is sticky. If another request already switched away from the
+// unreachable URL, the camera is left as-is.
+func (c *camera) failover(ctx context.Context, unreachable *url.URL,
+	err error) {
+	c.session.Swap(func(current *http.Cookie) (*http.Cookie, bool) {
+		c.upstreamMutex.Lock()
+		defer c.upstreamMutex.Unlock()
+
+		if c.baseURL != unreachable || len(c.baseURLs) < 2 {
+			return current, false
+		}
+
+		next := c.baseURLs[0]
+		for i, baseURL := range c.baseURLs[:len(c.baseURLs)-1] {
+			if baseURL == unreachable {
+				next = c.baseURLs[i+1]
+			}
+		}
+
+		c.logger("image").WarnContext(ctx,
+			"Camera URL unreachable, failing over", "from",
+			unreachable.Redacted(), "to", next.Redacted(), "error", err)
+
+		if c.urlSessions == nil {
+			c.urlSessions = map[*url.URL]*http.Cookie{}
+		}
+
+		c.urlSessions[unreachable] = current
+		resumed := c.urlSessions[next]
+		delete(c.urlSessions, next)
+
+		if c.LoginURL == "" {
+			c.loginBaseURL = next
+		}
+		c.baseURL = next
+
+		return resumed, true
+	})
+}
+
+// credentials retrieves the username and password of the camera.
+func (c *camera) credentials() (string, string) {
+	c.upstreamMutex.RLock()
+	defer c.upstreamMutex.RUnlock()
+
+	return c.Username, c.Password
+}
+
+// httpClient retrieves the HTTP client of the camera.
+func (c *camera) httpClient() httpDoer {
+	c.upstreamMutex.RLock()
+	defer c.upstreamMutex.RUnlock()
+
+	return c.client
+}
+
+// resolveEndpoint builds the URL of an endpoint by resolving its path against a
+// base URL, so that the base URL can have a path of its own, with or without a
+// trailing slash, and an IPv6 host.
+// It returns the URL with the raw query appended, if any.
+func resolveEndpoint(baseURL *url.URL, path string, rawQuery string) string {
+	// Resolve the path relative to the base URL as a directory, rather than
+	// replacing its path
+	base := *baseURL
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+		base.RawPath = ""
+	}
+
+	return base.ResolveReference(&url.URL{
+		Path:     strings.TrimPrefix(path, "/"),
+		RawQuery: rawQuery,
+	}).String()
+}
+
+// route prefixes a path with the name of the camera, so that each camera is
+// served under /{name}. The camera defined by environment variables has no
+// name and is served at the root.
+func (c *camera) route(path string) string {
+	if c.Name == "" {
+		return path
+	}
+
+	return fmt.Sprintf("/%s%s", c.Name, path)
+}
+
+// relogin performs the login process for the camera to replace an expired
+// session.
+// It returns a session cookie, and any errors encountered during login.
+func (c *camera) relogin(ctx context.Context) (*http.Cookie, error) {
+	relogins.WithLabelValues(c.label()).Inc()
+	c.relogins.Add(1)
+
+	sessionCookie, err := c.login(ctx)
+	if err != nil {
+		c.logger("login").ErrorContext(ctx, "Login failed", "error", err)
+		return nil, err
+	}
+
+	return sessionCookie, nil
+}
+
+// keepalive runs every keepalive period and makes an empty request to the
+// snapshot route. This is because the session expires on the aircam if
+// inactive for 15 minutes.
+func (c *camera) keepalive(ticker *time.Ticker) {
+	for range ticker.C {
+		// Run an empty getImage if no recent activity, otherwise reset flag.
+		if !c.recentActivity.Swap(false) {
+			c.logger("keepalive").Info("Running keepalive")
+			c.getImage(context.Background(), io.Discard, nil)
+		}
+	}
+}
+
+// keepWarm runs every keep-warm interval and fetches a frame which is
+// discarded, independent of client requests, so that the capture pipeline of
+// the AirCam stays active rather than producing a dark or blurry first frame
+// after idle periods. The frame is cached like any other, so it is also served
+// to clients. Failures are only logged at debug level, as they are retried on
+// the next tick.
+func (c *camera) keepWarm(ticker *time.Ticker) {
+	for range ticker.C {
+		if _, err := c.getFrame(context.Background(), nil); err != nil {
+			c.logger("keepwarm").Debug("Keep-warm fetch failed", "error", err)
+		}
+	}
+}
+
+// refreshSession runs every session refresh interval and logs in again, so that
+// the session is replaced before the AirCam expires it. If a refresh fails, the
+// current session is kept and replaced by the next request to find it expired.
+func (c *camera) refreshSession(ticker *time.Ticker) {
+	for range ticker.C {
+		c.logger("refresh").Info("Refreshing session")
+
+		if err := c.session.Refresh(context.Background()); err != nil {
+			c.logger("refresh").Warn("Session refresh failed, keeping session",
+				"error", err)
+			continue
+		}
+
+		c.logger("refresh").Info("Refreshed session")
+	}
+}
+
+// handleSnapshot is the handler function for retrieving images from the
+// camera.
+func (c *camera) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	// Only serve reads, with HEAD fetching the image for its headers alone
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodHead:
+		w = headWriter{w}
+	default:
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Respond with 304 rather than the image if the client already has it
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		w = &conditionalWriter{ResponseWriter: w, ifNoneMatch: ifNoneMatch}
+	}
+
+	c.logger("image").DebugContext(r.Context(), "Getting image")
+	snapshotRequests.WithLabelValues(c.label()).Inc()
+
+	// Apply the debug delay, abandoning the request if the client goes away
+	if conf.DebugDelay > 0 {
+		select {
+		case <-time.After(conf.DebugDelay):
+		case <-r.Context().Done():
+			c.logger("image").DebugContext(r.Context(),
+				"Client cancelled during debug delay")
+			return
+		}
+	}
+
+	// Parse any requested resizing or transcoding, rejecting invalid values
+	t, err := parseTransform(r.URL.Query())
+	if err != nil {
+		c.logger("image").DebugContext(r.Context(), "Invalid transform",
+			"error", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest),
+			http.StatusBadRequest)
+		return
+	}
+
+	// Retrieve image from AirCam, passing it through untouched unless a
+	// transform was requested, responding with the fallback image or an error
+	// status instead if the retrieval failed.
+	query := forwardedQuery(r.URL.Query())
+	if t.empty() {
+		err = c.getImage(r.Context(), w, query)
+	} else {
+		err = c.getTransformedImage(r.Context(), w, query, t)
+	}
+
+	if errors.Is(err, context.Canceled) {
+		c.logger("image").DebugContext(r.Context(), "Client cancelled request")
+		return
+	} else if errors.Is(err, errTransformTooLarge) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil && conf.Debug && r.URL.Query().Get("debug") == "1" &&
+		writeDebugError(w, err) {
+		return
+	} else if err != nil && conf.FallbackImage != nil {
+		serveFallback(w)
+		return
+	} else if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	c.recentActivity.Store(true)
+}
+
+// Type snapshotJSON represents the JSON body returned by the /snapshot.json
+// route, with the image as a data URI.
+type snapshotJSON struct {
+	Timestamp   time.Time `json:"timestamp"`
+	ContentType string    `json:"contentType"`
+	Data        string    `json:"data"`
+}
+
+// handleSnapshotJSON is the handler function for retrieving images from the
+// camera as JSON, for front-ends which consume images as data URIs.
+func (c *camera) handleSnapshotJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	snapshotRequests.WithLabelValues(c.label()).Inc()
+
+	f, err := c.getFrameOrStale(r.Context(), forwardedQuery(r.URL.Query()))
+	if errors.Is(err, context.Canceled) {
+		c.logger("image").DebugContext(r.Context(), "Client cancelled request")
+		return
+	} else if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if f.stale {
+		w.Header().Set("X-Snapshot-Stale", "true")
+	}
+
+	json.NewEncoder(w).Encode(snapshotJSON{
+		Timestamp:   f.captured.UTC(),
+		ContentType: "image/jpeg",
+		Data: "data:image/jpeg;base64," +
+			base64.StdEncoding.EncodeToString(f.image),
+	})
+
+	c.recentActivity.Store(true)
+}
+
+// serveFallback responds with the fallback image in place of a snapshot which
+// could not be retrieved, marked by the X-Snapshot-Fallback header.
+func serveFallback(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(conf.FallbackImage)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Snapshot-Fallback", "true")
+	w.WriteHeader(conf.FallbackStatus)
+	w.Write(conf.FallbackImage)
+}
+
+// Type headWriter is a response writer for HEAD requests, which keeps the
+// headers of the response but discards its body.
+type headWriter struct {
+	http.ResponseWriter
+}
+
+// Write discards the body, reporting it as written.
+func (hw headWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// Type conditionalWriter is a response writer for requests with an
+// If-None-Match header, which responds with 304 Not Modified and discards the
+// body when the ETag of a successful response matches it.
+type conditionalWriter struct {
+	http.ResponseWriter
+	ifNoneMatch string
+	wroteHeader bool
+	notModified bool
+}
+
+// WriteHeader writes the status, replacing 200 with 304 if the ETag of the
+// response matches.
+func (cw *conditionalWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+
+	etag := cw.Header().Get("ETag")
+	if status == http.StatusOK && etag != "" &&
+		etagMatches(cw.ifNoneMatch, etag) {
+		cw.notModified = true
+		cw.Header().Del("Content-Length")
+		cw.Header().Del("Content-Type")
+		status = http.StatusNotModified
+	}
+
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes the body, discarding it if the response is not modified.
+func (cw *conditionalWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.notModified {
+		return len(p), nil
+	}
+
+	return cw.ResponseWriter.Write(p)
+}
+
+// etagMatches checks whether an ETag is listed in an If-None-Match header, or
+// the header is *, using the weak comparison of RFC 9110.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadCamerasValidatesNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: "front"},
+		{name: "Back_Door-2.cam"},
+		{name: "", wantErr: true},
+		{name: "front/door", wantErr: true},
+		{name: "front door", wantErr: true},
+		{name: "{name}", wantErr: true},
+		{name: "caméra", wantErr: true},
+		{name: "..", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, map[string]string{
+				"SNAPSHOT_URL":      "http://aircam",
+				"SNAPSHOT_USERNAME": "ubnt",
+				"SNAPSHOT_PASSWORD": "secret",
+			})
+
+			path := filepath.Join(t.TempDir(), "cameras.json")
+			data := fmt.Sprintf(`[{"name": %q, "url": "http://aircam", `+
+				`"username": "ubnt", "password": "secret"}]`, tt.name)
+			if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := loadCameras(path)
+			switch {
+			case tt.wantErr && (err == nil ||
+				!strings.Contains(err.Error(), "invalid name")):
+				t.Errorf("loadCameras() error = %v, want invalid name", err)
+			case !tt.wantErr && err != nil:
+				t.Errorf("loadCameras() error = %v", err)
+			}
+		})
+	}
+}
+
+func BenchmarkConnectionReuse(b *testing.B) {
+	tests := []struct {
+		name    string
+		maxIdle string
+	}{
+		{
+			name:    "default",
+			maxIdle: strconv.Itoa(http.DefaultMaxIdleConnsPerHost),
+		},
+		{name: "tuned", maxIdle: "10"},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			var handshakes atomic.Int64
+			upstream := httptest.NewUnstartedServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Type", "image/jpeg")
+					w.Write(testJPEG)
+				}))
+			upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					handshakes.Add(1)
+				}
+			}
+			upstream.StartTLS()
+			b.Cleanup(upstream.Close)
+
+			setTestConfig(b, map[string]string{
+				"SNAPSHOT_URL":                     upstream.URL,
+				"SNAPSHOT_USERNAME":                "ubnt",
+				"SNAPSHOT_PASSWORD":                "secret",
+				"SNAPSHOT_MAX_IDLE_CONNS_PER_HOST": tt.maxIdle,
+			})
+			client := newClient(true, nil)
+
+			b.SetParallelism(4)
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					response, err := client.Get(upstream.URL)
+					if err != nil {
+						b.Errorf("Get() error = %v", err)
+						return
+					}
+
+					io.Copy(io.Discard, response.Body)
+					response.Body.Close()
+				}
+			})
+
+			b.ReportMetric(float64(handshakes.Load())/float64(b.N),
+				"handshakes/op")
+		})
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		wantErr bool
+	}{
+		{name: "fast upstream", delay: 0},
+		{name: "slow upstream", delay: time.Second, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					select {
+					case <-time.After(tt.delay):
+					case <-r.Context().Done():
+						return
+					}
+
+					w.Header().Set("Content-Type", "image/jpeg")
+					w.Write(testJPEG)
+				}))
+			t.Cleanup(upstream.Close)
+
+			setTestConfig(t, map[string]string{
+				"SNAPSHOT_URL":      upstream.URL,
+				"SNAPSHOT_USERNAME": "ubnt",
+				"SNAPSHOT_PASSWORD": "secret",
+				"SNAPSHOT_TIMEOUT":  "100ms",
+			})
+			client := newClient(false, nil)
+
+			start := time.Now()
+			response, err := client.Get(upstream.URL)
+			if err == nil {
+				response.Body.Close()
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var netErr net.Error
+			if tt.wantErr && (!errors.As(err, &netErr) || !netErr.Timeout()) {
+				t.Errorf("Get() error = %v, want a timeout", err)
+			}
+
+			if elapsed := time.Since(start); tt.wantErr &&
+				elapsed >= tt.delay {
+				t.Errorf("Get() took %s, want the timeout to fire first",
+					elapsed)
+			}
+		})
+	}
+}
+
+func TestResolveEndpoint(t *testing.T) {
+	tests := []struct {
+		baseURL string
+		path    string
+		query   string
+		want    string
+	}{
+		{baseURL: "http://aircam.local", path: "/snapshot.cgi",
+			want: "http://aircam.local/snapshot.cgi"},
+		{baseURL: "http://aircam.local/", path: "/snapshot.cgi",
+			want: "http://aircam.local/snapshot.cgi"},
+		{baseURL: "http://aircam.local:8080", path: "/snapshot.cgi",
+			query: "chan=1", want: "http://aircam.local:8080/snapshot.cgi?chan=1"},
+		{baseURL: "https://[fe80::1]", path: "/login.cgi",
+			want: "https://[fe80::1]/login.cgi"},
+		{baseURL: "https://[fe80::1]:8443/", path: "/snapshot.cgi",
+			want: "https://[fe80::1]:8443/snapshot.cgi"},
+		{baseURL: "http://proxy.local/aircam", path: "/snapshot.cgi",
+			want: "http://proxy.local/aircam/snapshot.cgi"},
+		{baseURL: "http://proxy.local/aircam/", path: "/snapshot.cgi",
+			want: "http://proxy.local/aircam/snapshot.cgi"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.baseURL, func(t *testing.T) {
+			baseURL, err := url.Parse(tt.baseURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := resolveEndpoint(baseURL, tt.path, tt.query)
+			if got != tt.want {
+				t.Errorf("resolveEndpoint(%s, %s) = %s, want %s", tt.baseURL,
+					tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamHeaders(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, map[string]string{
+		"SNAPSHOT_USER_AGENT":       "wall-display/2.1",
+		"SNAPSHOT_UPSTREAM_HEADERS": "X-Forwarded-Proto:https,X-Proxy-Token: abc",
+	})
+
+	sessionCookie, err := c.login(context.Background())
+	if err != nil {
+		t.Fatalf("login() error = %v", err)
+	}
+
+	if _, _, err := c.requestImage(context.Background(), sessionCookie,
+		nil); err != nil {
+		t.Fatalf("requestImage() error = %v", err)
+	}
+
+	aircam.mutex.Lock()
+	defer aircam.mutex.Unlock()
+
+	// The initial page, login, and snapshot requests all carry the headers
+	if len(aircam.headers) != 3 {
+		t.Fatalf("requests = %d, want 3", len(aircam.headers))
+	}
+
+	for i, header := range aircam.headers {
+		want := map[string]string{
+			"User-Agent":        "wall-display/2.1",
+			"X-Forwarded-Proto": "https",
+			"X-Proxy-Token":     "abc",
+		}
+		for name, value := range want {
+			if got := header.Get(name); got != value {
+				t.Errorf("request %d header %s = %q, want %q", i, name, got,
+					value)
+			}
+		}
+	}
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	target, err := url.Parse(aircam.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake proxy forwards requests for the unresolvable camera host to the
+	// fake AirCam, so that requests only succeed through the proxy
+	var proxied atomic.Int64
+	forward := httputil.NewSingleHostReverseProxy(target)
+	proxy := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Host != "aircam.invalid" {
+				http.Error(w, "unknown host", http.StatusBadGateway)
+				return
+			}
+
+			proxied.Add(1)
+			forward.ServeHTTP(w, r)
+		}))
+	t.Cleanup(proxy.Close)
+
+	setTestConfig(t, map[string]string{
+		"SNAPSHOT_URL":       "http://aircam.invalid",
+		"SNAPSHOT_USERNAME":  "ubnt",
+		"SNAPSHOT_PASSWORD":  "secret",
+		"SNAPSHOT_PROXY_URL": proxy.URL,
+	})
+
+	cameras, err := newCameras()
+	if err != nil {
+		t.Fatalf("newCameras() error = %v", err)
+	}
+	c := cameras[0]
+
+	sessionCookie, err := c.login(context.Background())
+	if err != nil {
+		t.Fatalf("login() error = %v", err)
+	}
+
+	image, _, err := c.requestImage(context.Background(), sessionCookie, nil)
+	if err != nil {
+		t.Fatalf("requestImage() error = %v", err)
+	}
+
+	if !bytes.Equal(image, testJPEG) {
+		t.Errorf("requestImage() = %x, want %x", image, testJPEG)
+	}
+
+	// The initial page, login, and snapshot requests were all proxied
+	if got := proxied.Load(); got != 3 {
+		t.Errorf("proxied requests = %d, want 3", got)
+	}
+}
+
+func TestUpstreamProxyDisabled(t *testing.T) {
+	setTestConfig(t, map[string]string{
+		"SNAPSHOT_URL":       "http://aircam.local",
+		"SNAPSHOT_USERNAME":  "ubnt",
+		"SNAPSHOT_PASSWORD":  "secret",
+		"SNAPSHOT_PROXY_URL": "none",
+	})
+
+	client := newClient(false, nil)
+	transport := client.Transport.(headerTransport).base.(*http.Transport)
+	if transport.Proxy != nil {
+		t.Error("newClient() proxy is set, want none")
+	}
+}
+
+// Type doerFunc is an httpDoer calling a function for each request, such as a
+// fake client returning canned responses without a server.
+type doerFunc func(request *http.Request) (*http.Response, error)
+
+// Do makes a request by calling the function.
+func (f doerFunc) Do(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+// cannedResponse builds a response to a request with a status, headers, and
+// body.
+func cannedResponse(request *http.Request, status int, header http.Header,
+	body []byte) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+
+	return &http.Response{
+		StatusCode: status,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Request:    request,
+	}
+}
+
+func TestFakeHTTPDoer(t *testing.T) {
+	setTestConfig(t, map[string]string{
+		"SNAPSHOT_URL":      "http://aircam.invalid",
+		"SNAPSHOT_USERNAME": "ubnt",
+		"SNAPSHOT_PASSWORD": "secret",
+	})
+
+	cameras, err := newCameras()
+	if err != nil {
+		t.Fatalf("newCameras() error = %v", err)
+	}
+	c := cameras[0]
+
+	var requests []string
+	c.client = doerFunc(func(request *http.Request) (*http.Response, error) {
+		requests = append(requests, request.Method+" "+request.URL.Path)
+
+		switch request.URL.Path {
+		case "/":
+			return cannedResponse(request, http.StatusOK, http.Header{
+				"Set-Cookie": {"AIROS_SESSIONID=canned"},
+			}, nil), nil
+		case "/login.cgi":
+			return cannedResponse(request, http.StatusFound, http.Header{
+				"Location": {"/snapshot.cgi"},
+			}, nil), nil
+		case "/snapshot.cgi":
+			if cookie, err := request.Cookie("AIROS_SESSIONID"); err != nil ||
+				cookie.Value != "canned" {
+				return cannedResponse(request, http.StatusFound, http.Header{
+					"Location": {"/login.cgi"},
+				}, nil), nil
+			}
+
+			return cannedResponse(request, http.StatusOK, http.Header{
+				"Content-Type": {"image/jpeg"},
+			}, testJPEG), nil
+		default:
+			return nil, errors.New("unexpected request")
+		}
+	})
+
+	sessionCookie, err := c.login(context.Background())
+	if err != nil {
+		t.Fatalf("login() error = %v", err)
+	}
+
+	image, _, err := c.requestImage(context.Background(), sessionCookie, nil)
+	if err != nil {
+		t.Fatalf("requestImage() error = %v", err)
+	}
+
+	if !bytes.Equal(image, testJPEG) {
+		t.Errorf("requestImage() = %x, want %x", image, testJPEG)
+	}
+
+	want := []string{"GET /", "POST /login.cgi", "GET /snapshot.cgi"}
+	if !slices.Equal(requests, want) {
+		t.Errorf("requests = %v, want %v", requests, want)
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	certPath, keyPath := writeTestCertificate(t, t.TempDir(),
+		time.Now().Add(24*time.Hour))
+
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(certPEM) {
+		t.Fatal("invalid test certificate")
+	}
+
+	// A server requiring a client certificate signed by the test certificate,
+	// as an mTLS terminating proxy in front of the AirCam does
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write(testJPEG)
+		}))
+	upstream.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{name: "presented", env: map[string]string{
+			"SNAPSHOT_CLIENT_CERT": certPath,
+			"SNAPSHOT_CLIENT_KEY":  keyPath,
+		}},
+		{name: "not presented", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{
+				"SNAPSHOT_URL":        upstream.URL,
+				"SNAPSHOT_USERNAME":   "ubnt",
+				"SNAPSHOT_PASSWORD":   "secret",
+				"SNAPSHOT_IGNORE_SSL": "true",
+			}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+			setTestConfig(t, env)
+
+			cameras, err := newCameras()
+			if err != nil {
+				t.Fatalf("newCameras() error = %v", err)
+			}
+
+			request, err := http.NewRequest(http.MethodGet, upstream.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response, err := cameras[0].httpClient().Do(request)
+			if tt.wantErr {
+				if err == nil {
+					response.Body.Close()
+					t.Fatal("Do() without a client certificate succeeded")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Do() error = %v", err)
+			}
+			defer response.Body.Close()
+
+			if response.StatusCode != http.StatusOK {
+				t.Errorf("status = %d, want %d", response.StatusCode,
+					http.StatusOK)
+			}
+		})
+	}
+}
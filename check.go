@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"io"
+	"net/url"
+	"reflect"
+)
+
+// maskedFields are the configuration fields holding secrets, which are masked
+// when printing the configuration.
+var maskedFields = map[string]bool{
+	"Password":    true,
+	"ProxyPass":   true,
+	"S3SecretKey": true,
+}
+
+// printConfig writes a summary of the effective configuration and cameras, as
+// printed by the -check flag, with passwords masked and any optional features
+// disabled as they failed to load.
+func printConfig(out io.Writer, conf config, cameras []*camera) {
+	fmt.Fprintln(out, "Configuration:")
+	printFields(out, reflect.ValueOf(conf))
+
+	if len(conf.disabled) > 0 {
+		fmt.Fprintln(out, "\nDisabled optional features:")
+		for _, d := range conf.disabled {
+			fmt.Fprintf(out, "  %s: %s\n", d.feature, d.err)
+		}
+	}
+
+	for _, c := range cameras {
+		fmt.Fprintf(out, "\nCamera %s:\n", c.label())
+		printFields(out, reflect.ValueOf(c).Elem())
+	}
+}
+
+// printFields writes each exported field of a struct and its value, one per
+// line, masking secrets and summarizing file contents by size.
+func printFields(out io.Writer, value reflect.Value) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		var formatted interface{} = value.Field(i).Interface()
+		switch data := formatted.(type) {
+		case string:
+			if maskedFields[field.Name] && data != "" {
+				formatted = "***"
+			}
+		case []byte:
+			formatted = fmt.Sprintf("(%d bytes)", len(data))
+		case *url.URL:
+			if data != nil {
+				formatted = data.Redacted()
+			}
+		case color.RGBA:
+			formatted = fmt.Sprintf("#%02x%02x%02x", data.R, data.G, data.B)
+		case *float64:
+			formatted = "(default)"
+			if data != nil {
+				formatted = *data
+			}
+		case *int:
+			formatted = "(default)"
+			if data != nil {
+				formatted = *data
+			}
+		}
+
+		fmt.Fprintf(out, "  %s: %v\n", field.Name, formatted)
+	}
+}
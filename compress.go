@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressMinSize is the size in bytes a response body must reach before it is
+// compressed, as compressing smaller bodies saves little or nothing.
+const compressMinSize = 1024
+
+// compressibleTypes are the media types of responses which are compressed,
+// alongside any text/* type. Images, notably image/jpeg snapshots and streams,
+// are already compressed and are never compressed again.
+var compressibleTypes = []string{
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// Type compressWriter is a response writer which compresses the body with the
+// negotiated encoding, once it is known to be of a compressible type and at
+// least compressMinSize bytes. Smaller bodies are buffered until then and
+// written as-is if the response ends first.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	buffer   []byte
+	decided  bool
+	encoder  io.WriteCloser
+}
+
+// WriteHeader records the status, which is written to the underlying response
+// once it is decided whether to compress the body.
+func (w *compressWriter) WriteHeader(status int) {
+	if w.decided {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// Write buffers or compresses the body, deciding whether to compress it once
+// its type and enough of it are known.
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+
+		// Detect the type of the body as net/http would, if not set
+		header := w.Header()
+		if header.Get("Content-Type") == "" {
+			header.Set("Content-Type", http.DetectContentType(p))
+		}
+
+		if !w.compressible() {
+			if err := w.decide(false); err != nil {
+				return 0, err
+			}
+		} else {
+			w.buffer = append(w.buffer, p...)
+			if len(w.buffer) < compressMinSize {
+				return len(p), nil
+			}
+
+			return len(p), w.decide(true)
+		}
+	}
+
+	if w.encoder != nil {
+		return w.encoder.Write(p)
+	}
+
+	return w.ResponseWriter.Write(p)
+}
+
+// compressible determines whether the response can be compressed, from its
+// status, its type, and whether it is encoded already.
+func (w *compressWriter) compressible() bool {
+	header := w.Header()
+	if w.status < http.StatusOK || w.status == http.StatusNoContent ||
+		w.status == http.StatusNotModified ||
+		header.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+
+	for _, compressible := range compressibleTypes {
+		if mediaType == compressible {
+			return true
+		}
+	}
+
+	return false
+}
+
+// decide writes the headers of the response, compressing the body from here on
+// if enabled, followed by any body buffered so far.
+// It returns any errors encountered writing the buffered body.
+func (w *compressWriter) decide(compress bool) error {
+	w.decided = true
+
+	if compress {
+		header := w.Header()
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", w.encoding)
+
+		if w.encoding == "gzip" {
+			w.encoder = gzip.NewWriter(w.ResponseWriter)
+		} else {
+			w.encoder = zlib.NewWriter(w.ResponseWriter)
+		}
+	}
+
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+
+	if len(w.buffer) == 0 {
+		return nil
+	}
+
+	buffer := w.buffer
+	w.buffer = nil
+
+	var err error
+	if w.encoder != nil {
+		_, err = w.encoder.Write(buffer)
+	} else {
+		_, err = w.ResponseWriter.Write(buffer)
+	}
+
+	return err
+}
+
+// Flush writes out the body so far, for streamed responses, which are sent
+// uncompressed if they are still below compressMinSize.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(false)
+	}
+
+	if flusher, ok := w.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack takes over the connection of the underlying response, for WebSocket
+// upgrades, which are never compressed.
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	w.decided = true
+
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the underlying response, for http.ResponseController.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close writes out any buffered body, uncompressed as it is below
+// compressMinSize, or finishes the compressed body.
+// It returns any errors encountered writing the body.
+func (w *compressWriter) Close() error {
+	if !w.decided {
+		if len(w.buffer) > 0 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(w.buffer)))
+		}
+
+		return w.decide(false)
+	}
+
+	if w.encoder != nil {
+		return w.encoder.Close()
+	}
+
+	return nil
+}
+
+// withCompression wraps a handler, compressing text and JSON responses with
+// gzip or deflate when the client accepts either in its Accept-Encoding header.
+// When compression is disabled, the handler is returned as-is.
+func withCompression(next http.Handler) http.Handler {
+	if conf.DisableCompression {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Responses vary by the encodings accepted whether or not this one
+		// is compressed, so that caches do not serve it to other clients
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead ||
+			r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		compressor := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer compressor.Close()
+
+		next.ServeHTTP(compressor, r)
+	})
+}
+
+// acceptedEncoding chooses the encoding to compress a response with from the
+// Accept-Encoding header of its request, preferring gzip over deflate.
+// It returns the encoding, or an empty string if the client accepts neither.
+func acceptedEncoding(header string) string {
+	accepted := map[string]bool{}
+	for _, value := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(value), ";")
+
+		// Record encodings explicitly refused with a quality of 0 as such
+		refused := false
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			quality, err := strconv.ParseFloat(q, 64)
+			refused = err == nil && quality == 0
+		}
+
+		accepted[strings.ToLower(strings.TrimSpace(coding))] = !refused
+	}
+
+	if gzipAccepted, ok := accepted["gzip"]; ok {
+		accepted["*"] = gzipAccepted
+	}
+
+	switch {
+	case accepted["gzip"] || accepted["*"]:
+		return "gzip"
+	case accepted["deflate"]:
+		return "deflate"
+	default:
+		return ""
+	}
+}
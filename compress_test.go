@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	json := append([]byte(`{"frames":"`), bytes.Repeat([]byte("a"),
+		2*compressMinSize)...)
+	json = append(json, `"}`...)
+	image := append(append(bytes.Clone(jpegSOI),
+		bytes.Repeat([]byte{0x00}, 2*compressMinSize)...), jpegEOI...)
+
+	tests := []struct {
+		name           string
+		contentType    string
+		body           []byte
+		acceptEncoding string
+		wantEncoding   string
+	}{
+		{name: "json", contentType: "application/json", body: json,
+			acceptEncoding: "gzip, deflate", wantEncoding: "gzip"},
+		{name: "json without gzip", contentType: "application/json",
+			body: json},
+		{name: "small json", contentType: "application/json",
+			body: []byte(`{}`), acceptEncoding: "gzip"},
+		{name: "image", contentType: "image/jpeg", body: image,
+			acceptEncoding: "gzip"},
+	}
+
+	setTestConfig(t, map[string]string{
+		"SNAPSHOT_URL":      "http://aircam.local",
+		"SNAPSHOT_USERNAME": "ubnt",
+		"SNAPSHOT_PASSWORD": "secret",
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := withCompression(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Type", tt.contentType)
+					w.Write(tt.body)
+				}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, r)
+
+			encoding := recorder.Header().Get("Content-Encoding")
+			if encoding != tt.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", encoding,
+					tt.wantEncoding)
+			}
+
+			var body io.Reader = recorder.Body
+			if encoding == "gzip" {
+				reader, err := gzip.NewReader(recorder.Body)
+				if err != nil {
+					t.Fatalf("gzip.NewReader() error = %v", err)
+				}
+				body = reader
+			}
+
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("reading body error = %v", err)
+			}
+
+			if !bytes.Equal(got, tt.body) {
+				t.Errorf("body = %q, want %q", got, tt.body)
+			}
+		})
+	}
+}
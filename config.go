@@ -0,0 +1,1229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Type config represents the configuration for the application, with the names
+// of the variables representing their corresponding environment variables.
+//
+// Settings are either required or optional. Required settings, which are the
+// camera URL, username, and password, and any setting which fails to parse,
+// exit at startup when invalid. Optional features which load from files or must
+// be set together, which are the TLS certificate and key, the fallback image,
+// and the proxy username and password, are instead disabled with a warning when
+// they fail to load, so the core server still starts, unless
+// SNAPSHOT_STRICT_CONFIG is set.
+type config struct {
+	URL                  string
+	LoginURL             string
+	AuthMode             string
+	SessionFile          string
+	Source               string
+	RTSPURL              string
+	FFmpeg               string
+	Username             string
+	Password             string
+	IgnoreSSL            bool
+	Port                 int
+	KeepalivePeriod      int
+	KeepWarmInterval     time.Duration
+	ForwardParams        []string
+	PrivacyMask          []image.Rectangle
+	TimestampOverlay     bool
+	TimestampPosition    string
+	TimestampColor       color.RGBA
+	TimestampFormat      string
+	Pipeline             []string
+	ResizeWidth          int
+	ResizeHeight         int
+	LoopRestartDelay     time.Duration
+	FrameTimeHeader      string
+	EnableWS             bool
+	StreamFPS            int
+	FrameBuffer          int
+	DebugDelay           time.Duration
+	CameraPath           string
+	Autodiscover         bool
+	JPEGRepair           string
+	MinHealthyBytes      int
+	MinHealthyFail       bool
+	Timeout              time.Duration
+	Bind                 string
+	Config               string
+	HealthTTL            time.Duration
+	CacheTTL             time.Duration
+	LogCredentials       bool
+	LogFormat            string
+	LogLevel             slog.Level
+	LogFile              string
+	AccessLog            string
+	CORSOrigins          []string
+	TLSCert              string
+	TLSKey               string
+	ClientCert           string
+	ClientKey            string
+	ProxyUser            string
+	ProxyPass            string
+	SaveDir              string
+	SaveInterval         time.Duration
+	S3Endpoint           string
+	S3Bucket             string
+	S3AccessKey          string
+	S3SecretKey          string
+	S3Region             string
+	S3Prefix             string
+	S3Interval           time.Duration
+	LoginRetries         int
+	LoginConcurrency     int
+	AllowedPaths         []string
+	PassthroughHeaders   []string
+	StreamResponse       bool
+	StripHeaders         []string
+	CookieName           string
+	CookiePrefix         bool
+	SessionRefresh       time.Duration
+	SessionMaxAge        time.Duration
+	RateLimit            float64
+	RateBurst            int
+	LoginTokenField      string
+	FieldUsername        string
+	FieldPassword        string
+	FieldURI             string
+	LoginExtraFields     map[string]string
+	MaxConcurrentFetches int
+	FetchRetries         int
+	StrictConfig         bool
+	PerIPRate            float64
+	PerIPBurst           int
+	TrustProxy           bool
+	DisableCompression   bool
+	UnixSocket           string
+	UnixSocketMode       os.FileMode
+	CAFile               string
+	FallbackImage        []byte
+	FallbackStatus       int
+	StartupCheck         bool
+	MaxImageBytes        int64
+	ReadHeaderTimeout    time.Duration
+	WriteTimeout         time.Duration
+	IdleTimeout          time.Duration
+	ServePath            string
+	BreakerThreshold     int
+	BreakerCooldown      time.Duration
+	MaxIdleConns         int
+	MaxIdleConnsPerHost  int
+	IdleConnTimeout      time.Duration
+	StatsInterval        time.Duration
+	UserAgent            string
+	UpstreamHeaders      http.Header
+	LoginFollowRedirects bool
+	StaleMax             time.Duration
+	UpstreamProxy        *url.URL
+	NoUpstreamProxy      bool
+	ViewerEnabled        bool
+	ReloginCooldown      time.Duration
+	Debug                bool
+	MotionWebhook        string
+	MotionInterval       time.Duration
+	MotionThreshold      float64
+	MotionCooldown       time.Duration
+
+	// Processors applied to every frame, from Pipeline
+	pipeline pipeline
+
+	// Client certificates presented to the AirCam, from ClientCert and
+	// ClientKey
+	clientCertificates []tls.Certificate
+
+	// Optional features disabled as they failed to load
+	disabled []disabledFeature
+}
+
+// reservedPaths are the routes of the proxy which can not be used as the
+// snapshot or passthrough paths.
+var reservedPaths = []string{
+	"/snapshot.json",
+	"/healthz",
+	"/ready",
+	"/stream.mjpeg",
+	"/frames.zip",
+	"/ws",
+	"/metrics",
+	"/version",
+	"/admin/relogin",
+	"/admin/reload-tls",
+	"/debug",
+}
+
+// writeTimeoutMargin is added to the upstream timeout for the default write
+// timeout of the HTTP server, allowing time to write the snapshot.
+const writeTimeoutMargin = 5 * time.Second
+
+// Type disabledFeature represents an optional feature which was disabled as
+// its configuration failed to load, and why.
+type disabledFeature struct {
+	feature string
+	err     error
+}
+
+// Type envParser parses typed configuration values from environment variables
+// using a getenv function, recording the first error encountered so that each
+// value does not need to be checked individually. Unset and empty variables are
+// treated the same.
+type envParser struct {
+	getenv func(string) string
+	err    error
+}
+
+// loadConfig parses the configuration for the application from environment
+// variables using the provided getenv function, such as os.Getenv.
+// It returns the configuration, and the first error encountered if any
+// variables are missing or invalid.
+func loadConfig(getenv func(string) string) (config, error) {
+	var conf config
+	env := &envParser{getenv: getenv}
+
+	// Parse the path of the multi-camera config file, defaulting to a single
+	// camera defined by environment variables if undefined
+	conf.Config = env.string("SNAPSHOT_CONFIG", "")
+
+	// Parse the source of snapshots, defaulting to logging in to the AirCam and
+	// requesting its snapshot endpoint if undefined
+	conf.Source = env.string("SNAPSHOT_SOURCE", sourceHTTP)
+	if conf.Source != sourceHTTP && conf.Source != sourceRTSP {
+		env.invalid("SNAPSHOT_SOURCE", "must be http or rtsp")
+	}
+
+	// Parse the ffmpeg command which decodes H.264 frames of the RTSP source,
+	// defaulting to ffmpeg on the PATH if undefined
+	conf.FFmpeg = env.string("SNAPSHOT_FFMPEG", "ffmpeg")
+
+	// Parse the mode of authenticating with the AirCam, defaulting to the form
+	// login if undefined
+	conf.AuthMode = env.string("SNAPSHOT_AUTH_MODE", authModeForm)
+	if conf.AuthMode != authModeForm && conf.AuthMode != authModeDigest {
+		env.invalid("SNAPSHOT_AUTH_MODE", "must be form or digest")
+	}
+
+	// Parse the path of the file the session cookies are saved to on shutdown
+	// and resumed from on startup, defaulting to logging in on every startup if
+	// undefined
+	conf.SessionFile = env.string("SNAPSHOT_SESSION_FILE", "")
+
+	// Parse the URL, username, and password to login to the AirCam with, which
+	// are required unless cameras are defined by the config file. The RTSP
+	// source requires the RTSP stream URL instead of the AirCam URL.
+	if conf.Config == "" {
+		if conf.Source == sourceRTSP {
+			conf.RTSPURL = strings.TrimSpace(env.required("SNAPSHOT_RTSP_URL"))
+		} else {
+			conf.URL = strings.TrimSpace(env.required("SNAPSHOT_URL"))
+		}
+
+		conf.Username = env.required("SNAPSHOT_USERNAME")
+		conf.Password = env.required("SNAPSHOT_PASSWORD")
+
+		// Parse the URL to login to the AirCam at, defaulting to the AirCam URL
+		// if undefined, for setups where they are reachable at different hosts
+		conf.LoginURL = strings.TrimSpace(env.string("SNAPSHOT_LOGIN_URL", ""))
+	}
+
+	// Parse the ignore SSL variable, defaulting to verifying certificates if
+	// undefined. This previously defaulted to ignoring them, so the error
+	// explains the change to anyone relying on the old behavior.
+	if ignoreSSL, err := strconv.ParseBool(
+		env.string("SNAPSHOT_IGNORE_SSL", "false")); err != nil {
+		env.invalid("SNAPSHOT_IGNORE_SSL", "must be true or false, "+
+			"certificates are verified by default unless it is true")
+	} else {
+		conf.IgnoreSSL = ignoreSSL
+	}
+
+	// Parse the bind address and port, defaulting to localhost:8000 if
+	// undefined. Both "0.0.0.0" and "::" bind to all interfaces.
+	conf.Bind = env.string("SNAPSHOT_BIND", "localhost")
+	conf.Port = env.int("SNAPSHOT_PORT", 8000)
+
+	// Parse the keepalive period, defaulting to 10 minutes if undefined
+	conf.KeepalivePeriod = env.int("SNAPSHOT_KEEPALIVE_PERIOD", 10)
+
+	// Parse the interval of fetching frames to keep the AirCam capture pipeline
+	// active, defaulting to disabled if undefined or 0
+	conf.KeepWarmInterval = env.duration("SNAPSHOT_KEEPWARM_INTERVAL", 0)
+
+	// Parse the allowlist of query parameters forwarded to the AirCam. Any
+	// parameter not on this list is ignored, defaulting to forwarding none.
+	conf.ForwardParams = env.list("SNAPSHOT_FORWARD_PARAMS")
+
+	// Parse the origins allowed to read snapshots by CORS, or * for any origin,
+	// defaulting to sending no CORS headers if undefined
+	conf.CORSOrigins = env.list("SNAPSHOT_CORS_ORIGINS")
+
+	// Parse the privacy mask rectangles, defaulting to no mask if undefined
+	if privacyMask := env.string("SNAPSHOT_PRIVACY_MASK", ""); privacyMask != "" {
+		var err error
+		conf.PrivacyMask, err = parsePrivacyMask(privacyMask)
+
+		if err != nil {
+			env.invalid("SNAPSHOT_PRIVACY_MASK", err)
+		}
+	}
+
+	// Parse whether to draw the capture time on each frame, defaulting to not
+	// drawing it if undefined, and its corner, color, and Go time layout,
+	// defaulting to white in the bottom right if undefined
+	conf.TimestampOverlay = env.bool("SNAPSHOT_TIMESTAMP_OVERLAY", false)
+	conf.TimestampPosition = env.string("SNAPSHOT_TIMESTAMP_POSITION",
+		overlayBottomRight)
+	switch conf.TimestampPosition {
+	case overlayTopLeft, overlayTopRight, overlayBottomLeft, overlayBottomRight:
+	default:
+		env.invalid("SNAPSHOT_TIMESTAMP_POSITION",
+			"must be top-left, top-right, bottom-left, or bottom-right")
+	}
+
+	var err error
+	conf.TimestampColor, err = parseOverlayColor(
+		env.string("SNAPSHOT_TIMESTAMP_COLOR", "#ffffff"))
+	if err != nil {
+		env.invalid("SNAPSHOT_TIMESTAMP_COLOR", err)
+	}
+
+	conf.TimestampFormat = env.string("SNAPSHOT_TIMESTAMP_FORMAT",
+		time.DateTime)
+
+	// Parse the processors applied to every frame in order, defaulting to
+	// blacking out the privacy mask and then drawing the timestamp overlay,
+	// when they are enabled, if undefined, and the size of the resize
+	// processor, defaulting to leaving the frame as-is if undefined
+	conf.Pipeline = env.list("SNAPSHOT_PIPELINE")
+	if len(conf.Pipeline) == 0 {
+		if len(conf.PrivacyMask) > 0 {
+			conf.Pipeline = append(conf.Pipeline, processorMask)
+		}
+
+		if conf.TimestampOverlay {
+			conf.Pipeline = append(conf.Pipeline, processorOverlay)
+		}
+	}
+
+	conf.pipeline, err = parsePipeline(conf.Pipeline)
+	if err != nil {
+		env.invalid("SNAPSHOT_PIPELINE", err)
+	}
+
+	// Refuse a pipeline which would serve frames with a configured privacy
+	// mask left off, or applied after resizing moved the masked regions
+	if len(conf.PrivacyMask) > 0 {
+		mask := slices.Index(conf.Pipeline, processorMask)
+		switch resize := slices.Index(conf.Pipeline, processorResize); {
+		case mask == -1:
+			env.invalid("SNAPSHOT_PIPELINE",
+				"must include mask when SNAPSHOT_PRIVACY_MASK is set")
+		case resize != -1 && resize < mask:
+			env.invalid("SNAPSHOT_PIPELINE", "must apply mask before resize")
+		}
+	}
+
+	conf.ResizeWidth = env.int("SNAPSHOT_RESIZE_WIDTH", 0)
+	conf.ResizeHeight = env.int("SNAPSHOT_RESIZE_HEIGHT", 0)
+
+	// Parse the delay before restarting a panicked background loop, defaulting
+	// to 5 seconds if undefined
+	conf.LoopRestartDelay = env.duration("SNAPSHOT_LOOP_RESTART_DELAY",
+		5*time.Second)
+
+	// Parse the name of the AirCam response header holding the frame capture
+	// time, defaulting to using the fetch time if undefined
+	conf.FrameTimeHeader = env.string("SNAPSHOT_FRAME_TIME_HEADER", "")
+
+	// Parse the enable WebSocket variable, defaulting to no if undefined
+	conf.EnableWS = env.bool("SNAPSHOT_ENABLE_WS", false)
+
+	// Parse the stream FPS, defaulting to 5 frames per second if undefined
+	conf.StreamFPS = env.int("SNAPSHOT_STREAM_FPS", 5)
+
+	// Parse the number of recently fetched frames buffered for the /frames.zip
+	// route, defaulting to disabling the buffer if undefined or 0
+	conf.FrameBuffer = env.int("SNAPSHOT_FRAME_BUFFER", 0)
+
+	// Parse the debug-only artificial response delay, defaulting to no delay if
+	// undefined. This exists solely for testing client loading and timeout
+	// behavior and should never be set in production.
+	conf.DebugDelay = env.duration("SNAPSHOT_DEBUG_DELAY", 0)
+
+	// Parse the snapshot path served by the proxy, defaulting to /snapshot.cgi
+	// if undefined
+	conf.ServePath = env.string("SNAPSHOT_SERVE_PATH", "/snapshot.cgi")
+
+	// Parse the snapshot path on the AirCam, defaulting to /snapshot.cgi if
+	// undefined. An explicit path always takes precedence over autodiscovery.
+	conf.CameraPath = env.string("SNAPSHOT_CAMERA_PATH", "")
+	if conf.CameraPath == "" {
+		conf.CameraPath = "/snapshot.cgi"
+
+		// Parse the autodiscover variable, defaulting to no if undefined
+		conf.Autodiscover = env.bool("SNAPSHOT_AUTODISCOVER", false)
+	}
+
+	// Parse the truncated JPEG handling mode, defaulting to reject if undefined
+	conf.JPEGRepair = env.string("SNAPSHOT_JPEG_REPAIR", jpegRepairReject)
+
+	// Parse the minimum healthy image size, defaulting to no minimum if
+	// undefined
+	conf.MinHealthyBytes = env.int("SNAPSHOT_MIN_HEALTHY_BYTES", 0)
+
+	// Parse whether images below the minimum healthy size fail the health
+	// check, defaulting to false if undefined
+	conf.MinHealthyFail = env.bool("SNAPSHOT_MIN_HEALTHY_FAIL", false)
+
+	// Parse the upstream request timeout, defaulting to 10 seconds if undefined
+	conf.Timeout = env.duration("SNAPSHOT_TIMEOUT", 10*time.Second)
+
+	// Parse the health check cache TTL, defaulting to 10 seconds if undefined
+	conf.HealthTTL = env.duration("SNAPSHOT_HEALTH_TTL", 10*time.Second)
+
+	// Parse the frame cache TTL, defaulting to 500 milliseconds if undefined
+	conf.CacheTTL = env.duration("SNAPSHOT_CACHE_TTL", 500*time.Millisecond)
+
+	// Parse the log credentials variable, defaulting to masking the password if
+	// undefined. This is intended for debugging login problems only.
+	conf.LogCredentials = env.bool("SNAPSHOT_LOG_CREDENTIALS", false)
+
+	// Parse the log format and level, defaulting to text at info if undefined
+	conf.LogFormat = env.string("SNAPSHOT_LOG_FORMAT", logFormatText)
+	if err := conf.LogLevel.UnmarshalText(
+		[]byte(env.string("SNAPSHOT_LOG_LEVEL", "info"))); err != nil {
+		env.invalid("SNAPSHOT_LOG_LEVEL", err)
+	}
+
+	// Parse the access log format, defaulting to no access logs if undefined
+	conf.AccessLog = env.string("SNAPSHOT_ACCESS_LOG", accessLogOff)
+	switch conf.AccessLog {
+	case accessLogOff, accessLogCommon, accessLogCombined, accessLogTimed:
+	default:
+		env.invalid("SNAPSHOT_ACCESS_LOG",
+			"must be off, common, combined, or timed")
+	}
+
+	// Parse the file to append logs to, defaulting to logging to stderr if
+	// undefined
+	conf.LogFile = env.string("SNAPSHOT_LOG_FILE", "")
+
+	// Parse the certificate and key files to serve HTTPS with, defaulting to
+	// serving plain HTTP if undefined
+	conf.TLSCert = env.string("SNAPSHOT_TLS_CERT", "")
+	conf.TLSKey = env.string("SNAPSHOT_TLS_KEY", "")
+
+	// Parse the client certificate and key files presented to the AirCam,
+	// such as to an mTLS terminating proxy in front of it, defaulting to
+	// presenting none if undefined
+	conf.ClientCert = env.string("SNAPSHOT_CLIENT_CERT", "")
+	conf.ClientKey = env.string("SNAPSHOT_CLIENT_KEY", "")
+
+	// Parse the credentials required by clients of the proxy, defaulting to no
+	// authentication if undefined
+	conf.ProxyUser = env.string("SNAPSHOT_PROXY_USER", "")
+	conf.ProxyPass = env.string("SNAPSHOT_PROXY_PASS", "")
+
+	// Parse the directory and interval to save snapshots to disk with,
+	// defaulting to not saving snapshots, at an interval of 1 minute, if
+	// undefined
+	conf.SaveDir = env.string("SNAPSHOT_SAVE_DIR", "")
+	conf.SaveInterval = env.duration("SNAPSHOT_SAVE_INTERVAL", time.Minute)
+
+	// Parse the S3-compatible bucket to upload snapshots to, defaulting to not
+	// uploading them if undefined, along with its endpoint, defaulting to AWS,
+	// its credentials and region, the prefix of the uploaded keys, and the
+	// upload interval, defaulting to every minute
+	conf.S3Bucket = env.string("SNAPSHOT_S3_BUCKET", "")
+	conf.S3Endpoint = env.string("SNAPSHOT_S3_ENDPOINT",
+		"https://s3.amazonaws.com")
+	conf.S3AccessKey = env.string("SNAPSHOT_S3_ACCESS_KEY", "")
+	conf.S3SecretKey = env.string("SNAPSHOT_S3_SECRET_KEY", "")
+	conf.S3Region = env.string("SNAPSHOT_S3_REGION", "")
+	conf.S3Prefix = env.string("SNAPSHOT_S3_PREFIX", "")
+	conf.S3Interval = env.duration("SNAPSHOT_S3_INTERVAL", time.Minute)
+
+	// Parse the number of startup login retries, defaulting to 5 if undefined
+	// and retrying forever if 0
+	conf.LoginRetries = env.int("SNAPSHOT_LOGIN_RETRIES", 5)
+
+	// Parse the number of cameras logged in to concurrently at startup,
+	// defaulting to every camera up to 8 if undefined or 0
+	conf.LoginConcurrency = env.int("SNAPSHOT_LOGIN_CONCURRENCY", 0)
+
+	// Parse the AirCam paths served by the proxy, defaulting to only
+	// /snapshot.cgi if undefined
+	conf.AllowedPaths = env.list("SNAPSHOT_ALLOWED_PATHS")
+	if len(conf.AllowedPaths) == 0 {
+		conf.AllowedPaths = []string{"/snapshot.cgi"}
+	}
+
+	// Parse the AirCam response headers relayed by the passthrough proxy,
+	// defaulting to the content headers if undefined, and the headers which
+	// are never relayed, defaulting to the cookies set by the AirCam if
+	// undefined. Names are canonicalized so that they match in any case.
+	conf.PassthroughHeaders = env.list("SNAPSHOT_PASSTHROUGH_HEADERS")
+	if len(conf.PassthroughHeaders) == 0 {
+		conf.PassthroughHeaders = passthroughHeaders
+	}
+
+	conf.StripHeaders = env.list("SNAPSHOT_STRIP_HEADERS")
+	if len(conf.StripHeaders) == 0 {
+		conf.StripHeaders = strippedHeaders
+	}
+
+	for i, name := range conf.PassthroughHeaders {
+		conf.PassthroughHeaders[i] = http.CanonicalHeaderKey(name)
+	}
+
+	for i, name := range conf.StripHeaders {
+		conf.StripHeaders[i] = http.CanonicalHeaderKey(name)
+	}
+
+	// Parse the name of the AirCam session cookie, defaulting to
+	// AIROS_SESSIONID if undefined, and whether it is matched as a prefix of
+	// the cookie name to support firmware which suffixes it, defaulting to no
+	conf.CookieName = env.string("SNAPSHOT_COOKIE_NAME", "AIROS_SESSIONID")
+	conf.CookiePrefix = env.bool("SNAPSHOT_COOKIE_PREFIX", false)
+
+	// Parse the proactive session refresh interval, defaulting to 30 minutes if
+	// undefined and disabled if 0
+	conf.SessionRefresh = env.duration("SNAPSHOT_SESSION_REFRESH",
+		30*time.Minute)
+
+	// Parse the maximum age of a session before it is replaced by logging in
+	// again, defaulting to unlimited if undefined or 0
+	conf.SessionMaxAge = env.duration("SNAPSHOT_SESSION_MAX_AGE", 0)
+
+	// Parse the snapshot rate limit in requests per second and its burst,
+	// defaulting to no limit, with a burst of 1, if undefined
+	conf.RateLimit = env.float("SNAPSHOT_RATE_LIMIT", 0)
+	conf.RateBurst = env.int("SNAPSHOT_RATE_BURST", 1)
+
+	// Parse the snapshot rate limit of each client IP in requests per second
+	// and its burst, defaulting to no limit, with a burst of 1, if undefined,
+	// and whether to trust the X-Forwarded-For header to identify clients,
+	// defaulting to not trusting it if undefined
+	conf.PerIPRate = env.float("SNAPSHOT_PER_IP_RATE", 0)
+	conf.PerIPBurst = env.int("SNAPSHOT_PER_IP_BURST", 1)
+	conf.TrustProxy = env.bool("SNAPSHOT_TRUST_PROXY", false)
+
+	// Parse whether to disable compression of text and JSON responses,
+	// defaulting to compressing them if undefined
+	conf.DisableCompression = env.bool("SNAPSHOT_DISABLE_COMPRESSION", false)
+
+	// Parse whether optional features which fail to load exit rather than
+	// being disabled, defaulting to disabling them if undefined
+	conf.StrictConfig = env.bool("SNAPSHOT_STRICT_CONFIG", false)
+
+	// Parse the number of times to retry snapshot requests which failed
+	// transiently, defaulting to 2 if undefined
+	conf.FetchRetries = env.int("SNAPSHOT_FETCH_RETRIES", 2)
+
+	// Parse the maximum number of concurrent fetches from the AirCam,
+	// defaulting to 3 if undefined and unlimited if 0
+	conf.MaxConcurrentFetches = env.int("SNAPSHOT_MAX_CONCURRENT_FETCHES", 3)
+
+	// Parse the name of the login token field scraped from the initial page,
+	// defaulting to logging in with credentials alone if undefined
+	conf.LoginTokenField = env.string("SNAPSHOT_LOGIN_TOKEN_FIELD", "")
+
+	// Parse the names of the login form fields, defaulting to the fields of the
+	// AirCam login page if undefined, and any extra fields submitted with them
+	// as comma-separated key=value pairs, defaulting to none if undefined
+	conf.FieldUsername = env.string("SNAPSHOT_FIELD_USERNAME", "username")
+	conf.FieldPassword = env.string("SNAPSHOT_FIELD_PASSWORD", "password")
+	conf.FieldURI = env.string("SNAPSHOT_FIELD_URI", "uri")
+	conf.LoginExtraFields = map[string]string{}
+	for _, field := range env.list("SNAPSHOT_LOGIN_EXTRA_FIELDS") {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			env.invalid("SNAPSHOT_LOGIN_EXTRA_FIELDS",
+				fmt.Sprintf("field %q must be key=value", field))
+			break
+		}
+
+		conf.LoginExtraFields[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+
+	// Parse the Unix socket path to serve on and its octal file mode,
+	// defaulting to serving on the TCP listen address, with a mode of 0660, if
+	// undefined
+	conf.UnixSocket = env.string("SNAPSHOT_UNIX_SOCKET", "")
+	if mode, err := strconv.ParseUint(
+		env.string("SNAPSHOT_UNIX_SOCKET_MODE", "0660"), 8, 32); err != nil {
+		env.invalid("SNAPSHOT_UNIX_SOCKET_MODE", err)
+	} else {
+		conf.UnixSocketMode = os.FileMode(mode)
+	}
+
+	// Parse the CA file to verify the AirCam certificate against, defaulting to
+	// the system roots if undefined
+	conf.CAFile = env.string("SNAPSHOT_CA_FILE", "")
+
+	// Parse the status served with the fallback image, defaulting to 200 if
+	// undefined
+	conf.FallbackStatus = env.int("SNAPSHOT_FALLBACK_STATUS", http.StatusOK)
+
+	// Parse the startup check variable, defaulting to yes if undefined
+	conf.StartupCheck = env.bool("SNAPSHOT_STARTUP_CHECK", true)
+
+	// Parse the maximum size of an image read from the AirCam, defaulting to
+	// 10MB if undefined
+	conf.MaxImageBytes = int64(env.int("SNAPSHOT_MAX_IMAGE_BYTES", 10<<20))
+
+	// Parse whether snapshots are streamed to clients as they are read from the
+	// AirCam, defaulting to buffering them first if undefined
+	conf.StreamResponse = env.bool("SNAPSHOT_STREAM_RESPONSE", false)
+
+	// Parse the timeouts of the HTTP server, which guard against slow clients
+	// holding connections open (e.g. slowloris) when bound to a network
+	// interface. Headers default to 5 seconds, and idle keep-alive connections
+	// to 60 seconds. Responses default to the upstream timeout plus a margin,
+	// as a snapshot response can not take longer than fetching it, and 0
+	// disables any of them.
+	conf.ReadHeaderTimeout = env.duration("SNAPSHOT_READ_HEADER_TIMEOUT",
+		5*time.Second)
+	conf.WriteTimeout = env.duration("SNAPSHOT_WRITE_TIMEOUT",
+		conf.Timeout+writeTimeoutMargin)
+	conf.IdleTimeout = env.duration("SNAPSHOT_IDLE_TIMEOUT", 60*time.Second)
+
+	// Parse the consecutive failures which open the circuit breaker, defaulting
+	// to 5 if undefined and disabled if 0, and the cooldown before probing the
+	// AirCam again, defaulting to 30 seconds if undefined
+	conf.BreakerThreshold = env.int("SNAPSHOT_BREAKER_THRESHOLD", 5)
+	conf.BreakerCooldown = env.duration("SNAPSHOT_BREAKER_COOLDOWN",
+		30*time.Second)
+
+	// Parse the idle connection pool of each camera, defaulting to 100
+	// connections, 10 of them to the AirCam, kept for 90 seconds if undefined.
+	// 0 means no limit for the total and timeout.
+	conf.MaxIdleConns = env.int("SNAPSHOT_MAX_IDLE_CONNS", 100)
+	conf.MaxIdleConnsPerHost = env.int("SNAPSHOT_MAX_IDLE_CONNS_PER_HOST", 10)
+	conf.IdleConnTimeout = env.duration("SNAPSHOT_IDLE_CONN_TIMEOUT",
+		90*time.Second)
+
+	// Parse the cache stats log interval, defaulting to not logging them if
+	// undefined
+	conf.StatsInterval = env.duration("SNAPSHOT_STATS_INTERVAL", 0)
+
+	// Parse the User-Agent and additional headers of requests to the AirCam,
+	// defaulting to identifying as this version of aircam-snapshot with no
+	// additional headers if undefined
+	conf.UserAgent = env.string("SNAPSHOT_USER_AGENT",
+		fmt.Sprintf("aircam-snapshot/%s", version))
+	conf.UpstreamHeaders = http.Header{}
+	for _, header := range env.list("SNAPSHOT_UPSTREAM_HEADERS") {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			env.invalid("SNAPSHOT_UPSTREAM_HEADERS",
+				fmt.Sprintf("header %q must be Name:Value", header))
+			break
+		}
+
+		conf.UpstreamHeaders.Add(strings.TrimSpace(name),
+			strings.TrimSpace(value))
+	}
+
+	// Parse the login follow redirects variable, defaulting to inspecting the
+	// login redirect rather than following it if undefined
+	conf.LoginFollowRedirects = env.bool("SNAPSHOT_LOGIN_FOLLOW_REDIRECTS",
+		false)
+
+	// Parse the maximum age of a stale frame served when a fetch fails,
+	// defaulting to 5 seconds if undefined and disabled if 0
+	conf.StaleMax = env.duration("SNAPSHOT_STALE_MAX", 5*time.Second)
+
+	// Parse the proxy of upstream requests, defaulting to the HTTP_PROXY and
+	// HTTPS_PROXY environment variables if undefined and disabled if none
+	switch proxyURL := env.string("SNAPSHOT_PROXY_URL", ""); proxyURL {
+	case "":
+	case "none":
+		conf.NoUpstreamProxy = true
+	default:
+		parsed, err := parseProxyURL(proxyURL)
+		if err != nil {
+			env.invalid("SNAPSHOT_PROXY_URL", err)
+			break
+		}
+
+		conf.UpstreamProxy = parsed
+	}
+
+	// Parse the viewer enabled variable, defaulting to not serving the HTML
+	// viewer if undefined
+	conf.ViewerEnabled = env.bool("SNAPSHOT_VIEWER_ENABLED", false)
+
+	// Parse the cooldown after a failed login, within which a request finding
+	// its session expired fails rather than logging in again, defaulting to 10
+	// seconds if undefined and disabled if 0
+	conf.ReloginCooldown = env.duration("SNAPSHOT_RELOGIN_COOLDOWN",
+		10*time.Second)
+
+	// Parse the debug variable, defaulting to not serving the /debug route if
+	// undefined
+	conf.Debug = env.bool("SNAPSHOT_DEBUG", false)
+
+	// Parse the motion webhook URL, defaulting to disabling motion detection if
+	// undefined, and the interval at which frames are compared, the ratio of
+	// changed pixels which counts as motion, and the minimum time between
+	// motion events, defaulting to 1 second, 0.05, and 1 minute if undefined
+	conf.MotionWebhook = strings.TrimSpace(env.string("SNAPSHOT_MOTION_WEBHOOK",
+		""))
+	conf.MotionInterval = env.duration("SNAPSHOT_MOTION_INTERVAL", time.Second)
+	conf.MotionThreshold = env.float("SNAPSHOT_MOTION_THRESHOLD", 0.05)
+	conf.MotionCooldown = env.duration("SNAPSHOT_MOTION_COOLDOWN", time.Minute)
+
+	if env.err != nil {
+		return conf, env.err
+	}
+
+	// Validate that the AirCam URL, and login URL if any, are absolute HTTP or
+	// HTTPS URLs, or that the RTSP stream URL is an RTSP URL
+	if conf.Config == "" && conf.Source == sourceRTSP {
+		if err := validateRTSPURL(conf.RTSPURL); err != nil {
+			return conf, invalidValue("SNAPSHOT_RTSP_URL", err)
+		}
+	} else if conf.Config == "" {
+		if err := validateURLs(conf.URL); err != nil {
+			return conf, invalidValue("SNAPSHOT_URL", err)
+		}
+
+		if conf.LoginURL != "" {
+			if err := validateURL(conf.LoginURL); err != nil {
+				return conf, invalidValue("SNAPSHOT_LOGIN_URL", err)
+			}
+		}
+	}
+
+	// Validate the values which are well-formed but out of range
+	switch {
+	case conf.FrameBuffer < 0:
+		return conf, invalidValue("SNAPSHOT_FRAME_BUFFER",
+			"must not be negative")
+	case conf.StreamFPS <= 0:
+		return conf, invalidValue("SNAPSHOT_STREAM_FPS", "must be positive")
+	case conf.MinHealthyBytes < 0:
+		return conf, invalidValue("SNAPSHOT_MIN_HEALTHY_BYTES",
+			"must not be negative")
+	case conf.Timeout <= 0:
+		return conf, invalidValue("SNAPSHOT_TIMEOUT", "must be positive")
+	case conf.LoginRetries < 0:
+		return conf, invalidValue("SNAPSHOT_LOGIN_RETRIES", "must not be negative")
+	case conf.LoginConcurrency < 0:
+		return conf, invalidValue("SNAPSHOT_LOGIN_CONCURRENCY",
+			"must not be negative")
+	case conf.S3Interval <= 0:
+		return conf, invalidValue("SNAPSHOT_S3_INTERVAL", "must be positive")
+	case conf.SaveInterval <= 0:
+		return conf, invalidValue("SNAPSHOT_SAVE_INTERVAL", "must be positive")
+	case conf.RateLimit < 0:
+		return conf, invalidValue("SNAPSHOT_RATE_LIMIT", "must not be negative")
+	case conf.RateBurst <= 0:
+		return conf, invalidValue("SNAPSHOT_RATE_BURST", "must be positive")
+	case conf.PerIPRate < 0:
+		return conf, invalidValue("SNAPSHOT_PER_IP_RATE", "must not be negative")
+	case conf.PerIPBurst <= 0:
+		return conf, invalidValue("SNAPSHOT_PER_IP_BURST", "must be positive")
+	case conf.FallbackStatus < 200 || conf.FallbackStatus > 599:
+		return conf, invalidValue("SNAPSHOT_FALLBACK_STATUS",
+			"must be an HTTP status from 200 to 599")
+	case conf.MaxImageBytes <= 0:
+		return conf, invalidValue("SNAPSHOT_MAX_IMAGE_BYTES", "must be positive")
+	case conf.StreamResponse && len(conf.Pipeline) > 0:
+		return conf, invalidValue("SNAPSHOT_STREAM_RESPONSE",
+			"can not be combined with a frame pipeline, as streamed frames "+
+				"are not processed")
+	case conf.ReadHeaderTimeout < 0:
+		return conf, invalidValue("SNAPSHOT_READ_HEADER_TIMEOUT",
+			"must not be negative")
+	case conf.WriteTimeout < 0:
+		return conf, invalidValue("SNAPSHOT_WRITE_TIMEOUT", "must not be negative")
+	case conf.IdleTimeout < 0:
+		return conf, invalidValue("SNAPSHOT_IDLE_TIMEOUT", "must not be negative")
+	case conf.BreakerThreshold < 0:
+		return conf, invalidValue("SNAPSHOT_BREAKER_THRESHOLD",
+			"must not be negative")
+	case conf.BreakerCooldown <= 0:
+		return conf, invalidValue("SNAPSHOT_BREAKER_COOLDOWN", "must be positive")
+	case conf.MaxIdleConns < 0:
+		return conf, invalidValue("SNAPSHOT_MAX_IDLE_CONNS", "must not be negative")
+	case conf.MaxIdleConnsPerHost <= 0:
+		return conf, invalidValue("SNAPSHOT_MAX_IDLE_CONNS_PER_HOST",
+			"must be positive")
+	case conf.IdleConnTimeout < 0:
+		return conf, invalidValue("SNAPSHOT_IDLE_CONN_TIMEOUT",
+			"must not be negative")
+	case conf.StatsInterval < 0:
+		return conf, invalidValue("SNAPSHOT_STATS_INTERVAL", "must not be negative")
+	case conf.StaleMax < 0:
+		return conf, invalidValue("SNAPSHOT_STALE_MAX", "must not be negative")
+	case conf.ReloginCooldown < 0:
+		return conf, invalidValue("SNAPSHOT_RELOGIN_COOLDOWN",
+			"must not be negative")
+	case conf.MotionInterval <= 0:
+		return conf, invalidValue("SNAPSHOT_MOTION_INTERVAL", "must be positive")
+	case conf.MotionThreshold <= 0 || conf.MotionThreshold > 1:
+		return conf, invalidValue("SNAPSHOT_MOTION_THRESHOLD",
+			"must be greater than 0 and at most 1")
+	case conf.MotionCooldown < 0:
+		return conf, invalidValue("SNAPSHOT_MOTION_COOLDOWN",
+			"must not be negative")
+	case conf.FieldUsername == conf.FieldPassword:
+		return conf, invalidValue("SNAPSHOT_FIELD_PASSWORD",
+			"must differ from SNAPSHOT_FIELD_USERNAME")
+	case conf.MaxConcurrentFetches < 0:
+		return conf, invalidValue("SNAPSHOT_MAX_CONCURRENT_FETCHES",
+			"must not be negative")
+	case conf.KeepWarmInterval < 0:
+		return conf, invalidValue("SNAPSHOT_KEEPWARM_INTERVAL",
+			"must not be negative")
+	case conf.FetchRetries < 0:
+		return conf, invalidValue("SNAPSHOT_FETCH_RETRIES",
+			"must not be negative")
+	case conf.ResizeWidth < 0 || conf.ResizeWidth > maxTransformSize:
+		return conf, invalidValue("SNAPSHOT_RESIZE_WIDTH",
+			fmt.Sprintf("must be 0 to %d", maxTransformSize))
+	case conf.ResizeHeight < 0 || conf.ResizeHeight > maxTransformSize:
+		return conf, invalidValue("SNAPSHOT_RESIZE_HEIGHT",
+			fmt.Sprintf("must be 0 to %d", maxTransformSize))
+	case conf.SessionRefresh < 0:
+		return conf, invalidValue("SNAPSHOT_SESSION_REFRESH",
+			"must not be negative")
+	case conf.SessionMaxAge < 0:
+		return conf, invalidValue("SNAPSHOT_SESSION_MAX_AGE",
+			"must not be negative")
+	}
+
+	// Validate that the motion webhook URL is an absolute HTTP or HTTPS URL
+	if conf.MotionWebhook != "" {
+		if err := validateURL(conf.MotionWebhook); err != nil {
+			return conf, invalidValue("SNAPSHOT_MOTION_WEBHOOK", err)
+		}
+	}
+
+	// Validate that the served and allowed paths are absolute and do not
+	// collide with the other routes of the proxy, including the viewer at the
+	// root, dropping repeated allowed paths so that each is routed once.
+	// Allowed paths ending in a slash are refused, as they would route every
+	// path below them.
+	if err := validateServedPath(conf.ServePath); err != nil {
+		return conf, invalidValue("SNAPSHOT_SERVE_PATH", err)
+	}
+
+	if conf.ViewerEnabled && conf.ServePath == "/" {
+		return conf, invalidValue("SNAPSHOT_SERVE_PATH",
+			`path "/" is served by the viewer`)
+	}
+
+	allowedPaths := make([]string, 0, len(conf.AllowedPaths))
+	for _, path := range conf.AllowedPaths {
+		if slices.Contains(allowedPaths, path) {
+			continue
+		}
+
+		switch err := validateServedPath(path); {
+		case err != nil:
+			return conf, invalidValue("SNAPSHOT_ALLOWED_PATHS", err)
+		case strings.HasSuffix(path, "/"):
+			return conf, invalidValue("SNAPSHOT_ALLOWED_PATHS",
+				fmt.Sprintf("path %q must not end with /", path))
+		}
+
+		allowedPaths = append(allowedPaths, path)
+	}
+	conf.AllowedPaths = allowedPaths
+
+	switch conf.LogFormat {
+	case logFormatText, logFormatJSON:
+	default:
+		return conf, invalidValue("SNAPSHOT_LOG_FORMAT", "must be text or json")
+	}
+
+	switch conf.JPEGRepair {
+	case jpegRepairReject, jpegRepairSalvage, jpegRepairOff:
+	default:
+		return conf, invalidValue("SNAPSHOT_JPEG_REPAIR",
+			"must be reject, salvage, or off")
+	}
+
+	// Validate that the TLS certificate and key are both set and load as a
+	// pair, otherwise serving plain HTTP
+	if conf.TLSCert != "" || conf.TLSKey != "" {
+		var err error
+		if conf.TLSCert == "" || conf.TLSKey == "" {
+			err = errors.New(
+				"SNAPSHOT_TLS_CERT and SNAPSHOT_TLS_KEY must be set together")
+		} else if _, loadErr := tls.LoadX509KeyPair(conf.TLSCert,
+			conf.TLSKey); loadErr != nil {
+			err = fmt.Errorf(
+				"Invalid certificate and key in SNAPSHOT_TLS_CERT and SNAPSHOT_TLS_KEY: %s",
+				loadErr)
+		}
+
+		if err != nil {
+			if err := conf.disable("TLS", err); err != nil {
+				return conf, err
+			}
+
+			conf.TLSCert, conf.TLSKey = "", ""
+		}
+	}
+
+	// Validate that the client certificate and key are both set and load as a
+	// pair. Unlike the served TLS certificate, this is always fatal, as the
+	// AirCam can not be reached without it.
+	if conf.ClientCert != "" || conf.ClientKey != "" {
+		if conf.ClientCert == "" || conf.ClientKey == "" {
+			return conf, errors.New(
+				"SNAPSHOT_CLIENT_CERT and SNAPSHOT_CLIENT_KEY must be set together")
+		}
+
+		certificate, err := tls.LoadX509KeyPair(conf.ClientCert, conf.ClientKey)
+		if err != nil {
+			return conf, fmt.Errorf(
+				"Invalid certificate and key in SNAPSHOT_CLIENT_CERT and SNAPSHOT_CLIENT_KEY: %s",
+				err)
+		}
+
+		conf.clientCertificates = []tls.Certificate{certificate}
+	}
+
+	// Load the JPEG served when a snapshot can not be retrieved, defaulting to
+	// serving the error status if undefined
+	if path := env.string("SNAPSHOT_FALLBACK_IMAGE", ""); path != "" {
+		var err error
+		conf.FallbackImage, err = loadFallbackImage(path)
+
+		if err != nil {
+			err = conf.disable("fallback image",
+				invalidValue("SNAPSHOT_FALLBACK_IMAGE", err))
+			if err != nil {
+				return conf, err
+			}
+		}
+	}
+
+	// Validate that the proxy credentials are both set, otherwise serving
+	// without authentication
+	if (conf.ProxyUser == "") != (conf.ProxyPass == "") {
+		err := conf.disable("proxy authentication", errors.New(
+			"SNAPSHOT_PROXY_USER and SNAPSHOT_PROXY_PASS must be set together"))
+		if err != nil {
+			return conf, err
+		}
+
+		conf.ProxyUser, conf.ProxyPass = "", ""
+	}
+
+	// Validate that the S3 endpoint is an HTTP or HTTPS URL with a host
+	if conf.S3Bucket != "" {
+		if err := validateURL(conf.S3Endpoint); err != nil {
+			return conf, invalidValue("SNAPSHOT_S3_ENDPOINT", err)
+		}
+	}
+
+	// Validate the listen address formed by the bind address and port
+	if _, err := net.ResolveTCPAddr("tcp", conf.listenAddr()); err != nil ||
+		conf.Port < 1 || conf.Port > 65535 {
+		return conf, fmt.Errorf(
+			"Invalid listen address %s from SNAPSHOT_BIND and SNAPSHOT_PORT",
+			conf.listenAddr())
+	}
+
+	return conf, nil
+}
+
+// disable disables an optional feature which failed to load, recording why so
+// that it is warned about at startup, or fails with SNAPSHOT_STRICT_CONFIG.
+// It returns the error if the configuration is strict, otherwise nil.
+func (conf *config) disable(feature string, err error) error {
+	if conf.StrictConfig {
+		return err
+	}
+
+	conf.disabled = append(conf.disabled, disabledFeature{feature, err})
+
+	return nil
+}
+
+// validateServedPath checks that a path served by the proxy begins with a slash,
+// contains no route wildcards or spaces, and is not one of its reserved routes.
+// It returns an error describing why the path is invalid, if it is.
+func validateServedPath(path string) error {
+	switch {
+	case !strings.HasPrefix(path, "/"):
+		return fmt.Errorf("path %q must begin with /", path)
+	case strings.ContainsAny(path, "{} \t"):
+		return fmt.Errorf("path %q must not contain wildcards or spaces", path)
+	case slices.Contains(reservedPaths, path):
+		return fmt.Errorf("path %q is reserved", path)
+	}
+
+	return nil
+}
+
+// loadFallbackImage reads the fallback image file, validating that it is a
+// JPEG so that it can be served in place of a snapshot.
+// It returns the contents of the file, and any errors encountered reading or
+// decoding it.
+func loadFallbackImage(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := jpeg.DecodeConfig(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// listenAddr combines the bind address and port into the address the HTTP
+// server listens on, bracketing IPv6 addresses such as "::".
+func (conf config) listenAddr() string {
+	return net.JoinHostPort(conf.Bind, strconv.Itoa(conf.Port))
+}
+
+// validateURL checks that a camera URL is an absolute HTTP or HTTPS URL with a
+// host, rejecting values such as "camera.local" which have no scheme, or
+// "https://fe80::1" which has an unbracketed IPv6 host.
+// It returns an error describing why the URL is invalid, if it is.
+func validateURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		// An unbracketed IPv6 host is mistaken for a host and port
+		if strings.Count(rawURL, ":") > 2 && !strings.Contains(rawURL, "[") {
+			return fmt.Errorf(
+				"%s, IPv6 hosts must be bracketed (e.g. https://[fe80::1])", err)
+		}
+
+		return err
+	}
+
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("%q must start with http:// or https://", rawURL)
+	}
+
+	if parsed.Hostname() == "" {
+		return fmt.Errorf("%q has no host", rawURL)
+	}
+
+	// An unbracketed IPv6 host may also parse, with its last group as a port
+	if strings.Count(parsed.Host, ":") > 1 &&
+		!strings.HasPrefix(parsed.Host, "[") {
+		return fmt.Errorf(
+			"%q has an unbracketed IPv6 host, IPv6 hosts must be bracketed "+
+				"(e.g. https://[fe80::1])", rawURL)
+	}
+
+	return nil
+}
+
+// splitURLs splits a comma separated list of camera URLs, such as the primary
+// and failover URLs of SNAPSHOT_URL, ignoring empty entries.
+// It returns the URLs in order.
+func splitURLs(rawURLs string) []string {
+	var urls []string
+	for _, rawURL := range strings.Split(rawURLs, ",") {
+		if rawURL = strings.TrimSpace(rawURL); rawURL != "" {
+			urls = append(urls, rawURL)
+		}
+	}
+
+	return urls
+}
+
+// validateURLs checks that a comma separated list of camera URLs contains at
+// least one URL, and that each is valid, see validateURL.
+// It returns an error describing why the URLs are invalid, if they are.
+func validateURLs(rawURLs string) error {
+	urls := splitURLs(rawURLs)
+	if len(urls) == 0 {
+		return errors.New("at least one URL is required")
+	}
+
+	for _, rawURL := range urls {
+		if err := validateURL(rawURL); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateRTSPURL validates that an RTSP stream URL is an absolute RTSP URL.
+// It returns an error describing why the URL is invalid, if it is.
+func validateRTSPURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	if parsed.Scheme != "rtsp" {
+		return fmt.Errorf("%q must start with rtsp://", parsed.Redacted())
+	}
+
+	if parsed.Hostname() == "" {
+		return fmt.Errorf("%q has no host", parsed.Redacted())
+	}
+
+	return nil
+}
+
+// parseProxyURL parses the URL of a proxy for upstream requests, which must be
+// an HTTP, HTTPS, or SOCKS5 proxy with a host.
+// It returns the parsed URL, and an error describing why it is invalid, if it
+// is.
+func parseProxyURL(rawURL string) (*url.URL, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch parsed.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf(
+			"%q must start with http://, https://, or socks5://",
+			parsed.Redacted())
+	}
+
+	if parsed.Hostname() == "" {
+		return nil, fmt.Errorf("%q has no host", parsed.Redacted())
+	}
+
+	return parsed, nil
+}
+
+// invalidValue creates the error for an environment variable with an invalid
+// value.
+func invalidValue(name string, reason interface{}) error {
+	return fmt.Errorf("Invalid value for %s: %v", name, reason)
+}
+
+// invalid records an invalid value error for an environment variable, unless
+// an earlier error has already been recorded.
+func (env *envParser) invalid(name string, reason interface{}) {
+	if env.err == nil {
+		env.err = invalidValue(name, reason)
+	}
+}
+
+// required parses a string variable which must be defined and not blank.
+func (env *envParser) required(name string) string {
+	value := env.getenv(name)
+
+	if env.err == nil {
+		if value == "" {
+			env.err = fmt.Errorf("%s not defined", name)
+		} else if strings.TrimSpace(value) == "" {
+			env.err = fmt.Errorf("%s is set but empty", name)
+		}
+	}
+
+	return value
+}
+
+// string parses a string variable, defaulting to fallback if undefined.
+func (env *envParser) string(name, fallback string) string {
+	if value := env.getenv(name); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+// int parses an integer variable, defaulting to fallback if undefined.
+func (env *envParser) int(name string, fallback int) int {
+	value := env.getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		env.invalid(name, err)
+	}
+
+	return parsed
+}
+
+// bool parses a boolean variable such as "true" or "false", defaulting to
+// fallback if undefined.
+func (env *envParser) bool(name string, fallback bool) bool {
+	value := env.getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		env.invalid(name, err)
+	}
+
+	return parsed
+}
+
+// float parses a floating point variable, defaulting to fallback if undefined.
+func (env *envParser) float(name string, fallback float64) float64 {
+	value := env.getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		env.invalid(name, err)
+	}
+
+	return parsed
+}
+
+// duration parses a duration variable such as "5s", defaulting to fallback if
+// undefined.
+func (env *envParser) duration(name string, fallback time.Duration) time.Duration {
+	value := env.getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		env.invalid(name, err)
+	}
+
+	return parsed
+}
+
+// list parses a comma-separated list variable, ignoring empty entries.
+func (env *envParser) list(name string) []string {
+	var values []string
+
+	for _, value := range strings.Split(env.getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
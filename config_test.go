@@ -0,0 +1,287 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigAllowedPaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "default",
+			want: []string{"/snapshot.cgi"},
+		},
+		{
+			name: "duplicates",
+			env: map[string]string{
+				"SNAPSHOT_ALLOWED_PATHS": "/status.cgi,/snapshot.cgi,/status.cgi",
+			},
+			want: []string{"/status.cgi", "/snapshot.cgi"},
+		},
+		{
+			name:    "reserved",
+			env:     map[string]string{"SNAPSHOT_ALLOWED_PATHS": "/status.cgi,/ws"},
+			wantErr: `path "/ws" is reserved`,
+		},
+		{
+			name:    "root",
+			env:     map[string]string{"SNAPSHOT_ALLOWED_PATHS": "/"},
+			wantErr: `path "/" must not end with /`,
+		},
+		{
+			name:    "wildcard",
+			env:     map[string]string{"SNAPSHOT_ALLOWED_PATHS": "/{path...}"},
+			wantErr: "must not contain wildcards",
+		},
+		{
+			name: "viewer",
+			env: map[string]string{
+				"SNAPSHOT_SERVE_PATH":     "/",
+				"SNAPSHOT_VIEWER_ENABLED": "true",
+			},
+			wantErr: "SNAPSHOT_SERVE_PATH",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{
+				"SNAPSHOT_URL":      "http://aircam",
+				"SNAPSHOT_USERNAME": "ubnt",
+				"SNAPSHOT_PASSWORD": "secret",
+			}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+
+			loaded, err := loadConfig(func(name string) string {
+				return env[name]
+			})
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("loadConfig() error = %v", err)
+			}
+
+			if !slices.Equal(loaded.AllowedPaths, tt.want) {
+				t.Errorf("AllowedPaths = %q, want %q", loaded.AllowedPaths,
+					tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigBooleans(t *testing.T) {
+	fields := map[string]func(config) bool{
+		"SNAPSHOT_ENABLE_WS":       func(c config) bool { return c.EnableWS },
+		"SNAPSHOT_AUTODISCOVER":    func(c config) bool { return c.Autodiscover },
+		"SNAPSHOT_LOG_CREDENTIALS": func(c config) bool { return c.LogCredentials },
+		"SNAPSHOT_COOKIE_PREFIX":   func(c config) bool { return c.CookiePrefix },
+	}
+
+	tests := []struct {
+		value   string
+		want    bool
+		wantErr bool
+	}{
+		{value: "", want: false},
+		{value: "true", want: true},
+		{value: "TRUE", want: true},
+		{value: "1", want: true},
+		{value: "false", want: false},
+		{value: "0", want: false},
+		{value: "yes", wantErr: true},
+	}
+
+	for name, field := range fields {
+		for _, tt := range tests {
+			t.Run(name+"="+tt.value, func(t *testing.T) {
+				env := map[string]string{
+					"SNAPSHOT_URL":      "http://aircam",
+					"SNAPSHOT_USERNAME": "ubnt",
+					"SNAPSHOT_PASSWORD": "secret",
+					name:                tt.value,
+				}
+
+				loaded, err := loadConfig(func(name string) string {
+					return env[name]
+				})
+
+				if tt.wantErr {
+					if err == nil || !strings.Contains(err.Error(), name) {
+						t.Errorf("loadConfig() error = %v, want invalid %s", err,
+							name)
+					}
+					return
+				}
+
+				if err != nil {
+					t.Fatalf("loadConfig() error = %v", err)
+				}
+
+				if got := field(loaded); got != tt.want {
+					t.Errorf("%s = %t, want %t", name, got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+	}{
+		{name: "valid"},
+		{
+			name:    "missing url",
+			env:     map[string]string{"SNAPSHOT_URL": ""},
+			wantErr: "SNAPSHOT_URL not defined",
+		},
+		{
+			name:    "missing username",
+			env:     map[string]string{"SNAPSHOT_USERNAME": ""},
+			wantErr: "SNAPSHOT_USERNAME not defined",
+		},
+		{
+			name:    "missing password",
+			env:     map[string]string{"SNAPSHOT_PASSWORD": ""},
+			wantErr: "SNAPSHOT_PASSWORD not defined",
+		},
+		{
+			name:    "empty username",
+			env:     map[string]string{"SNAPSHOT_USERNAME": "  "},
+			wantErr: "SNAPSHOT_USERNAME is set but empty",
+		},
+		{
+			name:    "empty password",
+			env:     map[string]string{"SNAPSHOT_PASSWORD": "\t"},
+			wantErr: "SNAPSHOT_PASSWORD is set but empty",
+		},
+		{
+			name:    "login url without scheme",
+			env:     map[string]string{"SNAPSHOT_LOGIN_URL": "camera.local"},
+			wantErr: "Invalid value for SNAPSHOT_LOGIN_URL",
+		},
+		{
+			name:    "non-numeric port",
+			env:     map[string]string{"SNAPSHOT_PORT": "http"},
+			wantErr: "Invalid value for SNAPSHOT_PORT",
+		},
+		{
+			name:    "zero port",
+			env:     map[string]string{"SNAPSHOT_PORT": "0"},
+			wantErr: "SNAPSHOT_PORT",
+		},
+		{
+			name:    "out of range port",
+			env:     map[string]string{"SNAPSHOT_PORT": "65536"},
+			wantErr: "SNAPSHOT_PORT",
+		},
+		{
+			name:    "invalid ignore ssl",
+			env:     map[string]string{"SNAPSHOT_IGNORE_SSL": "maybe"},
+			wantErr: "Invalid value for SNAPSHOT_IGNORE_SSL",
+		},
+		{
+			name:    "invalid bool",
+			env:     map[string]string{"SNAPSHOT_DEBUG": "on"},
+			wantErr: "Invalid value for SNAPSHOT_DEBUG",
+		},
+		{
+			name:    "invalid duration",
+			env:     map[string]string{"SNAPSHOT_TIMEOUT": "10"},
+			wantErr: "Invalid value for SNAPSHOT_TIMEOUT",
+		},
+		{
+			name:    "client cert without key",
+			env:     map[string]string{"SNAPSHOT_CLIENT_CERT": "cert.pem"},
+			wantErr: "must be set together",
+		},
+		{
+			name: "missing client cert",
+			env: map[string]string{
+				"SNAPSHOT_CLIENT_CERT": "missing.pem",
+				"SNAPSHOT_CLIENT_KEY":  "missing.pem",
+			},
+			wantErr: "Invalid certificate and key in SNAPSHOT_CLIENT_CERT",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{
+				"SNAPSHOT_URL":      "http://aircam",
+				"SNAPSHOT_USERNAME": "ubnt",
+				"SNAPSHOT_PASSWORD": "secret",
+			}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+
+			loaded, err := loadConfig(func(name string) string {
+				return env[name]
+			})
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("loadConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("loadConfig() error = %v", err)
+			}
+
+			if loaded.URL != "http://aircam" || loaded.Port != 8000 ||
+				loaded.IgnoreSSL {
+				t.Errorf("loadConfig() = URL %q, port %d, ignore SSL %t, want "+
+					"http://aircam, 8000, false", loaded.URL, loaded.Port,
+					loaded.IgnoreSSL)
+			}
+		})
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr string
+	}{
+		{url: "http://aircam.local"},
+		{url: "https://aircam.local:8443/"},
+		{url: "https://[fe80::1]"},
+		{url: "https://[fe80::1]:8443/aircam/"},
+		{url: "https://fe80::1", wantErr: "IPv6 hosts must be bracketed"},
+		{url: "aircam.local", wantErr: "http"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			err := validateURL(tt.url)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validateURL() error = %v, want nil", err)
+			}
+
+			if tt.wantErr != "" && (err == nil ||
+				!strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateURL() error = %v, want one containing %q",
+					err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// corsExposedHeaders are the response headers of the proxy which scripts on
+// other origins are allowed to read, beyond the CORS-safelisted headers.
+var corsExposedHeaders = []string{
+	"X-Snapshot-Fetched-At",
+	"X-Snapshot-Stale",
+	"X-Snapshot-Fallback",
+	"X-Request-ID",
+}
+
+// cors wraps a handler with CORS handling for the configured origins, allowing
+// browsers to read responses from pages served by another origin. Preflight
+// OPTIONS requests are answered directly, before any authentication, as
+// browsers send them without credentials. Requests from origins which are not
+// allowed are served without CORS headers, which browsers then block. Only
+// origins which are listed explicitly may send credentials, such as the proxy
+// Basic Auth a browser has stored, while "*" allows any other origin to read
+// responses without them. When no origins are configured, the handler is
+// returned as-is.
+func cors(next http.HandlerFunc) http.HandlerFunc {
+	if len(conf.CORSOrigins) == 0 {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+
+		listed := origin != "" && slices.Contains(conf.CORSOrigins, origin)
+		allowed := listed ||
+			(origin != "" && slices.Contains(conf.CORSOrigins, "*"))
+		switch {
+		case listed:
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		case allowed:
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+
+		if allowed {
+			w.Header().Set("Access-Control-Expose-Headers",
+				strings.Join(corsExposedHeaders, ", "))
+		}
+
+		// Answer preflight requests, which carry the method requested
+		if r.Method == http.MethodOptions &&
+			r.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Methods",
+					"GET, HEAD, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+				w.Header().Set("Access-Control-Max-Age", "600")
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		name            string
+		origins         string
+		method          string
+		origin          string
+		wantOrigin      string
+		wantCredentials string
+		wantStatus      int
+	}{
+		{
+			name:            "allowed",
+			origins:         "https://app.example.com",
+			method:          http.MethodGet,
+			origin:          "https://app.example.com",
+			wantOrigin:      "https://app.example.com",
+			wantCredentials: "true",
+			wantStatus:      http.StatusOK,
+		},
+		{
+			name:       "disallowed",
+			origins:    "https://app.example.com",
+			method:     http.MethodGet,
+			origin:     "https://evil.example.com",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "wildcard",
+			origins:    "*",
+			method:     http.MethodGet,
+			origin:     "https://evil.example.com",
+			wantOrigin: "*",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:            "listed with wildcard",
+			origins:         "*,https://app.example.com",
+			method:          http.MethodGet,
+			origin:          "https://app.example.com",
+			wantOrigin:      "https://app.example.com",
+			wantCredentials: "true",
+			wantStatus:      http.StatusOK,
+		},
+		{
+			name:            "preflight",
+			origins:         "https://app.example.com",
+			method:          http.MethodOptions,
+			origin:          "https://app.example.com",
+			wantOrigin:      "https://app.example.com",
+			wantCredentials: "true",
+			wantStatus:      http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, map[string]string{
+				"SNAPSHOT_URL":          "http://aircam",
+				"SNAPSHOT_USERNAME":     "ubnt",
+				"SNAPSHOT_PASSWORD":     "secret",
+				"SNAPSHOT_CORS_ORIGINS": tt.origins,
+			})
+
+			handler := cors(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			request := httptest.NewRequest(tt.method, "/snapshot.cgi", nil)
+			request.Header.Set("Origin", tt.origin)
+			if tt.method == http.MethodOptions {
+				request.Header.Set("Access-Control-Request-Method",
+					http.MethodGet)
+			}
+
+			recorder := httptest.NewRecorder()
+			handler(recorder, request)
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, tt.wantStatus)
+			}
+
+			header := recorder.Header()
+			if got := header.Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got,
+					tt.wantOrigin)
+			}
+			if got := header.Get("Access-Control-Allow-Credentials"); got != tt.wantCredentials {
+				t.Errorf("Access-Control-Allow-Credentials = %q, want %q", got,
+					tt.wantCredentials)
+			}
+
+			wantMethods := ""
+			if tt.method == http.MethodOptions {
+				wantMethods = "GET, HEAD, OPTIONS"
+			}
+			if got := header.Get("Access-Control-Allow-Methods"); got != wantMethods {
+				t.Errorf("Access-Control-Allow-Methods = %q, want %q", got,
+					wantMethods)
+			}
+		})
+	}
+}
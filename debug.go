@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// startTime is when the server started, from which its uptime is reported.
+var startTime = time.Now()
+
+// debugBodyLimit bounds the upstream response body kept with an upstream error
+// for the ?debug=1 query parameter.
+const debugBodyLimit = 64 << 10
+
+// Type upstreamError wraps an error caused by an unexpected response from the
+// AirCam with the response itself, which is written verbatim to a client which
+// requested ?debug=1 when SNAPSHOT_DEBUG is enabled.
+type upstreamError struct {
+	err    error
+	status string
+	header http.Header
+	body   []byte
+}
+
+// Error returns the message of the wrapped error.
+func (e *upstreamError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the wrapped error, so that it can be matched by errors.Is.
+func (e *upstreamError) Unwrap() error {
+	return e.err
+}
+
+// withResponse wraps an error caused by an unexpected response from the AirCam
+// with its status, headers, and body, if SNAPSHOT_DEBUG is enabled. The body is
+// read from the response unless it has already been read.
+// It returns the wrapped error, or the error as-is if debug is not enabled.
+func withResponse(err error, response *http.Response, body []byte) error {
+	if !conf.Debug {
+		return err
+	}
+
+	if body == nil {
+		body, _ = io.ReadAll(io.LimitReader(response.Body, debugBodyLimit))
+	}
+
+	return &upstreamError{
+		err:    err,
+		status: response.Status,
+		header: debugHeaders(response),
+		body:   bytes.Clone(body[:min(len(body), debugBodyLimit)]),
+	}
+}
+
+// debugHeaders copies the headers of an AirCam response kept with an upstream
+// error, leaving out those the passthrough proxy never relays, as well as the
+// cookies set by the AirCam, and masking any value containing a cookie sent
+// with the request, so that the session does not leak to the client.
+// It returns the copied headers.
+func debugHeaders(response *http.Response) http.Header {
+	stripped := strippedHeaderNames(response.Header)
+	for _, name := range strippedHeaders {
+		stripped[name] = true
+	}
+
+	var secrets []string
+	if response.Request != nil {
+		for _, cookie := range response.Request.Cookies() {
+			if cookie.Value != "" {
+				secrets = append(secrets, cookie.Value)
+			}
+		}
+	}
+
+	header := http.Header{}
+	for name, values := range response.Header {
+		if stripped[name] {
+			continue
+		}
+
+		for _, value := range values {
+			for _, secret := range secrets {
+				if strings.Contains(value, secret) {
+					value = "***"
+					break
+				}
+			}
+
+			header.Add(name, value)
+		}
+	}
+
+	return header
+}
+
+// writeDebugError responds to a client which requested ?debug=1 with the
+// response of the AirCam which caused an upstream error, as plain text, with
+// the status code of the AirCam if it responded with an unexpected status.
+// It returns whether the error carried a response to write.
+func writeDebugError(w http.ResponseWriter, err error) bool {
+	var upstreamErr *upstreamError
+	if !errors.As(err, &upstreamErr) {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	var upstreamStatus ErrUpstreamStatus
+	if errors.As(err, &upstreamStatus) {
+		w.WriteHeader(upstreamStatus.StatusCode)
+	} else {
+		w.WriteHeader(errorStatus(err))
+	}
+
+	fmt.Fprintf(w, "%s\n\n%s\n\n", err, upstreamErr.status)
+	upstreamErr.header.Write(w)
+	fmt.Fprint(w, "\n")
+	w.Write(upstreamErr.body)
+
+	return true
+}
+
+// Type fetchStatus records the outcome of the most recent upstream fetches of
+// a camera, as reported by the /debug route.
+type fetchStatus struct {
+	mutex     sync.Mutex
+	succeeded time.Time
+	failed    time.Time
+	err       error
+	successes int64
+	failures  int64
+}
+
+// Type debugInfo represents the JSON body returned by the /debug route.
+type debugInfo struct {
+	Uptime     string         `json:"uptime"`
+	Goroutines int            `json:"goroutines"`
+	Cameras    []cameraStatus `json:"cameras"`
+}
+
+// Type cameraStatus represents the diagnostic state of a single camera in the
+// JSON body returned by the /debug route. The session cookie itself is never
+// included.
+type cameraStatus struct {
+	Name        string     `json:"name"`
+	SessionAge  string     `json:"sessionAge,omitempty"`
+	Relogins    int64      `json:"relogins"`
+	Fetches     int64      `json:"fetches"`
+	FetchErrors int64      `json:"fetchErrors"`
+	LastFetch   *time.Time `json:"lastFetch,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// recordStatus records the result of an upstream fetch for the /debug route.
+// Cancelled fetches say nothing about the AirCam and are ignored.
+func (c *camera) recordStatus(err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	s := &c.status
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err != nil {
+		s.failed = time.Now()
+		s.err = err
+		s.failures++
+	} else {
+		s.succeeded = time.Now()
+		s.successes++
+	}
+}
+
+// debugStatus collects the diagnostic state of the camera.
+// It returns the state of the camera.
+func (c *camera) debugStatus() cameraStatus {
+	status := cameraStatus{
+		Name:     c.label(),
+		Relogins: c.relogins.Load(),
+	}
+
+	if obtained := c.session.Obtained(); !obtained.IsZero() {
+		status.SessionAge = time.Since(obtained).Round(time.Second).String()
+	}
+
+	s := &c.status
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status.Fetches = s.successes
+	status.FetchErrors = s.failures
+
+	// Copy the times, which are replaced by later fetches
+	if succeeded := s.succeeded; !succeeded.IsZero() {
+		status.LastFetch = &succeeded
+	}
+
+	if failed := s.failed; s.err != nil {
+		status.LastError = s.err.Error()
+		status.LastErrorAt = &failed
+	}
+
+	return status
+}
+
+// handleDebug is the handler function for the /debug route, responding with
+// the uptime, goroutine count, and diagnostic state of every camera.
+func handleDebug(w http.ResponseWriter, r *http.Request) {
+	info := debugInfo{
+		Uptime:     time.Since(startTime).Round(time.Second).String(),
+		Goroutines: runtime.NumGoroutine(),
+	}
+
+	for _, c := range cameras {
+		info.Cameras = append(info.Cameras, c.debugStatus())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// logDiagnostics logs the uptime, goroutine count, and diagnostic state of
+// every camera at info level, as requested by SIGUSR1, for debugging when the
+// HTTP routes can not be reached. Like the /debug route, this never includes
+// passwords or session cookies.
+func logDiagnostics() {
+	logger("debug").Info("Diagnostic state", "uptime",
+		time.Since(startTime).Round(time.Second).String(), "goroutines",
+		runtime.NumGoroutine())
+
+	for _, c := range cameras {
+		status := c.debugStatus()
+		args := []any{"sessionAge", status.SessionAge, "fetches",
+			status.Fetches, "fetchErrors", status.FetchErrors, "relogins",
+			status.Relogins}
+
+		if status.LastFetch != nil {
+			args = append(args, "lastFetch", *status.LastFetch)
+		}
+
+		if status.LastErrorAt != nil {
+			args = append(args, "lastError", status.LastError, "lastErrorAt",
+				*status.LastErrorAt)
+		}
+
+		c.logger("debug").Info("Camera diagnostic state", args...)
+	}
+}
+
+// handleDiagnosticSignals runs every time the process receives the diagnostic
+// signal, SIGUSR1 where supported, and logs the diagnostic state.
+func handleDiagnosticSignals() {
+	signals := make(chan os.Signal, 1)
+	notifyDiagnostics(signals)
+
+	for range signals {
+		logDiagnostics()
+	}
+}
+
+// registerDebugRoutes associates the diagnostic handlers with their routes on a
+// mux, with the runtime profiles served by net/http/pprof, behind the proxy
+// credentials.
+func registerDebugRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/debug", requireAuth(handleDebug))
+	mux.HandleFunc("/debug/pprof/", requireAuth(pprof.Index))
+	mux.HandleFunc("/debug/pprof/profile", requireAuth(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/trace", requireAuth(pprof.Trace))
+	mux.HandleFunc("/debug/pprof/symbol", requireAuth(pprof.Symbol))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugErrorOmitsSessionHeaders(t *testing.T) {
+	setTestConfig(t, map[string]string{
+		"SNAPSHOT_URL":      "http://aircam",
+		"SNAPSHOT_USERNAME": "ubnt",
+		"SNAPSHOT_PASSWORD": "secret",
+		"SNAPSHOT_DEBUG":    "true",
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "http://aircam/snapshot.cgi",
+		nil)
+	request.AddCookie(&http.Cookie{Name: "AIROS_SESSIONID", Value: "session1"})
+
+	response := &http.Response{
+		Status: "500 Internal Server Error",
+		Header: http.Header{
+			"Content-Type": {"text/html"},
+			"Set-Cookie":   {"AIROS_SESSIONID=session2"},
+			"Connection":   {"X-Hop"},
+			"X-Hop":        {"1"},
+			"X-Session":    {"current session1"},
+		},
+		Body:    io.NopCloser(strings.NewReader("<html>Error</html>")),
+		Request: request,
+	}
+
+	err := withResponse(errors.New("Image - Unexpected response"), response,
+		nil)
+
+	recorder := httptest.NewRecorder()
+	if !writeDebugError(recorder, err) {
+		t.Fatal("writeDebugError() = false, want true")
+	}
+
+	body := recorder.Body.String()
+	for _, want := range []string{"Content-Type: text/html", "X-Session: ***",
+		"<html>Error</html>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("debug response does not contain %q:\n%s", want, body)
+		}
+	}
+
+	for _, unwanted := range []string{"Set-Cookie", "session1", "session2",
+		"X-Hop", "Connection"} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("debug response contains %q:\n%s", unwanted, body)
+		}
+	}
+}
+
+func TestDebugErrorWritesUpstreamStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+	}{
+		{
+			name: "upstream status",
+			err: fmt.Errorf("Image - Unexpected response: %w",
+				ErrUpstreamStatus{StatusCode: http.StatusServiceUnavailable}),
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "other error",
+			err:        errors.New("Image - Unexpected content type"),
+			wantStatus: http.StatusBadGateway,
+		},
+	}
+
+	setTestConfig(t, map[string]string{
+		"SNAPSHOT_URL":      "http://aircam",
+		"SNAPSHOT_USERNAME": "ubnt",
+		"SNAPSHOT_PASSWORD": "secret",
+		"SNAPSHOT_DEBUG":    "true",
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := &http.Response{
+				Status: "503 Service Unavailable",
+				Header: http.Header{},
+				Body:   io.NopCloser(strings.NewReader("Busy")),
+				Request: httptest.NewRequest(http.MethodGet,
+					"http://aircam/snapshot.cgi", nil),
+			}
+
+			recorder := httptest.NewRecorder()
+			if !writeDebugError(recorder, withResponse(tt.err, response, nil)) {
+				t.Fatal("writeDebugError() = false, want true")
+			}
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestProfileRoutesRequireAuth(t *testing.T) {
+	setTestConfig(t, map[string]string{
+		"SNAPSHOT_URL":        "http://aircam",
+		"SNAPSHOT_USERNAME":   "ubnt",
+		"SNAPSHOT_PASSWORD":   "secret",
+		"SNAPSHOT_DEBUG":      "true",
+		"SNAPSHOT_PROXY_USER": "proxy",
+		"SNAPSHOT_PROXY_PASS": "hunter2",
+	})
+
+	mux := http.NewServeMux()
+	registerDebugRoutes(mux)
+
+	tests := []struct {
+		name       string
+		path       string
+		auth       bool
+		wantStatus int
+	}{
+		{name: "index", path: "/debug/pprof/", auth: true,
+			wantStatus: http.StatusOK},
+		{name: "profile", path: "/debug/pprof/goroutine?debug=1", auth: true,
+			wantStatus: http.StatusOK},
+		{name: "symbol", path: "/debug/pprof/symbol", auth: true,
+			wantStatus: http.StatusOK},
+		{name: "unauthenticated index", path: "/debug/pprof/",
+			wantStatus: http.StatusUnauthorized},
+		{name: "unauthenticated trace", path: "/debug/pprof/trace",
+			wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.auth {
+				request.SetBasicAuth("proxy", "hunter2")
+			}
+
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, request)
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyDiagnostics does nothing, as there is no SIGUSR1 on this platform to
+// request the diagnostic state with.
+func notifyDiagnostics(signals chan<- os.Signal) {}
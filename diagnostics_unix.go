@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDiagnostics relays SIGUSR1, which requests the diagnostic state to be
+// logged, to a channel.
+func notifyDiagnostics(signals chan<- os.Signal) {
+	signal.Notify(signals, syscall.SIGUSR1)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// frameArchiveTimeFormat is the layout of the file names of frames in the
+// /frames.zip archive, precise to the millisecond so that frames fetched
+// within the same second have distinct names.
+const frameArchiveTimeFormat = "2006-01-02T15-04-05.000"
+
+// Type frameBuffer is a ring buffer of the most recently fetched frames of a
+// camera, holding up to SNAPSHOT_FRAME_BUFFER frames for the /frames.zip route.
+type frameBuffer struct {
+	mutex  sync.Mutex
+	frames []*frame
+	next   int
+}
+
+// bufferFrame adds a newly fetched frame to the frame buffer of the camera,
+// replacing the oldest frame once it is full. Nothing is buffered if the frame
+// buffer is disabled.
+func (c *camera) bufferFrame(f *frame) {
+	if conf.FrameBuffer == 0 {
+		return
+	}
+
+	b := &c.frames
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.frames) < conf.FrameBuffer {
+		b.frames = append(b.frames, f)
+		return
+	}
+
+	b.frames[b.next] = f
+	b.next = (b.next + 1) % len(b.frames)
+}
+
+// bufferedFrames retrieves the frames in the frame buffer of the camera.
+// It returns the frames, oldest first.
+func (c *camera) bufferedFrames() []*frame {
+	b := &c.frames
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return append(append([]*frame{}, b.frames[b.next:]...),
+		b.frames[:b.next]...)
+}
+
+// handleFrames is the handler function for the /frames.zip route, which
+// responds with a ZIP archive of the buffered frames of the camera, each named
+// by the time it was fetched. It responds with 404 if no frames are buffered,
+// including when the frame buffer is disabled.
+func (c *camera) handleFrames(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	frames := c.bufferedFrames()
+	if len(frames) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(
+		"attachment; filename=%q", fmt.Sprintf("frames-%s-%s.zip", c.label(),
+			time.Now().UTC().Format(saveTimeFormat))))
+
+	// Write the archive straight to the response, storing the frames as-is
+	// as JPEGs do not compress further
+	archive := zip.NewWriter(w)
+	for _, f := range frames {
+		entry, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     f.fetched.UTC().Format(frameArchiveTimeFormat) + ".jpg",
+			Method:   zip.Store,
+			Modified: f.fetched,
+		})
+		if err == nil {
+			_, err = entry.Write(f.image)
+		}
+
+		if err != nil {
+			c.logger("frames").DebugContext(r.Context(),
+				"Error writing frame archive", "error", err)
+			return
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		c.logger("frames").DebugContext(r.Context(),
+			"Error writing frame archive", "error", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFramesArchive(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, map[string]string{
+		"SNAPSHOT_FRAME_BUFFER": "2",
+	})
+	server := newTestServer(t, c)
+
+	get := func() (*http.Response, []byte) {
+		t.Helper()
+
+		response, err := http.Get(server.URL + "/frames.zip")
+		if err != nil {
+			t.Fatalf("GET /frames.zip error = %v", err)
+		}
+		defer response.Body.Close()
+
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatalf("reading body error = %v", err)
+		}
+
+		return response, body
+	}
+
+	if response, _ := get(); response.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /frames.zip with no frames status = %d, want %d",
+			response.StatusCode, http.StatusNotFound)
+	}
+
+	// Buffer one frame more than the buffer holds, pushing out the oldest
+	fetched := time.Date(2026, 10, 14, 8, 0, 0, 0, time.UTC)
+	var frames []*frame
+	for i := range 3 {
+		f := &frame{
+			image:   append(bytes.Clone(testJPEG), byte(i)),
+			fetched: fetched.Add(time.Duration(i) * 250 * time.Millisecond),
+		}
+		frames = append(frames, f)
+		c.bufferFrame(f)
+	}
+
+	response, body := get()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("GET /frames.zip status = %d, want %d", response.StatusCode,
+			http.StatusOK)
+	}
+
+	if contentType := response.Header.Get("Content-Type"); contentType !=
+		"application/zip" {
+		t.Errorf("Content-Type = %q, want %q", contentType, "application/zip")
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("zip.NewReader() error = %v", err)
+	}
+
+	want := []struct {
+		name  string
+		image []byte
+	}{
+		{name: "2026-10-14T08-00-00.250.jpg", image: frames[1].image},
+		{name: "2026-10-14T08-00-00.500.jpg", image: frames[2].image},
+	}
+
+	if len(archive.File) != len(want) {
+		t.Fatalf("archive has %d entries, want %d", len(archive.File),
+			len(want))
+	}
+
+	for i, entry := range archive.File {
+		if entry.Name != want[i].name {
+			t.Errorf("entry %d name = %q, want %q", i, entry.Name, want[i].name)
+		}
+
+		image, err := readZipEntry(entry)
+		if err != nil {
+			t.Fatalf("reading entry %q error = %v", entry.Name, err)
+		}
+
+		if !bytes.Equal(image, want[i].image) {
+			t.Errorf("entry %q = %x, want %x", entry.Name, image, want[i].image)
+		}
+	}
+}
+
+func TestFramesArchiveDisabled(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, nil)
+	server := newTestServer(t, c)
+
+	c.bufferFrame(&frame{image: testJPEG, fetched: time.Now()})
+
+	response, err := http.Get(server.URL + "/frames.zip")
+	if err != nil {
+		t.Fatalf("GET /frames.zip error = %v", err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /frames.zip status = %d, want %d", response.StatusCode,
+			http.StatusNotFound)
+	}
+}
+
+// readZipEntry reads the contents of an entry of a ZIP archive.
+// It returns the contents, and any errors encountered reading them.
+func readZipEntry(entry *zip.File) ([]byte, error) {
+	reader, err := entry.Open()
+	if err != nil {
+		return nil, fmt.Errorf("opening entry: %w", err)
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
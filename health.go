@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ready is whether startup has finished, after the cameras have logged in, and
+// snapshots can be served. The server is live before then, so that
+// orchestrators can tell a starting server from a dead one.
+var ready atomic.Bool
+
+// notReadyRetryAfter is the Retry-After, in seconds, of responses to requests
+// received before startup has finished.
+const notReadyRetryAfter = "5"
+
+// startupCheckMinBytes is the smallest image accepted by the startup check,
+// below which the response can not be a real frame.
+const startupCheckMinBytes = 128
+
+// Type healthStatus represents the JSON body returned by the /healthz and
+// /ready routes.
+type healthStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// checkHealth verifies that the camera is reachable and that its session is
+// valid by requesting a snapshot, which must also be at least the minimum
+// healthy size if SNAPSHOT_MIN_HEALTHY_FAIL is set. The result is cached for
+// the health TTL so that frequent probes do not overload the camera.
+// It returns any errors encountered during the check.
+func (c *camera) checkHealth() error {
+	c.healthMutex.Lock()
+	defer c.healthMutex.Unlock()
+
+	if !c.healthChecked.IsZero() && time.Since(c.healthChecked) < conf.HealthTTL {
+		return c.healthErr
+	}
+
+	image, err := c.requestSnapshot()
+
+	switch {
+	case err != nil:
+	case !bytes.HasPrefix(image, jpegSOI):
+		err = errors.New("Health - Response is not a JPEG image")
+	case conf.MinHealthyFail && len(image) < conf.MinHealthyBytes:
+		err = fmt.Errorf("Health - Image is only %d bytes, below the healthy "+
+			"minimum of %d", len(image), conf.MinHealthyBytes)
+	}
+
+	c.healthChecked = time.Now()
+	c.healthErr = err
+
+	return err
+}
+
+// checkStartup verifies end-to-end snapshot retrieval after login by fetching
+// a single frame, so that a misconfigured camera fails at startup rather than
+// on the first client request.
+// It returns an error describing why the frame is not a valid JPEG, if it is
+// not.
+func (c *camera) checkStartup() error {
+	image, err := c.requestSnapshot()
+	switch {
+	case err != nil:
+		return err
+	case !bytes.HasPrefix(image, jpegSOI):
+		return errors.New("Startup - Response is not a JPEG image")
+	case len(image) < startupCheckMinBytes:
+		return fmt.Errorf("Startup - Image is only %d bytes", len(image))
+	}
+
+	return nil
+}
+
+// requestSnapshot requests a single snapshot from the camera, bypassing the
+// cache and without logging in again if the session has expired, or taking a
+// single frame from the RTSP stream with the RTSP source.
+// It returns a byte slice with the image contents, and any errors encountered
+// during the request.
+func (c *camera) requestSnapshot() ([]byte, error) {
+	if conf.Source == sourceRTSP {
+		image, _, err := c.fetchRTSPFrame(context.Background())
+		return image, err
+	}
+
+	sessionCookie, err := c.session.Current(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	image, _, err := c.requestImage(context.Background(), sessionCookie, nil)
+
+	return image, err
+}
+
+// requireReady wraps a handler, responding with 503 and a Retry-After header
+// rather than handling requests received before startup has finished.
+func requireReady(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			w.Header().Set("Retry-After", notReadyRetryAfter)
+			http.Error(w, "authenticating, not ready yet",
+				http.StatusServiceUnavailable)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// checkReady verifies that the camera can serve frames, which requires startup
+// to have finished, the last login to have succeeded, and either a recent
+// successful fetch or, if there has been none within the health TTL, a
+// successful health check.
+// It returns an error describing why the camera is not ready, if it is not.
+func (c *camera) checkReady() error {
+	if !ready.Load() {
+		return errors.New("Ready - Startup has not finished")
+	}
+
+	if conf.Source == sourceHTTP {
+		if c.session.Get() == nil {
+			return errors.New("Ready - Not logged in")
+		}
+
+		if failed := c.session.Failed(); !failed.IsZero() {
+			return fmt.Errorf("Ready - Last login failed at %s",
+				failed.UTC().Format(time.RFC3339))
+		}
+	}
+
+	// A fetch which succeeded recently, and has not failed since, shows that
+	// frames can be served without another request to the camera
+	c.status.mutex.Lock()
+	succeeded, failed := c.status.succeeded, c.status.failed
+	c.status.mutex.Unlock()
+
+	if time.Since(succeeded) < conf.HealthTTL && succeeded.After(failed) {
+		return nil
+	}
+
+	return c.checkHealth()
+}
+
+// handleHealth is the handler function for the /healthz route, which is meant
+// for liveness probes. It responds with 200 as long as the server can handle
+// requests, without contacting the camera, so that an orchestrator does not
+// restart the server only because the camera is down.
+func (c *camera) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(healthStatus{Status: "ok"})
+}
+
+// handleReady is the handler function for the /ready route, which is meant for
+// readiness probes. It responds with 200 when the camera can serve frames, and
+// 503 with a JSON body describing why otherwise, so that an orchestrator stops
+// routing requests to a server which can not serve them.
+func (c *camera) handleReady(w http.ResponseWriter, r *http.Request) {
+	status := healthStatus{Status: "ready"}
+	code := http.StatusOK
+
+	if err := c.checkReady(); err != nil {
+		c.logger("health").WarnContext(r.Context(), "Camera is not ready",
+			"error", err)
+		status = healthStatus{Status: "not ready", Error: err.Error()}
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
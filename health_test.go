@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTinyFrames(t *testing.T) {
+	tests := []struct {
+		name    string
+		fail    string
+		wantErr bool
+	}{
+		{name: "counted", fail: "false"},
+		{name: "failing health", fail: "true", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aircam := newFakeAirCam(t, "ubnt", "secret")
+			c := newTestCamera(t, aircam, map[string]string{
+				"SNAPSHOT_MIN_HEALTHY_BYTES": "128",
+				"SNAPSHOT_MIN_HEALTHY_FAIL":  tt.fail,
+			})
+
+			sessionCookie, err := c.login(context.Background())
+			if err != nil {
+				t.Fatalf("login() error = %v", err)
+			}
+			c.session.Set(sessionCookie)
+
+			suspect := suspectFrames.WithLabelValues(c.label())
+			before := testutil.ToFloat64(suspect)
+
+			// Tiny frames are still served, but counted as suspect
+			if _, err := c.loadFrame(context.Background(), nil); err != nil {
+				t.Fatalf("loadFrame() error = %v", err)
+			}
+
+			if got := testutil.ToFloat64(suspect) - before; got != 1 {
+				t.Errorf("suspect frames = %v, want 1", got)
+			}
+
+			err = c.checkHealth()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkHealth() error = %v, want error %t", err,
+					tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHealthyFramesPassMinimum(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, map[string]string{
+		"SNAPSHOT_MIN_HEALTHY_BYTES": "16",
+		"SNAPSHOT_MIN_HEALTHY_FAIL":  "true",
+	})
+
+	sessionCookie, err := c.login(context.Background())
+	if err != nil {
+		t.Fatalf("login() error = %v", err)
+	}
+	c.session.Set(sessionCookie)
+
+	if err := c.checkHealth(); err != nil {
+		t.Errorf("checkHealth() error = %v", err)
+	}
+}
+
+func TestHealthRoutes(t *testing.T) {
+	tests := []struct {
+		name           string
+		snapshotStatus int
+		wantHealth     int
+		wantReady      int
+	}{
+		{name: "healthy upstream", wantHealth: http.StatusOK,
+			wantReady: http.StatusOK},
+		{name: "unhealthy upstream",
+			snapshotStatus: http.StatusInternalServerError,
+			wantHealth:     http.StatusOK,
+			wantReady:      http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aircam := newFakeAirCam(t, "ubnt", "secret")
+			aircam.snapshotStatus = tt.snapshotStatus
+			server := newTestServer(t, newTestCamera(t, aircam, nil))
+
+			for path, want := range map[string]int{
+				"/healthz": tt.wantHealth,
+				"/ready":   tt.wantReady,
+			} {
+				response, err := http.Get(server.URL + path)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var status healthStatus
+				err = json.NewDecoder(response.Body).Decode(&status)
+				response.Body.Close()
+				if err != nil {
+					t.Fatalf("GET %s body error = %v", path, err)
+				}
+
+				if response.StatusCode != want {
+					t.Errorf("GET %s status = %d, want %d (%+v)", path,
+						response.StatusCode, want, status)
+				}
+			}
+		})
+	}
+}
+
+func TestReadyTransitions(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, nil)
+	server := newTestServer(t, c)
+
+	// Checks the /ready route, along with /healthz which stays live throughout
+	check := func(step string, wantReady int, wantErr string) {
+		t.Helper()
+
+		for path, want := range map[string]int{
+			"/healthz": http.StatusOK,
+			"/ready":   wantReady,
+		} {
+			response, err := http.Get(server.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var status healthStatus
+			err = json.NewDecoder(response.Body).Decode(&status)
+			response.Body.Close()
+			if err != nil {
+				t.Fatalf("%s: GET %s body error = %v", step, path, err)
+			}
+
+			if response.StatusCode != want {
+				t.Errorf("%s: GET %s status = %d, want %d (%+v)", step, path,
+					response.StatusCode, want, status)
+			}
+
+			if path == "/ready" && !strings.Contains(status.Error, wantErr) {
+				t.Errorf("%s: GET /ready error = %q, want %q", step,
+					status.Error, wantErr)
+			}
+		}
+	}
+
+	ready.Store(false)
+	check("starting", http.StatusServiceUnavailable, "Startup has not finished")
+
+	ready.Store(true)
+	check("started", http.StatusOK, "")
+
+	// Logging in again with rotated credentials fails, until they are fixed
+	c.Password = "rotated"
+	if err := c.session.Refresh(context.Background()); err == nil {
+		t.Fatal("Refresh() with rotated password succeeded")
+	}
+	check("login failed", http.StatusServiceUnavailable, "Last login failed")
+
+	c.Password = "secret"
+	if err := c.session.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	check("logged in again", http.StatusOK, "")
+
+	c.session.Set(nil)
+	check("logged out", http.StatusServiceUnavailable, "Not logged in")
+}
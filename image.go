@@ -0,0 +1,761 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// readBuffers pools the buffers which upstream response bodies are read into,
+// so that sustained polling does not grow a new buffer for every image.
+var readBuffers = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// forwardedQuery filters the query parameters of an incoming request down to
+// those named in the SNAPSHOT_FORWARD_PARAMS allowlist.
+// It returns the filtered parameters, which are empty by default so that
+// cache-busting parameters such as ?t=12345 never reach the AirCam.
+func forwardedQuery(query url.Values) url.Values {
+	forwarded := url.Values{}
+
+	for _, param := range conf.ForwardParams {
+		if values, ok := query[param]; ok {
+			forwarded[param] = values
+		}
+	}
+
+	return forwarded
+}
+
+// snapshotURL builds the upstream snapshot URL of the camera for a set of
+// forwarded query parameters.
+// It returns the URL, which doubles as the cache key for a snapshot. Encode
+// sorts the parameters by name and only allowlisted parameters are present, so
+// requests which differ in ignored parameters or parameter order result in
+// the same key.
+func (c *camera) snapshotURL(query url.Values) string {
+	return c.endpoint(c.path, query.Encode())
+}
+
+// getImage retrieves an image from the camera using its current session, and
+// writes it to the provided writer. Nothing is written if retrieval fails,
+// including when the context is cancelled because the client went away.
+// It returns any errors encountered during retrieval.
+func (c *camera) getImage(ctx context.Context, out io.Writer,
+	query url.Values) error {
+	// Stream the image straight from the AirCam to clients if configured
+	if w, ok := out.(http.ResponseWriter); ok && conf.StreamResponse &&
+		conf.Source == sourceHTTP {
+		return c.streamImage(ctx, w, query)
+	}
+
+	f, err := c.getFrameOrStale(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	return writeFrame(out, f, f.image, "image/jpeg")
+}
+
+// writeFrame writes an image of a frame to the provided writer, which is either
+// the frame's own image or a transformed copy of it.
+// It returns any errors encountered writing the image.
+func writeFrame(out io.Writer, f *frame, image []byte,
+	contentType string) error {
+	// Write the image, marking it as an uncacheable image of known length with
+	// the time the frame was captured and fetched and an ETag of its contents
+	// when writing to an HTTP response. These are only set once retrieval
+	// succeeds, so that failures respond with the error status alone.
+	if w, ok := out.(http.ResponseWriter); ok {
+		sum := sha256.Sum256(image)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(image)))
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+		w.Header().Set("Last-Modified",
+			f.captured.UTC().Format(http.TimeFormat))
+		w.Header().Set("X-Snapshot-Fetched-At",
+			f.fetched.UTC().Format(time.RFC3339Nano))
+
+		if f.stale {
+			w.Header().Set("X-Snapshot-Stale", "true")
+		}
+	}
+
+	_, err := out.Write(image)
+
+	return err
+}
+
+// streamImage makes a snapshot request to the AirCam using its current session,
+// logging in again and retrying once if it has expired, and copies the image
+// to the response as it arrives rather than buffering it first, see
+// SNAPSHOT_STREAM_RESPONSE. The response has no Content-Length or ETag, and
+// the image is not cached, processed, or checked to be a complete JPEG. Once
+// any of the image is written, an error can no longer be responded with, so
+// the response is aborted instead, leaving the client with a truncated
+// response rather than an incomplete image it could mistake for whole.
+// It returns any errors encountered before the image was written.
+func (c *camera) streamImage(ctx context.Context, w http.ResponseWriter,
+	query url.Values) error {
+	if !c.allowFetch() {
+		return errCircuitOpen
+	}
+
+	release, err := c.acquireFetch(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	start := time.Now()
+	defer func() {
+		upstreamDuration.WithLabelValues(c.label()).Observe(
+			time.Since(start).Seconds())
+	}()
+
+	sessionCookie, err := c.session.Current(ctx)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.openImage(ctx, sessionCookie, query)
+	if errors.Is(err, ErrSessionExpired) {
+		c.logger("image").InfoContext(ctx, "Session expired, logging in again")
+
+		sessionCookie, err = c.session.RefreshExpired(ctx, sessionCookie)
+		if err == nil {
+			response, err = c.openImage(ctx, sessionCookie, query)
+		}
+	}
+
+	if err != nil {
+		c.recordFetch(err)
+		c.recordStatus(err)
+		return err
+	}
+	defer response.Body.Close()
+
+	fetched := time.Now()
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Last-Modified",
+		frameTime(response.Header, fetched).UTC().Format(http.TimeFormat))
+	w.Header().Set("X-Snapshot-Fetched-At",
+		fetched.UTC().Format(time.RFC3339Nano))
+
+	// Copy the body up to one byte past the maximum size, so that an oversized
+	// image is detected rather than silently truncated
+	written, err := io.Copy(w, io.LimitReader(response.Body,
+		conf.MaxImageBytes+1))
+	if err == nil && written > conf.MaxImageBytes {
+		err = fmt.Errorf("Image - Image exceeds maximum size of %d bytes",
+			conf.MaxImageBytes)
+	} else if err != nil {
+		err = fmt.Errorf("Image - Error streaming response body: %w", err)
+	}
+
+	if ctx.Err() != nil {
+		c.logger("image").DebugContext(ctx, "Request cancelled by client")
+		return ctx.Err()
+	}
+
+	c.recordFetch(err)
+	c.recordStatus(err)
+
+	if err == nil {
+		return nil
+	}
+
+	c.logger("image").ErrorContext(ctx, "Error streaming image", "bytes",
+		written, "error", err)
+	c.countUpstreamError(transportCause(err))
+
+	if written == 0 {
+		return err
+	}
+
+	panic(http.ErrAbortHandler)
+}
+
+// loadFrame retrieves and processes a new frame from the camera.
+// It returns the frame, and any errors encountered during retrieval.
+func (c *camera) loadFrame(ctx context.Context, query url.Values) (*frame,
+	error) {
+	// Fetch the image, retrying once if a truncated image is rejected.
+	image, header, err := c.fetchImage(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	fetched := time.Now()
+
+	image, complete := repairJPEG(image)
+	if !complete {
+		c.logger("image").WarnContext(ctx, "Rejected truncated JPEG, retrying")
+
+		image, header, err = c.fetchImage(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+
+		fetched = time.Now()
+
+		image, complete = repairJPEG(image)
+		if !complete {
+			c.logger("image").ErrorContext(ctx,
+				"Rejected truncated JPEG after retry")
+			return nil, errors.New("Image - Truncated JPEG received")
+		}
+	}
+
+	// Flag suspiciously small images, which the AirCam returns as a valid but
+	// all-black JPEG when the sensor fails. These are still served.
+	if len(image) < conf.MinHealthyBytes {
+		c.logger("image").WarnContext(ctx,
+			"Suspect image is below healthy minimum size", "bytes", len(image),
+			"minimum", conf.MinHealthyBytes)
+		suspectFrames.WithLabelValues(c.label()).Inc()
+	}
+
+	// Process the image with the frame pipeline, such as blacking out any
+	// privacy mask regions, before it is served.
+	captured := frameTime(header, fetched)
+	image, err = conf.pipeline.apply(image, captured)
+	if err != nil {
+		c.logger("image").ErrorContext(ctx, "Error processing frame", "error",
+			err)
+		return nil, err
+	}
+
+	return &frame{
+		image:    image,
+		fetched:  fetched,
+		captured: captured,
+	}, nil
+}
+
+// fetchImage makes a snapshot request to the camera using its current session.
+// If the session has expired, it logs in again and retries the request once.
+// With the RTSP source, the frame is taken from the RTSP stream instead.
+// It returns a byte slice with the image contents, the response headers, and
+// any errors encountered during the request.
+func (c *camera) fetchImage(ctx context.Context, query url.Values) ([]byte,
+	http.Header, error) {
+	if conf.Source == sourceRTSP {
+		return c.fetchRTSPFrame(ctx)
+	}
+
+	// Logging in to an unreachable URL fails over like a request to it
+	baseURL := c.activeURL()
+	sessionCookie, err := c.session.Current(ctx)
+	if err != nil && !unreachable(err) {
+		return nil, nil, err
+	}
+
+	var image []byte
+	var header http.Header
+	if err == nil {
+		image, header, err = c.requestImageWithRetry(ctx, sessionCookie, query)
+	}
+
+	// Fail over to the next URL of the camera while the one in use is
+	// unreachable, trying each other URL once, logging in to it if it has no
+	// session yet
+	for tries := 1; tries < c.urlCount() && unreachable(err); tries++ {
+		c.failover(ctx, baseURL, err)
+
+		baseURL = c.activeURL()
+		if sessionCookie, err = c.session.Current(ctx); err != nil {
+			continue
+		}
+
+		image, header, err = c.requestImageWithRetry(ctx, sessionCookie, query)
+	}
+
+	if sessionCookie == nil {
+		return nil, nil, err
+	}
+
+	// A dropped connection means the AirCam may have rebooted, which also
+	// invalidates the session, so give it a moment to finish booting before
+	// logging in again as if the session expired. This is only logged once
+	// until a request succeeds again.
+	if connectionLost(err) {
+		if !c.rebooting.Swap(true) {
+			c.logger("image").WarnContext(ctx,
+				"Camera appears to have rebooted, re-authenticating",
+				"error", err)
+		}
+
+		select {
+		case <-time.After(rebootBackoff):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+
+		err = ErrSessionExpired
+	}
+
+	if errors.Is(err, ErrSessionExpired) {
+		c.logger("image").InfoContext(ctx, "Session expired, logging in again")
+
+		sessionCookie, err = c.session.RefreshExpired(ctx, sessionCookie)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		image, header, err = c.requestImage(ctx, sessionCookie, query)
+	}
+
+	if err == nil && c.rebooting.Swap(false) {
+		c.logger("image").InfoContext(ctx, "Camera is back after reboot")
+	}
+
+	return image, header, err
+}
+
+// fetchRetryBackoff is the backoff before the first retry of a failed image
+// fetch, which doubles for each further retry.
+const fetchRetryBackoff = 100 * time.Millisecond
+
+// Type ErrUpstreamStatus indicates that the AirCam responded to a snapshot or
+// login request with an unexpected status, which is wrapped by the error of
+// either, so that callers can match it with errors.As.
+type ErrUpstreamStatus struct {
+	StatusCode int
+}
+
+// Error formats the status of the response.
+func (err ErrUpstreamStatus) Error() string {
+	return fmt.Sprintf("Non-200 status code received: %d", err.StatusCode)
+}
+
+// upstreamTimeout wraps an error of a request to the AirCam which timed out in
+// ErrUpstreamTimeout, leaving any other error as-is.
+func upstreamTimeout(err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) {
+		return fmt.Errorf("%w: %w", ErrUpstreamTimeout, err)
+	}
+
+	return err
+}
+
+// requestImageWithRetry makes a snapshot request to the AirCam like
+// requestImage, retrying requests which failed transiently up to
+// SNAPSHOT_FETCH_RETRIES times with exponential backoff and jitter. Retries
+// stop once the next would start after the context deadline or the upstream
+// timeout since the first request, and are abandoned if the context is
+// cancelled.
+// It returns a byte slice with the image contents, the response headers, and
+// the error of the last request if every request failed.
+func (c *camera) requestImageWithRetry(ctx context.Context,
+	sessionCookie *http.Cookie, query url.Values) ([]byte, http.Header, error) {
+	deadline := time.Now().Add(conf.Timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	backoff := fetchRetryBackoff
+	for attempt := 0; ; attempt++ {
+		image, header, err := c.requestImage(ctx, sessionCookie, query)
+		if err == nil || attempt >= conf.FetchRetries || !retryable(err) {
+			return image, header, err
+		}
+
+		// Add up to half the backoff again, so that requests which failed
+		// together do not retry together
+		delay := backoff + rand.N(backoff/2)
+		if time.Now().Add(delay).After(deadline) {
+			return image, header, err
+		}
+
+		c.logger("image").DebugContext(ctx, "Fetch failed, retrying",
+			"attempt", attempt+1, "delay", delay, "error", err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+
+		backoff *= 2
+	}
+}
+
+// retryable checks whether a failed snapshot request may succeed if retried,
+// which is the case for timeouts, lost connections, and 5xx responses. Expired
+// sessions are not retried here, as they are handled by logging in again.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrSessionExpired) {
+		return false
+	}
+
+	var status ErrUpstreamStatus
+	if errors.As(err, &status) {
+		return status.StatusCode >= 500
+	}
+
+	return connectionLost(err) ||
+		errorStatus(err) == http.StatusGatewayTimeout
+}
+
+// connectionLost checks whether an error is caused by the connection to the
+// AirCam being reset, refused, or closed mid response, as happens when it
+// reboots, rather than by a timeout or an unexpected response.
+// It returns whether the connection was lost.
+func connectionLost(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// unreachable checks whether an error is caused by the AirCam URL being
+// unreachable, either as the connection was lost, see connectionLost, or as it
+// could not be resolved or connected to at all, which a camera with failover
+// URLs fails over on.
+// It returns whether the URL is unreachable.
+func unreachable(err error) bool {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+
+	return connectionLost(err) || errors.As(err, &dnsErr) ||
+		(errors.As(err, &opErr) && opErr.Op == "dial")
+}
+
+// requestImage makes a single snapshot request to the AirCam using a session
+// cookie, which is aborted if the context is cancelled.
+// It returns a byte slice with the image contents, the response headers, and
+// any errors encountered during the request.
+func (c *camera) requestImage(ctx context.Context, sessionCookie *http.Cookie,
+	query url.Values) ([]byte, http.Header, error) {
+	// Wait for a free fetch slot, which is held until the image is read
+	release, err := c.acquireFetch(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	// Record the latency of the request, including reading the image
+	start := time.Now()
+	defer func() {
+		upstreamDuration.WithLabelValues(c.label()).Observe(
+			time.Since(start).Seconds())
+	}()
+
+	response, err := c.openImage(ctx, sessionCookie, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+
+	// Read the response body into a pooled buffer, returning an error if unable
+	// to read. The body is read up to one byte past the maximum size so that an
+	// oversized image is detected rather than silently truncated.
+	buffer := readBuffers.Get().(*bytes.Buffer)
+	buffer.Reset()
+	defer readBuffers.Put(buffer)
+
+	_, err = buffer.ReadFrom(io.LimitReader(response.Body,
+		conf.MaxImageBytes+1))
+	if errors.Is(err, context.Canceled) {
+		c.logger("image").DebugContext(ctx, "Request cancelled by client")
+		return nil, nil, err
+	} else if err != nil {
+		if !connectionLost(err) {
+			c.logger("image").ErrorContext(ctx, "Error reading response body",
+				"error", err)
+		}
+		c.countUpstreamError(transportCause(err))
+		if timeout := upstreamTimeout(err); timeout != err {
+			return nil, nil, timeout
+		}
+		return nil, nil, fmt.Errorf("Image - Error reading response body: %w",
+			err)
+	}
+
+	if int64(buffer.Len()) > conf.MaxImageBytes {
+		c.logger("image").ErrorContext(ctx, "Image exceeds maximum size",
+			"maximum", conf.MaxImageBytes)
+		return nil, nil, fmt.Errorf(
+			"Image - Image exceeds maximum size of %d bytes", conf.MaxImageBytes)
+	}
+
+	// Check that the body is a JPEG image, as the AirCam responds with an HTML
+	// error page when it is rebooting, which must not be served as a frame.
+	if !bytes.HasPrefix(buffer.Bytes(), jpegSOI) {
+		c.logger("image").ErrorContext(ctx, "Response is not a JPEG image",
+			"content_type", response.Header.Get("Content-Type"))
+		c.countUpstreamError(causeNotJPEG)
+		return nil, nil, withResponse(
+			errors.New("Image - Response is not a JPEG image"), response,
+			buffer.Bytes())
+	}
+
+	// Copy the image out of the buffer, which is reused by the next request
+	return bytes.Clone(buffer.Bytes()), response.Header, nil
+}
+
+// openImage makes a snapshot request to the AirCam using a session cookie,
+// checking that it responded with an image, whose body is left unread.
+// It returns the response, which must be closed, and any errors encountered
+// during the request.
+func (c *camera) openImage(ctx context.Context, sessionCookie *http.Cookie,
+	query url.Values) (*http.Response, error) {
+	// Create an HTTP request based on the provided URL endpoint, returning an
+	// error if the request cannot be created.
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		c.snapshotURL(query), nil)
+	if err != nil {
+		c.logger("image").ErrorContext(ctx, "Error creating request", "error",
+			err)
+		return nil, err
+	}
+
+	// Make the HTTP request authenticated by the session with the shared http
+	// Client, returning an error if the request fails or times out.
+	// A cancelled request is not an upstream failure, so it is not logged as an
+	// error or counted.
+	response, err := c.auth.do(c.httpClient(), request, sessionCookie)
+	if errors.Is(err, context.Canceled) {
+		c.logger("image").DebugContext(ctx, "Request cancelled by client")
+		return nil, err
+	} else if err != nil {
+		// A lost connection is logged once by fetchImage, rather than by every
+		// request while the AirCam reboots
+		if !connectionLost(err) {
+			c.logger("image").ErrorContext(ctx, "Error creating response",
+				"error", err)
+		}
+		c.countUpstreamError(transportCause(err))
+		if timeout := upstreamTimeout(err); timeout != err {
+			return nil, timeout
+		}
+		return nil, fmt.Errorf("Image - Error creating response: %w", err)
+	}
+
+	// Check if the status code is OK (200) and return an error if it is not.
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		c.logger("image").ErrorContext(ctx, "Non-200 status code received",
+			"status", response.StatusCode)
+		c.countUpstreamError(causeNon200)
+		return nil, withResponse(fmt.Errorf("Image - %w",
+			ErrUpstreamStatus{StatusCode: response.StatusCode}), response, nil)
+	}
+
+	// Check if the AirCam redirected to the login page or responded with
+	// something other than an image, which means the session has expired.
+	contentType := response.Header.Get("Content-Type")
+	if strings.HasSuffix(response.Request.URL.Path, "/login.cgi") ||
+		(contentType != "" && !strings.HasPrefix(contentType, "image/")) {
+		defer response.Body.Close()
+		c.countUpstreamError(causeAuthFailure)
+		return nil, withResponse(ErrSessionExpired, response, nil)
+	}
+
+	return response, nil
+}
+
+// errorStatus maps an error encountered while retrieving an image to the HTTP
+// status code returned to the client.
+// It returns 503 if the AirCam is unavailable, such as when the circuit breaker
+// is open, 504 if the AirCam timed out, and 502 for any other failure.
+func errorStatus(err error) int {
+	if errors.Is(err, errCircuitOpen) || errors.Is(err, ErrNotLoggedIn) ||
+		errors.Is(err, ErrLoginCooldown) || errors.Is(err, errFetchesBusy) {
+		return http.StatusServiceUnavailable
+	}
+
+	var netErr net.Error
+	if errors.Is(err, ErrUpstreamTimeout) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusBadGateway
+}
+
+// writeError responds to the client with the HTTP status of an error
+// encountered while retrieving an image, and a short diagnostic body naming the
+// failure mode, such as "upstream timeout after 10s".
+func writeError(w http.ResponseWriter, err error) {
+	status := errorStatus(err)
+
+	var message string
+	var upstreamStatus ErrUpstreamStatus
+	switch {
+	case errors.Is(err, ErrLoginCooldown):
+		message = fmt.Sprintf("upstream unavailable, login failed within %s",
+			conf.ReloginCooldown)
+	case errors.Is(err, ErrNotLoggedIn):
+		message = "upstream unavailable, not logged in"
+	case errors.Is(err, errFetchesBusy):
+		message = "upstream unavailable, too many concurrent fetches"
+	case status == http.StatusServiceUnavailable:
+		message = "upstream unavailable, circuit breaker open"
+	case status == http.StatusGatewayTimeout:
+		message = fmt.Sprintf("upstream timeout after %s", conf.Timeout)
+	case errors.Is(err, ErrInvalidCredentials):
+		message = "upstream error, credentials rejected"
+	case errors.Is(err, ErrLoginFailed):
+		message = "upstream error, login failed"
+	case errors.As(err, &upstreamStatus):
+		message = fmt.Sprintf("upstream error, HTTP %d", upstreamStatus.StatusCode)
+	default:
+		message = "upstream error"
+	}
+
+	http.Error(w, message, status)
+}
+
+// repairJPEG checks that a JPEG image ends with the EOI (end of image) marker,
+// which is missing when the AirCam truncates an image under heavy load. Based
+// on SNAPSHOT_JPEG_REPAIR, a truncated image is either rejected, salvaged by
+// appending the marker, or passed through as-is.
+// It returns the possibly repaired image, and whether it should be served.
+func repairJPEG(frame []byte) ([]byte, bool) {
+	if conf.JPEGRepair == jpegRepairOff || bytes.HasSuffix(frame, jpegEOI) {
+		return frame, true
+	}
+
+	if conf.JPEGRepair == jpegRepairSalvage {
+		logger("image").Warn("Salvaging truncated JPEG by appending EOI marker")
+		return append(frame, jpegEOI...), true
+	}
+
+	return frame, false
+}
+
+// discoverSnapshotPath probes each of the common snapshot paths on the AirCam
+// using a session cookie.
+// It returns the first path which responds with a JPEG image, or an error if
+// none of them do.
+func (c *camera) discoverSnapshotPath(sessionCookie *http.Cookie) (string,
+	error) {
+	for _, path := range snapshotPaths {
+		probeURL := c.endpoint(path, "")
+		c.logger("discover").Info("Probing snapshot path", "url", probeURL)
+
+		request, err := http.NewRequest(http.MethodGet, probeURL, nil)
+		if err != nil {
+			return "", err
+		}
+
+		response, err := c.auth.do(c.httpClient(), request, sessionCookie)
+		if err != nil {
+			c.logger("discover").Warn("Error probing snapshot path", "path", path,
+				"error", err)
+			continue
+		}
+
+		// Only the start of the body is needed to identify a JPEG
+		header := make([]byte, 2)
+		_, err = io.ReadFull(response.Body, header)
+		response.Body.Close()
+
+		if err == nil && response.StatusCode == http.StatusOK &&
+			bytes.Equal(header, jpegSOI) {
+			c.logger("discover").Info("Discovered snapshot path", "path", path)
+			return path, nil
+		}
+	}
+
+	return "", errors.New("no known snapshot path returned a JPEG image")
+}
+
+// frameTime determines the time a frame was captured using the configured
+// SNAPSHOT_FRAME_TIME_HEADER of the AirCam response, which is either an HTTP
+// date or a Unix timestamp in seconds.
+// It returns the capture time, or the provided fetch time if the header is not
+// configured, absent, or invalid.
+func frameTime(header http.Header, fetchTime time.Time) time.Time {
+	if conf.FrameTimeHeader == "" {
+		return fetchTime
+	}
+
+	value := header.Get(conf.FrameTimeHeader)
+	if value == "" {
+		return fetchTime
+	}
+
+	if captured, err := http.ParseTime(value); err == nil {
+		return captured
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0)
+	}
+
+	logger("image").Warn("Invalid frame time header", "header",
+		conf.FrameTimeHeader, "value", value)
+
+	return fetchTime
+}
+
+// parsePrivacyMask parses a privacy mask definition, which is a semicolon
+// separated list of rectangles in the form x,y,w,h.
+// It returns the rectangles, and any errors encountered during parsing.
+func parsePrivacyMask(mask string) ([]image.Rectangle, error) {
+	var rects []image.Rectangle
+
+	for _, rect := range strings.Split(mask, ";") {
+		if strings.TrimSpace(rect) == "" {
+			continue
+		}
+
+		// Parse the four comma separated dimensions of the rectangle
+		fields := strings.Split(rect, ",")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("rectangle %q is not in the form x,y,w,h", rect)
+		}
+
+		var dims [4]int
+		for i, field := range fields {
+			dim, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || dim < 0 {
+				return nil, fmt.Errorf("rectangle %q has invalid dimension %q", rect,
+					field)
+			}
+
+			dims[i] = dim
+		}
+
+		rects = append(rects, image.Rect(dims[0], dims[1], dims[0]+dims[2],
+			dims[1]+dims[3]))
+	}
+
+	return rects, nil
+}
+
+// maskRects fills the provided rectangles of an image with black, offset by
+// the image origin.
+func maskRects(img *image.RGBA, rects []image.Rectangle) {
+	black := image.NewUniform(color.Black)
+	for _, rect := range rects {
+		rect = rect.Add(img.Bounds().Min).Intersect(img.Bounds())
+		draw.Draw(img, rect, black, image.Point{}, draw.Src)
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFetchReturnsTypedErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		status     int
+		want       error
+		wantStatus int
+		response   int
+	}{
+		{
+			name: "timeout",
+			env: map[string]string{
+				"SNAPSHOT_CAMERA_PATH":   "/stall.cgi",
+				"SNAPSHOT_TIMEOUT":       "100ms",
+				"SNAPSHOT_FETCH_RETRIES": "0",
+			},
+			want:     ErrUpstreamTimeout,
+			response: http.StatusGatewayTimeout,
+		},
+		{
+			name:       "status",
+			env:        map[string]string{"SNAPSHOT_FETCH_RETRIES": "0"},
+			status:     http.StatusServiceUnavailable,
+			wantStatus: http.StatusServiceUnavailable,
+			response:   http.StatusBadGateway,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aircam := newFakeAirCam(t, "ubnt", "secret")
+			c := newTestCamera(t, aircam, tt.env)
+
+			sessionCookie, err := c.login(context.Background())
+			if err != nil {
+				t.Fatalf("login() error = %v", err)
+			}
+			c.session.Set(sessionCookie)
+			aircam.snapshotStatus = tt.status
+
+			_, _, err = c.fetchImage(context.Background(), nil)
+
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("fetchImage() error = %v, want %v", err, tt.want)
+			}
+
+			var upstreamStatus ErrUpstreamStatus
+			switch {
+			case tt.wantStatus == 0 && errors.As(err, &upstreamStatus):
+				t.Errorf("fetchImage() error = %v, want no status", err)
+			case tt.wantStatus != 0 && (!errors.As(err, &upstreamStatus) ||
+				upstreamStatus.StatusCode != tt.wantStatus):
+				t.Errorf("fetchImage() error = %v, want status %d", err,
+					tt.wantStatus)
+			}
+
+			recorder := httptest.NewRecorder()
+			writeError(recorder, err)
+			if recorder.Code != tt.response {
+				t.Errorf("writeError() status = %d, want %d", recorder.Code,
+					tt.response)
+			}
+		})
+	}
+}
+
+func TestUpstreamErrorResponses(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		status int
+		closed bool
+		want   int
+		body   string
+	}{
+		{
+			name: "timeout",
+			env: map[string]string{
+				"SNAPSHOT_CAMERA_PATH": "/stall.cgi",
+				"SNAPSHOT_TIMEOUT":     "100ms",
+			},
+			want: http.StatusGatewayTimeout,
+			body: "upstream timeout after 100ms",
+		},
+		{
+			name:   "connection refused",
+			closed: true,
+			want:   http.StatusBadGateway,
+			body:   "upstream error",
+		},
+		{
+			name:   "status",
+			status: http.StatusServiceUnavailable,
+			want:   http.StatusBadGateway,
+			body:   "upstream error, HTTP 503",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aircam := newFakeAirCam(t, "ubnt", "secret")
+			c := newTestCamera(t, aircam, tt.env)
+
+			sessionCookie, err := c.login(context.Background())
+			if err != nil {
+				t.Fatalf("login() error = %v", err)
+			}
+			aircam.snapshotStatus = tt.status
+			if tt.closed {
+				aircam.Close()
+			}
+
+			_, _, err = c.requestImage(context.Background(), sessionCookie, nil)
+			if err == nil {
+				t.Fatal("requestImage() error = nil, want an error")
+			}
+
+			recorder := httptest.NewRecorder()
+			writeError(recorder, err)
+			if recorder.Code != tt.want {
+				t.Errorf("writeError() status = %d, want %d", recorder.Code,
+					tt.want)
+			}
+
+			if body := strings.TrimSpace(recorder.Body.String()); body != tt.body {
+				t.Errorf("writeError() body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestRejectsHTMLResponse(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	aircam.setImage([]byte("<html><body>Camera is rebooting</body></html>"))
+	c := newTestCamera(t, aircam, map[string]string{
+		"SNAPSHOT_FETCH_RETRIES": "0",
+	})
+	server := newTestServer(t, c)
+
+	notJPEG := upstreamErrors.WithLabelValues(c.label(), causeNotJPEG)
+	before := testutil.ToFloat64(notJPEG)
+
+	response, err := http.Get(server.URL + "/snapshot.cgi")
+	if err != nil {
+		t.Fatalf("GET /snapshot.cgi error = %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusBadGateway {
+		t.Errorf("GET /snapshot.cgi status = %d, want %d", response.StatusCode,
+			http.StatusBadGateway)
+	}
+
+	if contentType := response.Header.Get("Content-Type"); strings.HasPrefix(
+		contentType, "image/") {
+		t.Errorf("GET /snapshot.cgi Content-Type = %s, want no image",
+			contentType)
+	}
+
+	body, _ := io.ReadAll(response.Body)
+	if bytes.Contains(body, []byte("<html>")) {
+		t.Errorf("GET /snapshot.cgi body = %q, want no upstream HTML", body)
+	}
+
+	if got := testutil.ToFloat64(notJPEG) - before; got != 1 {
+		t.Errorf("not JPEG errors = %v, want 1", got)
+	}
+}
+
+func TestLoginReturnsUpstreamStatus(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	aircam.loginStatus = http.StatusInternalServerError
+	c := newTestCamera(t, aircam, nil)
+
+	_, err := c.login(context.Background())
+	if !errors.Is(err, ErrLoginFailed) {
+		t.Errorf("login() error = %v, want %v", err, ErrLoginFailed)
+	}
+
+	var upstreamStatus ErrUpstreamStatus
+	if !errors.As(err, &upstreamStatus) ||
+		upstreamStatus.StatusCode != http.StatusInternalServerError {
+		t.Errorf("login() error = %v, want status %d", err,
+			http.StatusInternalServerError)
+	}
+
+	if errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("login() error = %v, want not %v", err, ErrInvalidCredentials)
+	}
+}
+
+func BenchmarkGetImage(b *testing.B) {
+	aircam := newFakeAirCam(b, "ubnt", "secret")
+	aircam.setImage(append(append(bytes.Clone(jpegSOI),
+		bytes.Repeat([]byte{0x00}, 256<<10)...), jpegEOI...))
+
+	c := newTestCamera(b, aircam, map[string]string{
+		"SNAPSHOT_CACHE_TTL":              "0",
+		"SNAPSHOT_MAX_CONCURRENT_FETCHES": "0",
+	})
+
+	sessionCookie, err := c.login(context.Background())
+	if err != nil {
+		b.Fatalf("login() error = %v", err)
+	}
+	c.session.Set(sessionCookie)
+
+	b.ReportAllocs()
+	b.SetParallelism(4)
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := c.getImage(context.Background(), io.Discard,
+				nil); err != nil {
+				b.Errorf("getImage() error = %v", err)
+				return
+			}
+		}
+	})
+}
+
+func TestCancelAbortsUpstreamRequest(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, map[string]string{
+		"SNAPSHOT_CAMERA_PATH": "/stall.cgi",
+		"SNAPSHOT_TIMEOUT":     "10s",
+	})
+
+	sessionCookie, err := c.login(context.Background())
+	if err != nil {
+		t.Fatalf("login() error = %v", err)
+	}
+	c.session.Set(sessionCookie)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := c.fetchImage(ctx, nil)
+		errs <- err
+	}()
+
+	select {
+	case <-aircam.stalled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was never made")
+	}
+
+	cancel()
+
+	select {
+	case <-aircam.abandoned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not aborted after cancelling")
+	}
+
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("fetchImage() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRepairTruncatedJPEG(t *testing.T) {
+	truncated := testJPEG[:len(testJPEG)-len(jpegEOI)]
+
+	tests := []struct {
+		mode          string
+		image         []byte
+		want          []byte
+		wantErr       bool
+		wantSnapshots int
+	}{
+		{mode: jpegRepairReject, image: testJPEG, want: testJPEG,
+			wantSnapshots: 1},
+		{mode: jpegRepairReject, image: truncated, wantErr: true,
+			wantSnapshots: 2},
+		{mode: jpegRepairReject, image: jpegSOI, wantErr: true,
+			wantSnapshots: 2},
+		{mode: jpegRepairSalvage, image: truncated, want: testJPEG,
+			wantSnapshots: 1},
+		{mode: jpegRepairOff, image: truncated, want: truncated,
+			wantSnapshots: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %d bytes", tt.mode, len(tt.image)),
+			func(t *testing.T) {
+				aircam := newFakeAirCam(t, "ubnt", "secret")
+				aircam.setImage(tt.image)
+				c := newTestCamera(t, aircam, map[string]string{
+					"SNAPSHOT_JPEG_REPAIR": tt.mode,
+				})
+
+				sessionCookie, err := c.login(context.Background())
+				if err != nil {
+					t.Fatalf("login() error = %v", err)
+				}
+				c.session.Set(sessionCookie)
+
+				f, err := c.loadFrame(context.Background(), nil)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("loadFrame() error = %v, wantErr %v", err,
+						tt.wantErr)
+				}
+
+				if !tt.wantErr && !bytes.Equal(f.image, tt.want) {
+					t.Errorf("loadFrame() = %x, want %x", f.image, tt.want)
+				}
+
+				if _, snapshots := aircam.counts(); snapshots != tt.wantSnapshots {
+					t.Errorf("snapshots = %d, want %d", snapshots,
+						tt.wantSnapshots)
+				}
+			})
+	}
+}
+
+func TestCameraPath(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, map[string]string{
+		"SNAPSHOT_CAMERA_PATH": "/cgi-bin/snapshot.cgi",
+		"SNAPSHOT_SERVE_PATH":  "/camera.jpg",
+	})
+	server := newTestServer(t, c)
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{path: "/camera.jpg", status: http.StatusOK},
+		{path: "/cgi-bin/snapshot.cgi", status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			response, err := http.Get(server.URL + tt.path)
+			if err != nil {
+				t.Fatalf("GET %s error = %v", tt.path, err)
+			}
+			defer response.Body.Close()
+
+			if response.StatusCode != tt.status {
+				t.Errorf("GET %s status = %d, want %d", tt.path,
+					response.StatusCode, tt.status)
+			}
+		})
+	}
+
+	if _, snapshots := aircam.counts(); snapshots != 1 {
+		t.Errorf("snapshots = %d, want 1", snapshots)
+	}
+
+	aircam.mutex.Lock()
+	defer aircam.mutex.Unlock()
+
+	if aircam.snapshotPath != "/cgi-bin/snapshot.cgi" {
+		t.Errorf("upstream path = %s, want /cgi-bin/snapshot.cgi",
+			aircam.snapshotPath)
+	}
+}
+
+func TestFetchRetriesTransientFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		retries    string
+		wantStatus int
+	}{
+		{name: "retried", retries: "2", wantStatus: http.StatusOK},
+		{name: "retries disabled", retries: "0",
+			wantStatus: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aircam := newFakeAirCam(t, "ubnt", "secret")
+			aircam.snapshotFailures = 1
+			c := newTestCamera(t, aircam, map[string]string{
+				"SNAPSHOT_FETCH_RETRIES": tt.retries,
+			})
+			server := newTestServer(t, c)
+
+			response, err := http.Get(server.URL + "/snapshot.cgi")
+			if err != nil {
+				t.Fatalf("GET /snapshot.cgi error = %v", err)
+			}
+			defer response.Body.Close()
+
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Fatalf("reading body error = %v", err)
+			}
+
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("GET /snapshot.cgi status = %d, want %d",
+					response.StatusCode, tt.wantStatus)
+			}
+
+			// The failed request is retried once, and the frame of the retry
+			// is served
+			wantSnapshots := 0
+			if tt.wantStatus == http.StatusOK {
+				wantSnapshots = 1
+
+				if !bytes.Equal(body, testJPEG) {
+					t.Errorf("GET /snapshot.cgi body = %x, want %x", body,
+						testJPEG)
+				}
+			}
+
+			if _, snapshots := aircam.counts(); snapshots != wantSnapshots {
+				t.Errorf("snapshots = %d, want %d", snapshots, wantSnapshots)
+			}
+		})
+	}
+}
+
+func TestFailoverToSecondURL(t *testing.T) {
+	// A closed server, whose URL refuses connections
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, map[string]string{
+		"SNAPSHOT_URL":           dead.URL + "," + aircam.URL,
+		"SNAPSHOT_FETCH_RETRIES": "0",
+	})
+
+	// The first fetch fails to log in to the unreachable URL, and fails over
+	// to the second, which later fetches keep using
+	for i := range 2 {
+		image, _, err := c.fetchImage(context.Background(), nil)
+		if err != nil {
+			t.Fatalf("fetchImage() %d error = %v", i, err)
+		}
+
+		if !bytes.Equal(image, testJPEG) {
+			t.Errorf("fetchImage() %d = %x, want %x", i, image, testJPEG)
+		}
+
+		if got := c.activeURL().String(); got != aircam.URL {
+			t.Errorf("activeURL() after fetch %d = %s, want %s", i, got,
+				aircam.URL)
+		}
+	}
+
+	if logins, snapshots := aircam.counts(); logins != 1 || snapshots != 2 {
+		t.Errorf("logins, snapshots = %d, %d, want 1, 2", logins, snapshots)
+	}
+}
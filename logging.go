@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Log output formats, see SNAPSHOT_LOG_FORMAT.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// newLogger creates the application logger, writing records to the provided
+// writer, such as stderr, in the provided format at or above the provided
+// level.
+// It returns the logger, and an error if the format is unknown.
+func newLogger(out io.Writer, format string, level slog.Level) (*slog.Logger,
+	error) {
+	options := &slog.HandlerOptions{Level: level}
+
+	switch format {
+	case logFormatText:
+		return slog.New(contextHandler{slog.NewTextHandler(out, options)}), nil
+	case logFormatJSON:
+		return slog.New(contextHandler{slog.NewJSONHandler(out, options)}), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// Type logFile is a log file opened for appending, which can be reopened at
+// the same path, such as after logrotate has moved it aside.
+type logFile struct {
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+}
+
+// openLogFile opens a log file for appending, creating it if it does not exist.
+// It returns the log file, and any errors encountered opening it.
+func openLogFile(path string) (*logFile, error) {
+	l := &logFile{path: path}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Write appends to the currently open file.
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.file.Write(p)
+}
+
+// Reopen opens the log file at its path again, closing the previous file once
+// the new one is open. If the file can not be opened, the previous file is
+// kept.
+// It returns any errors encountered opening the file.
+func (l *logFile) Reopen() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file != nil {
+		l.file.Close()
+	}
+
+	l.file = file
+
+	return nil
+}
+
+// Type requestIDKey is the context key of the ID of the request being handled.
+type requestIDKey struct{}
+
+// Type contextHandler is a log handler which attaches the ID of the request
+// being handled, if any, from the context of each record.
+type contextHandler struct {
+	slog.Handler
+}
+
+// Handle attaches the request ID to a record and passes it to the underlying
+// handler.
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestID, ok := ctx.Value(requestIDKey{}).(string); ok {
+		record.AddAttrs(slog.String("request_id", requestID))
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+// WithAttrs creates a handler with additional attributes, which still attaches
+// the request ID.
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup creates a handler with a group, which still attaches the request
+// ID.
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// withRequestID wraps a handler, generating a short random ID for each request
+// which is attached to every record logged with the request context, and
+// echoed back in the X-Request-ID header.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := make([]byte, 4)
+		rand.Read(id)
+		requestID := hex.EncodeToString(id)
+
+		w.Header().Set("X-Request-ID", requestID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(),
+			requestIDKey{}, requestID)))
+	})
+}
+
+// logger creates a logger for a component of the application, such as login or
+// image, which is attached to every record.
+func logger(component string) *slog.Logger {
+	return slog.With("component", component)
+}
+
+// logger creates a logger for a component of the camera, which attaches the
+// component and camera name to every record.
+func (c *camera) logger(component string) *slog.Logger {
+	return logger(component).With("camera", c.label())
+}
+
+// fatal logs an error and exits the process, in the manner of log.Fatal.
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Bounds of the exponential backoff between startup login retries.
+const (
+	loginBackoffInitial = time.Second
+	loginBackoffMax     = 30 * time.Second
+)
+
+// defaultLoginConcurrency caps the number of cameras logged in to concurrently
+// at startup when SNAPSHOT_LOGIN_CONCURRENCY is not set.
+const defaultLoginConcurrency = 8
+
+// loginCameras logs in to every camera at startup, concurrently up to
+// SNAPSHOT_LOGIN_CONCURRENCY cameras at a time, so that a slow or failing
+// camera does not hold up the others. A session saved to SNAPSHOT_SESSION_FILE
+// is resumed instead if the AirCam still accepts it. The session of each
+// camera which logged in is set, and any camera which failed is left without
+// one.
+// It returns the login error of each camera, in the order of the cameras.
+func loginCameras(cameras []*camera) []error {
+	concurrency := conf.LoginConcurrency
+	if concurrency == 0 {
+		concurrency = min(len(cameras), defaultLoginConcurrency)
+	}
+
+	// Load the saved sessions, logging in to every camera if they can not be
+	// read
+	saved := map[string]savedSession{}
+	if conf.SessionFile != "" {
+		var err error
+		if saved, err = loadSessions(conf.SessionFile); err != nil {
+			logger("login").Warn("Error loading saved sessions, logging in",
+				"path", conf.SessionFile, "error", err)
+			saved = map[string]savedSession{}
+		}
+	}
+
+	errs := make([]error, len(cameras))
+	workers := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for i, c := range cameras {
+		wg.Add(1)
+		workers <- struct{}{}
+
+		go func() {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+
+			if resumed, ok := saved[c.label()]; ok && c.resumeSession(resumed) {
+				return
+			}
+
+			sessionCookie, err := c.loginWithRetry()
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			c.session.Set(sessionCookie)
+		}()
+	}
+
+	wg.Wait()
+
+	return errs
+}
+
+// loginWithRetry performs the login process for the camera, retrying failed
+// logins up to SNAPSHOT_LOGIN_RETRIES times with exponential backoff, which
+// allows the camera to finish booting if both were started together.
+// It returns a session cookie, and the error of the last attempt if every
+// attempt failed.
+func (c *camera) loginWithRetry() (*http.Cookie, error) {
+	backoff := loginBackoffInitial
+
+	for attempt := 0; ; attempt++ {
+		sessionCookie, err := c.login(context.Background())
+		if err == nil {
+			return sessionCookie, nil
+		}
+
+		// Rejected credentials will not succeed on retry
+		if errors.Is(err, ErrInvalidCredentials) {
+			return nil, err
+		}
+
+		if conf.LoginRetries != 0 && attempt >= conf.LoginRetries {
+			return nil, err
+		}
+
+		c.logger("login").Warn("Login failed, retrying", "attempt", attempt+1,
+			"backoff", backoff, "error", err)
+		time.Sleep(backoff)
+
+		backoff = min(backoff*2, loginBackoffMax)
+	}
+}
+
+// login performs the login process for the camera with its authenticator. The
+// context only carries request-scoped attributes for logging, as the session is
+// shared by every request and is not abandoned if the request triggering the
+// login goes away.
+// It returns a session cookie, and any errors encountered during login.
+func (c *camera) login(ctx context.Context) (*http.Cookie, error) {
+	return c.auth.login(ctx)
+}
+
+// formLogin performs the form login process for the camera.
+// It returns a session cookie, and any errors encountered during login.
+func (c *camera) formLogin(ctx context.Context) (*http.Cookie, error) {
+	// Use the same credentials and client throughout, even if they are
+	// replaced by a reload during the login
+	username, password := c.credentials()
+	client := c.httpClient()
+
+	// Mask the password unless credential logging is explicitly enabled
+	loggedPassword := "***"
+	if conf.LogCredentials {
+		loggedPassword = password
+	}
+
+	c.logger("login").InfoContext(ctx, "Logging in", "username", username,
+		"password", loggedPassword)
+
+	// Make an initial request to the root of the webserver.
+	// This is the only URL which provides a session cookie.
+	initialURL := c.loginEndpoint("/")
+	c.logger("login").DebugContext(ctx,
+		"Making initial request to retrieve session cookie", "url", initialURL)
+	initialRequest, err := http.NewRequest("GET", initialURL, nil)
+	if err != nil {
+		c.logger("login").ErrorContext(ctx, "Error creating initial request",
+			"error", err)
+		return nil, fmt.Errorf("%w: %w", ErrLoginFailed, err)
+	}
+
+	initialResponse, err := client.Do(initialRequest)
+	if err != nil {
+		c.logger("login").ErrorContext(ctx, "Error making initial request",
+			"error", err)
+		return nil, fmt.Errorf("%w: %w", ErrLoginFailed, upstreamTimeout(err))
+	}
+	defer initialResponse.Body.Close()
+
+	// Locate the session cookie in the response, erroring if not found.
+	c.logger("login").DebugContext(ctx, "Finding session cookie")
+	var sessionCookie *http.Cookie
+	sessionFound := false
+	for _, cookie := range initialResponse.Cookies() {
+		if cookie.Name == conf.CookieName || (conf.CookiePrefix &&
+			strings.HasPrefix(cookie.Name, conf.CookieName)) {
+			c.logger("login").InfoContext(ctx, "Found session cookie", "name",
+				cookie.Name)
+			sessionCookie = cookie
+			sessionFound = true
+		}
+	}
+
+	if !sessionFound {
+		c.logger("login").ErrorContext(ctx, "Could not find session cookie")
+		return nil, ErrSessionCookieNotFound
+	}
+
+	// Create a multipart form body
+	c.logger("login").DebugContext(ctx, "Constructing multipart form data")
+
+	// Byte buffer to hold the body
+	bodyBuffer := &bytes.Buffer{}
+
+	// Multipart writer
+	bodyWriter := multipart.NewWriter(bodyBuffer)
+
+	// Construct map containing the form fields and their values, including any
+	// extra fields required by the firmware
+	formValues := map[string]string{
+		conf.FieldURI:      "/snapshot.cgi",
+		"Submit":           "Login",
+		conf.FieldUsername: username,
+		conf.FieldPassword: password,
+	}
+
+	for field, value := range conf.LoginExtraFields {
+		formValues[field] = value
+	}
+
+	// Add the login token scraped from the initial page if configured, for
+	// firmware which requires it alongside the credentials
+	if conf.LoginTokenField != "" {
+		token, found := findInputValue(initialResponse.Body,
+			conf.LoginTokenField)
+		if found {
+			c.logger("login").DebugContext(ctx, "Found login token", "field",
+				conf.LoginTokenField)
+			formValues[conf.LoginTokenField] = token
+		} else {
+			c.logger("login").DebugContext(ctx, "Login token not found",
+				"field", conf.LoginTokenField)
+		}
+	}
+
+	// Write each field and value to the multipart writer
+	for field, value := range formValues {
+		err = bodyWriter.WriteField(field, value)
+
+		if err != nil {
+			c.logger("login").ErrorContext(ctx, "Error encoding form field",
+				"field", field, "error", err)
+			return nil, fmt.Errorf("%w: %w", ErrLoginFailed, err)
+		}
+	}
+
+	bodyWriter.Close()
+
+	// Make the request to the login endpoint on the AirCam.
+	loginURL := c.loginEndpoint("/login.cgi")
+	c.logger("login").DebugContext(ctx, "Creating login request", "url",
+		loginURL)
+
+	// Create a new POST request to the login endpoint with the multipart buffer
+	request, err := http.NewRequest("POST", loginURL, bodyBuffer)
+	if err != nil {
+		c.logger("login").ErrorContext(ctx, "Error creating login request",
+			"error", err)
+		return nil, fmt.Errorf("%w: %w", ErrLoginFailed, err)
+	}
+
+	// Add the session cookie retrieved earlier
+	request.AddCookie(sessionCookie)
+
+	// Dynamically set the Content-Type header to indicate the form boundary
+	request.Header.Set("Content-Type", bodyWriter.FormDataContentType())
+
+	// Make the login request, without following the redirect which the AirCam
+	// responds with unless configured to, so that its target can be inspected
+	c.logger("login").DebugContext(ctx, "Making login request")
+	if !conf.LoginFollowRedirects {
+		client = withoutRedirects(client)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		c.logger("login").ErrorContext(ctx, "Error making login request",
+			"error", err)
+		return nil, fmt.Errorf("%w: %w", ErrLoginFailed, upstreamTimeout(err))
+	}
+	defer response.Body.Close()
+
+	// Check if the AirCam redirected back to the login page, either in the
+	// unfollowed redirect or the final URL of a followed one, which means the
+	// credentials were rejected
+	var target *url.URL
+	if location, err := response.Location(); err == nil {
+		target = location
+	} else if response.Request.Response != nil {
+		target = response.Request.URL
+	}
+
+	if target != nil && strings.HasSuffix(target.Path, "/login.cgi") {
+		c.logger("login").ErrorContext(ctx, "Credentials rejected", "redirect",
+			target)
+		return nil, ErrInvalidCredentials
+	}
+
+	// Check if the server responded with anything other than 200 or, when not
+	// following it, a redirect
+	redirected := response.StatusCode >= 300 && response.StatusCode < 400
+	if response.StatusCode != http.StatusOK &&
+		(conf.LoginFollowRedirects || !redirected) {
+		c.logger("login").ErrorContext(ctx, "Error making login request",
+			"status", response.StatusCode)
+		return nil, fmt.Errorf("%w: %w", ErrLoginFailed,
+			ErrUpstreamStatus{StatusCode: response.StatusCode})
+	}
+
+	// Check if the AirCam rendered the login form again rather than redirecting
+	// to the snapshot, which means the credentials were rejected, detected by
+	// its password field
+	if strings.HasPrefix(response.Header.Get("Content-Type"), "text/html") {
+		if _, found := findInputValue(response.Body, conf.FieldPassword); found {
+			c.logger("login").ErrorContext(ctx, "Credentials rejected")
+			return nil, ErrInvalidCredentials
+		}
+	}
+
+	// Return the session cookie and no error
+	return sessionCookie, nil
+}
+
+// findInputValue parses an HTML page for an input element with the given name,
+// such as a hidden token field of a form.
+// It returns the value of the first matching input, and whether it was found.
+func findInputValue(page io.Reader, name string) (string, bool) {
+	tokenizer := html.NewTokenizer(page)
+
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return "", false
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if token.DataAtom != atom.Input {
+				continue
+			}
+
+			var inputName, value string
+			for _, attr := range token.Attr {
+				switch attr.Key {
+				case "name":
+					inputName = attr.Val
+				case "value":
+					value = attr.Val
+				}
+			}
+
+			if inputName == name {
+				return value, true
+			}
+		}
+	}
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoginAndFetch(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, nil)
+
+	sessionCookie, err := c.login(context.Background())
+	if err != nil {
+		t.Fatalf("login() error = %v", err)
+	}
+	c.session.Set(sessionCookie)
+
+	image, _, err := c.fetchImage(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("fetchImage() error = %v", err)
+	}
+
+	if !bytes.Equal(image, testJPEG) {
+		t.Errorf("fetchImage() = %x, want %x", image, testJPEG)
+	}
+
+	if logins, snapshots := aircam.counts(); logins != 1 || snapshots != 1 {
+		t.Errorf("logins, snapshots = %d, %d, want 1, 1", logins, snapshots)
+	}
+}
+
+func TestFetchLogsInAgainAfterSessionExpires(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, nil)
+
+	sessionCookie, err := c.login(context.Background())
+	if err != nil {
+		t.Fatalf("login() error = %v", err)
+	}
+	c.session.Set(sessionCookie)
+
+	aircam.expireSessions()
+
+	if _, _, err := c.fetchImage(context.Background(), nil); err != nil {
+		t.Fatalf("fetchImage() error = %v", err)
+	}
+
+	if logins, _ := aircam.counts(); logins != 2 {
+		t.Errorf("logins = %d, want 2", logins)
+	}
+
+	if c.session.Get() == sessionCookie {
+		t.Error("session cookie was not replaced after expiring")
+	}
+}
+
+func TestLoginRejectsInvalidCredentials(t *testing.T) {
+	tests := []struct {
+		name           string
+		rejectWithForm bool
+		env            map[string]string
+	}{
+		{name: "redirect"},
+		{name: "form", rejectWithForm: true},
+		{
+			name:           "form with custom password field",
+			rejectWithForm: true,
+			env:            map[string]string{"SNAPSHOT_FIELD_PASSWORD": "pass"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aircam := newFakeAirCam(t, "ubnt", "secret")
+			aircam.rejectWithForm = tt.rejectWithForm
+			if field := tt.env["SNAPSHOT_FIELD_PASSWORD"]; field != "" {
+				aircam.passwordField = field
+			}
+
+			c := newTestCamera(t, aircam, tt.env)
+			c.Password = "wrong"
+
+			_, err := c.login(context.Background())
+			if !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("login() error = %v, want %v", err,
+					ErrInvalidCredentials)
+			}
+		})
+	}
+}
+
+func TestLoginWithoutSessionCookie(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	aircam.omitCookie = true
+	c := newTestCamera(t, aircam, nil)
+
+	_, err := c.login(context.Background())
+	if !errors.Is(err, ErrSessionCookieNotFound) {
+		t.Errorf("login() error = %v, want %v", err, ErrSessionCookieNotFound)
+	}
+}
+
+func TestLoginSubmitsToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		tokenField string
+		configured string
+		wantErr    bool
+	}{
+		{name: "token found", tokenField: "csrf_token",
+			configured: "csrf_token"},
+		{name: "token not configured", tokenField: "csrf_token",
+			wantErr: true},
+		{name: "token not on page", configured: "csrf_token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aircam := newFakeAirCam(t, "ubnt", "secret")
+			aircam.tokenField = tt.tokenField
+			c := newTestCamera(t, aircam, map[string]string{
+				"SNAPSHOT_LOGIN_TOKEN_FIELD": tt.configured,
+			})
+
+			_, err := c.login(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("login() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			wantLogins := 1
+			if tt.wantErr {
+				wantLogins = 0
+			}
+
+			if logins, _ := aircam.counts(); logins != wantLogins {
+				t.Errorf("logins = %d, want %d", logins, wantLogins)
+			}
+		})
+	}
+}
+
+func TestSnapshotRejectsMissingSessionCookie(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, nil)
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+	}{
+		{name: "inactive", cookie: &http.Cookie{Name: "AIROS_SESSIONID",
+			Value: "unknown"}},
+		{name: "other name", cookie: &http.Cookie{Name: "other",
+			Value: "session1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := c.requestImage(context.Background(), tt.cookie, nil)
+			if !errors.Is(err, ErrSessionExpired) {
+				t.Errorf("requestImage() error = %v, want %v", err,
+					ErrSessionExpired)
+			}
+		})
+	}
+
+	if _, snapshots := aircam.counts(); snapshots != 0 {
+		t.Errorf("snapshots = %d, want 0", snapshots)
+	}
+}
+
+func TestDigestLoginRejectedWithoutChallenge(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{name: "no challenge"},
+		{name: "basic challenge", header: `Basic realm="AirCam"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					if tt.header != "" {
+						w.Header().Set("WWW-Authenticate", tt.header)
+					}
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				}))
+			t.Cleanup(upstream.Close)
+
+			aircam := newFakeAirCam(t, "ubnt", "secret")
+			c := newTestCamera(t, aircam, map[string]string{
+				"SNAPSHOT_URL":       upstream.URL,
+				"SNAPSHOT_AUTH_MODE": "digest",
+			})
+
+			_, err := c.login(context.Background())
+			if !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("login() error = %v, want %v", err,
+					ErrInvalidCredentials)
+			}
+		})
+	}
+}
+
+func TestLoginFailedPage(t *testing.T) {
+	tests := []struct {
+		name    string
+		page    string
+		wantErr error
+	}{
+		{
+			name: "login failed",
+			page: `<html><body><p class="error">Login failed</p>` +
+				`<form method="post" action="/login.cgi">` +
+				`<input name="username" value="ubnt">` +
+				`<input type="password" name="password"></form></body></html>`,
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name: "logged in",
+			page: `<html><body><img src="/snapshot.cgi"></body></html>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					if r.Method == http.MethodGet {
+						http.SetCookie(w, &http.Cookie{Name: "AIROS_SESSIONID",
+							Value: "session1"})
+					}
+
+					// Like the AirCam, the page is served with a 200 either way
+					w.Header().Set("Content-Type", "text/html; charset=utf-8")
+					w.Write([]byte(tt.page))
+				}))
+			t.Cleanup(upstream.Close)
+
+			aircam := newFakeAirCam(t, "ubnt", "secret")
+			c := newTestCamera(t, aircam, map[string]string{
+				"SNAPSHOT_URL": upstream.URL,
+			})
+
+			_, err := c.login(context.Background())
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("login() error = %v, want nil", err)
+			}
+
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("login() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInvalidRequestURL(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, nil)
+
+	// The camera URL is validated when loaded, so replace it with one which
+	// http.NewRequest fails to parse, as it has a control character
+	invalid := &url.URL{Scheme: "http", Host: "aircam\x7f.local"}
+	c.baseURL = invalid
+	c.loginBaseURL = invalid
+
+	if _, err := c.login(context.Background()); !errors.Is(err,
+		ErrLoginFailed) {
+		t.Errorf("login() error = %v, want %v", err, ErrLoginFailed)
+	}
+
+	cookie := &http.Cookie{Name: "AIROS_SESSIONID", Value: "session1"}
+	if _, _, err := c.requestImage(context.Background(), cookie,
+		nil); err == nil {
+		t.Error("requestImage() error = nil, want an error")
+	}
+
+	if logins, snapshots := aircam.counts(); logins != 0 || snapshots != 0 {
+		t.Errorf("logins, snapshots = %d, %d, want 0, 0", logins, snapshots)
+	}
+}
+
+func TestLoginRedirects(t *testing.T) {
+	tests := []struct {
+		name         string
+		password     string
+		follow       string
+		wantErr      error
+		wantRequests int
+	}{
+		{name: "rejected", password: "wrong", wantErr: ErrInvalidCredentials,
+			wantRequests: 2},
+		{name: "rejected following redirects", password: "wrong",
+			follow: "true", wantErr: ErrInvalidCredentials, wantRequests: 3},
+		{name: "accepted", password: "secret", wantRequests: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aircam := newFakeAirCam(t, "ubnt", "secret")
+			c := newTestCamera(t, aircam, map[string]string{
+				"SNAPSHOT_LOGIN_FOLLOW_REDIRECTS": tt.follow,
+			})
+			c.Password = tt.password
+
+			_, err := c.login(context.Background())
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("login() error = %v, want nil", err)
+			}
+
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("login() error = %v, want %v", err, tt.wantErr)
+			}
+
+			// The redirect after the login form is only followed if configured
+			aircam.mutex.Lock()
+			requests := len(aircam.headers)
+			aircam.mutex.Unlock()
+
+			if requests != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestLoginCamerasWithOneFailing(t *testing.T) {
+	front := newFakeAirCam(t, "ubnt", "secret")
+	back := newFakeAirCam(t, "ubnt", "secret")
+
+	cameras, err := newConfigCameras(t, fmt.Sprintf(`[
+		{"name": "front", "url": %q, "username": "ubnt", "password": "secret"},
+		{"name": "back", "url": %q, "username": "ubnt", "password": "wrong"}
+	]`, front.URL, back.URL), map[string]string{
+		"SNAPSHOT_LOGIN_RETRIES":    "0",
+		"SNAPSHOT_RELOGIN_COOLDOWN": "0",
+	})
+	if err != nil {
+		t.Fatalf("newCameras() error = %v", err)
+	}
+
+	errs := loginCameras(cameras)
+	if errs[0] != nil {
+		t.Errorf("loginCameras() front error = %v, want nil", errs[0])
+	}
+
+	if !errors.Is(errs[1], ErrInvalidCredentials) {
+		t.Errorf("loginCameras() back error = %v, want %v", errs[1],
+			ErrInvalidCredentials)
+	}
+
+	ready.Store(true)
+	t.Cleanup(func() { ready.Store(false) })
+
+	mux := http.NewServeMux()
+	for _, c := range cameras {
+		c.registerRoutes(mux)
+	}
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	get := func(path string, want int) {
+		t.Helper()
+
+		response, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s error = %v", path, err)
+		}
+		response.Body.Close()
+
+		if response.StatusCode != want {
+			t.Errorf("GET %s status = %d, want %d", path, response.StatusCode,
+				want)
+		}
+	}
+
+	// The camera which failed to log in is still served, but unavailable
+	// until it logs in
+	get("/front/snapshot.cgi", http.StatusOK)
+	get("/back/snapshot.cgi", http.StatusServiceUnavailable)
+
+	cameras[1].Password = "secret"
+	get("/back/snapshot.cgi", http.StatusOK)
+}
+
+func TestSeparateLoginURL(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	target, err := url.Parse(aircam.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The snapshot host reaches the same AirCam through a different address,
+	// like a NAT, recording the paths requested through it
+	var mutex sync.Mutex
+	var paths []string
+	forward := httputil.NewSingleHostReverseProxy(target)
+	snapshotHost := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			paths = append(paths, r.URL.Path)
+			mutex.Unlock()
+
+			forward.ServeHTTP(w, r)
+		}))
+	t.Cleanup(snapshotHost.Close)
+
+	c := newTestCamera(t, aircam, map[string]string{
+		"SNAPSHOT_URL":       snapshotHost.URL,
+		"SNAPSHOT_LOGIN_URL": aircam.URL,
+	})
+
+	sessionCookie, err := c.login(context.Background())
+	if err != nil {
+		t.Fatalf("login() error = %v", err)
+	}
+
+	// The session cookie from the login host is sent to the snapshot host
+	if _, _, err := c.requestImage(context.Background(), sessionCookie,
+		nil); err != nil {
+		t.Fatalf("requestImage() error = %v", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !slices.Equal(paths, []string{"/snapshot.cgi"}) {
+		t.Errorf("snapshot host paths = %v, want [/snapshot.cgi]", paths)
+	}
+
+	if logins, snapshots := aircam.counts(); logins != 1 || snapshots != 1 {
+		t.Errorf("logins, snapshots = %d, %d, want 1, 1", logins, snapshots)
+	}
+}
+
+func TestFetchReauthenticatesAfterReboot(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, map[string]string{
+		"SNAPSHOT_FETCH_RETRIES": "0",
+	})
+
+	sessionCookie, err := c.login(context.Background())
+	if err != nil {
+		t.Fatalf("login() error = %v", err)
+	}
+	c.session.Set(sessionCookie)
+
+	aircam.reboot()
+
+	start := time.Now()
+	image, _, err := c.fetchImage(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("fetchImage() error = %v", err)
+	}
+
+	if !bytes.Equal(image, testJPEG) {
+		t.Errorf("fetchImage() = %x, want %x", image, testJPEG)
+	}
+
+	// The AirCam is given time to finish booting before logging in again
+	if elapsed := time.Since(start); elapsed < rebootBackoff {
+		t.Errorf("fetchImage() took %s, want at least %s", elapsed,
+			rebootBackoff)
+	}
+
+	if logins, _ := aircam.counts(); logins != 2 {
+		t.Errorf("logins = %d, want 2", logins)
+	}
+
+	if c.rebooting.Load() {
+		t.Error("camera is still rebooting after a successful fetch")
+	}
+}
+
+func TestLoginFormFields(t *testing.T) {
+	var mutex sync.Mutex
+	var form map[string][]string
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet {
+				http.SetCookie(w, &http.Cookie{Name: "AIROS_SESSIONID",
+					Value: "session1"})
+				return
+			}
+
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				http.Error(w, "invalid form", http.StatusBadRequest)
+				return
+			}
+
+			mutex.Lock()
+			form = r.MultipartForm.Value
+			mutex.Unlock()
+
+			http.Redirect(w, r, "/snapshot.cgi", http.StatusFound)
+		}))
+	t.Cleanup(upstream.Close)
+
+	setTestConfig(t, map[string]string{
+		"SNAPSHOT_URL":                upstream.URL,
+		"SNAPSHOT_USERNAME":           "ubnt",
+		"SNAPSHOT_PASSWORD":           "secret",
+		"SNAPSHOT_FIELD_USERNAME":     "user",
+		"SNAPSHOT_FIELD_PASSWORD":     "pass",
+		"SNAPSHOT_FIELD_URI":          "next",
+		"SNAPSHOT_LOGIN_EXTRA_FIELDS": "lang=en_US,remember=1",
+	})
+
+	cameras, err := newCameras()
+	if err != nil {
+		t.Fatalf("newCameras() error = %v", err)
+	}
+
+	if _, err := cameras[0].login(context.Background()); err != nil {
+		t.Fatalf("login() error = %v", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	want := map[string][]string{
+		"user":     {"ubnt"},
+		"pass":     {"secret"},
+		"next":     {"/snapshot.cgi"},
+		"Submit":   {"Login"},
+		"lang":     {"en_US"},
+		"remember": {"1"},
+	}
+	if !maps.EqualFunc(form, want, slices.Equal) {
+		t.Errorf("login form = %v, want %v", form, want)
+	}
+}
@@ -4,289 +4,518 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
-	"mime/multipart"
+	"io/fs"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Package level configuration and cameras
+var (
+	conf    config
+	cameras []*camera
 )
 
-// Type config represents the configuration for the application, with the names
-// of the variables representing their corresponding environment variables.
-type config struct {
-	URL             string
-	Username        string
-	Password        string
-	IgnoreSSL       bool
-	Port            int
-	KeepalivePeriod int
+// ErrSessionExpired indicates that the AirCam rejected the session cookie and
+// responded with the login page rather than an image.
+var ErrSessionExpired = errors.New("Image - Session expired")
+
+// ErrLoginFailed indicates that logging in to the AirCam failed, which every
+// login error wraps, alongside the more specific errors below or the cause.
+var ErrLoginFailed = errors.New("Login - Login failed")
+
+// ErrSessionCookieNotFound indicates that the AirCam did not set the session
+// cookie on the initial request of the login.
+var ErrSessionCookieNotFound = fmt.Errorf(
+	"%w, could not find session cookie", ErrLoginFailed)
+
+// ErrInvalidCredentials indicates that the AirCam rejected the username and
+// password, and responded to the login with the login page again.
+var ErrInvalidCredentials = fmt.Errorf("%w, invalid credentials",
+	ErrLoginFailed)
+
+// ErrUpstreamTimeout indicates that a request to the AirCam timed out, either
+// connecting or waiting for the response.
+var ErrUpstreamTimeout = errors.New("Upstream - Request timed out")
+
+// ErrNotLoggedIn indicates that the camera has no session, as its login failed
+// at startup and every login since has also failed.
+var ErrNotLoggedIn = errors.New("Login - Camera is not logged in")
+
+// ErrLoginCooldown indicates that a login was skipped, as the previous login
+// failed within the re-login cooldown.
+var ErrLoginCooldown = errors.New("Login - Waiting to retry failed login")
+
+// rebootBackoff is how long the AirCam is given to finish booting after its
+// connection is lost, before logging in again.
+const rebootBackoff = 2 * time.Second
+
+// shutdownTimeout bounds how long in-flight requests are given to finish after
+// a shutdown signal is received.
+const shutdownTimeout = 15 * time.Second
+
+// snapshotPaths is the list of common AirOS/Ubiquiti snapshot endpoints probed,
+// in order, when autodiscovery is enabled.
+var snapshotPaths = []string{
+	"/snapshot.cgi",
+	"/image.cgi",
+	"/cgi-bin/snapshot.cgi",
+	"/snapshot.jpg",
+	"/image.jpg",
+	"/jpg/image.jpg",
 }
 
-// Package level configuration and http client
+// Handling modes for truncated JPEG images, see repairJPEG.
+const (
+	jpegRepairReject  = "reject"
+	jpegRepairSalvage = "salvage"
+	jpegRepairOff     = "off"
+)
+
+// JPEG SOI (start of image) and EOI (end of image) markers, which begin and end
+// every complete JPEG image.
 var (
-	conf   config
-	client http.Client
+	jpegSOI = []byte{0xFF, 0xD8}
+	jpegEOI = []byte{0xFF, 0xD9}
 )
 
-func init() {
-	// Parse the URL of the AirCam, exiting if undefined
-	if URL, err := os.LookupEnv("SNAPSHOT_URL"); err {
-		conf.URL = URL
-	} else {
-		log.Fatal("SNAPSHOT_URL not defined")
-	}
-
-	// Parse the username to login to the AirCam with, exiting if undefined
-	if username, err := os.LookupEnv("SNAPSHOT_USERNAME"); err {
-		conf.Username = username
-	} else {
-		log.Fatal("SNAPSHOT_USERNAME not defined")
-	}
-
-	// Parse the password to login to the AirCam with, exiting if undefined
-	if password, err := os.LookupEnv("SNAPSHOT_PASSWORD"); err {
-		conf.Password = password
-	} else {
-		log.Fatal("SNAPSHOT_PASSWORD not defined")
-	}
-
-	// Parse the ignore SSL variable, defaulting to no if undefined
-	if ignoreSSL, err := os.LookupEnv("SNAPSHOT_IGNORE_SSL"); err {
-		switch ignoreSSL {
-		case "true":
-			conf.IgnoreSSL = true
-		case "false":
-			conf.IgnoreSSL = false
-		default:
-			conf.IgnoreSSL = true
-		}
-	} else {
-		conf.IgnoreSSL = true
+func main() {
+	// Print the build information and exit if requested, otherwise run the
+	// server configured by environment variables
+	showVersion := flag.Bool("version", false,
+		"print the version, commit, and build date and exit")
+	oneshot := flag.Bool("oneshot", false,
+		"write a single snapshot from the camera to stdout and exit")
+	check := flag.Bool("check", false,
+		"validate and print the configuration, then exit")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(buildInfo())
+		return
 	}
 
-	// Parse the port variable, defaulting to 8000 if undefined
-	if port, err := os.LookupEnv("SNAPSHOT_PORT"); err {
-		var parseErr error
-		conf.Port, parseErr = strconv.Atoi(port)
+	// Load the configuration, exiting if it is invalid
+	var err error
+	conf, err = loadConfig(os.Getenv)
+	if err != nil {
+		fatal(logger("config"), "Invalid configuration", "error", err)
+	}
 
-		if parseErr != nil {
-			log.Fatal("Invalid value for SNAPSHOT_PORT")
+	// Open the log file if configured, which is reopened whenever logrotate
+	// sends SIGHUP, otherwise log to stderr
+	var appLogFile *logFile
+	var logOutput io.Writer = os.Stderr
+	if conf.LogFile != "" {
+		appLogFile, err = openLogFile(conf.LogFile)
+		if err != nil {
+			fatal(logger("config"), "Error opening log file", "path",
+				conf.LogFile, "error", err)
 		}
-	} else {
-		conf.Port = 8000
+
+		logOutput = appLogFile
+	}
+
+	// Create the logger used by every component
+	appLogger, err := newLogger(logOutput, conf.LogFormat, conf.LogLevel)
+	if err != nil {
+		fatal(logger("config"), "Invalid configuration", "error", err)
 	}
 
-	// Parse the keepalive period
-	if keepalivePeriod, err := os.LookupEnv("SNAPSHOT_KEEPALIVE_PERIOD"); err {
-		var parseErr error
-		conf.KeepalivePeriod, parseErr = strconv.Atoi(keepalivePeriod)
+	slog.SetDefault(appLogger)
 
-		if parseErr != nil {
-			log.Fatal("Invalid value for SNAPSHOT_KEEPALIVE_PERIOD")
-		}
-	} else {
-		conf.KeepalivePeriod = 10
+	for _, d := range conf.disabled {
+		logger("config").Warn("Optional feature disabled", "feature",
+			d.feature, "error", d.err)
 	}
 
-	// Set the ignore SSL setting in the HTTP client
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{
-		InsecureSkipVerify: conf.IgnoreSSL,
+	if conf.DebugDelay > 0 {
+		logger("config").Warn("DEBUG: Delaying every snapshot response",
+			"delay", conf.DebugDelay)
 	}
-}
 
-func main() {
-	// Login to the camera
-	sessionCookie, err := login()
+	// Load the cameras to proxy, exiting if they are invalid
+	cameras, err = newCameras()
 	if err != nil {
-		log.Fatalf("Login - Login failed: %s", err)
+		fatal(logger("config"), "Invalid configuration", "error", err)
 	}
 
-	// Boolean for if there has been recent access to snapshots.
-	recentActivity := false
+	for _, c := range cameras {
+		c.recordLimits()
+	}
 
-	// Keepalive routine, runs every period and makes an empty request to the
-	// snapshot route. This is because the session expires on the aircam if
-	// inactive for 15 minutes.
-	keepalive := time.NewTicker(time.Minute * time.Duration(conf.KeepalivePeriod))
-	go func() {
-		for range keepalive.C {
-			// Run an empty getImage if no recent activity, otherwise reset flag.
-			if !recentActivity {
-				log.Print("Alive - Running keepalive")
-				getImage(nil, sessionCookie, false)
-			} else {
-				recentActivity = false
-			}
-		}
-	}()
+	// Print the validated configuration and exit if requested, as any invalid
+	// configuration has already exited non-zero
+	if *check {
+		printConfig(os.Stdout, conf, cameras)
+		return
+	}
 
-	// Create handler function for retrieving images
-	handler := func(w http.ResponseWriter, r *http.Request) {
-		log.Print("Image - Getting image")
+	// Write a single snapshot from the first camera and exit if requested,
+	// exiting non-zero if it could not be retrieved
+	if *oneshot {
+		if err := cameras[0].oneshot(os.Stdout); err != nil {
+			fatal(cameras[0].logger("oneshot"), "Snapshot failed", "error", err)
+		}
 
-		// Set the header to indicate image content and retrieve image from AirCam
-		w.Header().Set("Content-Type", "image/jpeg")
-		getImage(w, sessionCookie, true)
+		return
+	}
 
-		recentActivity = true
+	for _, c := range cameras {
+		if c.IgnoreSSL {
+			c.logger("config").Warn(
+				"INSECURE: TLS certificate verification is disabled", "url", c.URL)
+		}
 	}
 
-	// Associate handler
-	http.HandleFunc("/snapshot.cgi", handler)
+	// Associate the handlers of every camera before logging in, so that the
+	// server is live while the cameras are still logging in, and responds with
+	// 503 to snapshot requests until the cameras are ready. The handlers are
+	// associated with a mux of their own, as net/http/pprof associates its
+	// unauthenticated handlers with the default one.
+	mux := http.NewServeMux()
+	for _, c := range cameras {
+		c.registerRoutes(mux)
+	}
 
-	// Start the HTTP server
-	log.Fatal(http.ListenAndServe(fmt.Sprintf("localhost:%d", conf.Port), nil))
-}
+	// Associate the Prometheus metrics and build information handlers
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/version", handleVersion)
 
-// getImage retrieves an image from a provided url using a session cookie.
-// It returns a byte slice with the image contents.
-func getImage(out io.Writer, sessionCookie *http.Cookie, write bool) {
-	// Byte slice that will eventually hold the image contents
-	var image []byte
+	// Associate the TLS reload handler, which applies to every camera, only if
+	// the proxy requires credentials, so that it is never left open
+	if conf.ProxyUser != "" {
+		mux.HandleFunc("/admin/reload-tls", requireAuth(handleReloadTLS))
+	}
 
-	// Create an HTTP request based on the provided URL endpoint, returning an
-	// error if the request cannot be created.
-	request, err := http.NewRequest(http.MethodGet,
-		fmt.Sprintf("%s/snapshot.cgi", conf.URL), nil)
-	if err != nil {
-		log.Printf("Image - Error creating request: %s", err)
+	// Associate the diagnostic handlers if enabled
+	if conf.Debug {
+		registerDebugRoutes(mux)
 	}
 
-	// Add the session cookie to the request
-	request.AddCookie(sessionCookie)
+	// Reopen the log file and reload the cameras whenever SIGHUP is received
+	go superviseLoop("hangup", func() { handleHangups(appLogFile) })
+	go superviseLoop("diagnostics", handleDiagnosticSignals)
 
-	// Make the HTTP request with the shared http Client, returning an error if
-	// the request fails or times out.
-	response, err := client.Do(request)
+	// Listen on the Unix socket or TCP address, then start the HTTP server in
+	// the background
+	listener, err := listen()
 	if err != nil {
-		log.Printf("Image - Error creating response: %s", err)
+		fatal(logger("server"), "Error listening", "error", err)
 	}
 
-	// Check if the status code is OK (200) and return an error if it is not.
-	if response.StatusCode != http.StatusOK {
-		log.Printf("Image - Non-200 status code received: %d", response.StatusCode)
+	handler := withCompression(mux)
+	server := &http.Server{
+		Handler:           withAccessLog(withRequestID(handler)),
+		ReadHeaderTimeout: conf.ReadHeaderTimeout,
+		WriteTimeout:      conf.WriteTimeout,
+		IdleTimeout:       conf.IdleTimeout,
 	}
+	go func() {
+		logger("server").Info("Serving", "addr", listener.Addr(), "tls",
+			conf.TLSCert != "")
+
+		// Serve HTTPS if a certificate is configured, otherwise plain HTTP
+		var err error
+		if conf.TLSCert != "" {
+			err = server.ServeTLS(listener, conf.TLSCert, conf.TLSKey)
+		} else {
+			err = server.Serve(listener)
+		}
 
-	// Parse the response body into a byte slice, returning an error if unable to
-	// parse.
-	image, err = ioutil.ReadAll(response.Body)
-	if err != nil {
-		log.Printf("Image - Error reading response body, %s", err)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal(logger("server"), "Error serving", "error", err)
+		}
+	}()
+
+	// Login to every camera, retrying in case they are still starting up. A
+	// camera which fails to login is still served, responding with 503 until
+	// a later login succeeds, unless every camera failed. The RTSP source does
+	// not login.
+	loginErrs := make([]error, len(cameras))
+	if conf.Source == sourceHTTP {
+		var loggedIn, failed []string
+		loginErrs = loginCameras(cameras)
+		for i, c := range cameras {
+			err := loginErrs[i]
+			if err == nil {
+				loggedIn = append(loggedIn, c.label())
+				continue
+			}
+
+			failed = append(failed, c.label())
+
+			var verifyErr *tls.CertificateVerificationError
+			if errors.As(err, &verifyErr) {
+				c.logger("login").Error(
+					"Login failed verifying the camera certificate, which is now "+
+						"verified by default, set SNAPSHOT_IGNORE_SSL=true to skip",
+					"error", err)
+			} else if errors.Is(err, ErrInvalidCredentials) {
+				c.logger("login").Error(
+					"Login rejected, check the username and password", "username",
+					c.Username)
+			} else {
+				c.logger("login").Error("Login failed", "error", err)
+			}
+		}
+
+		if len(loggedIn) == 0 {
+			fatal(logger("login"), "Login failed for every camera")
+		}
+
+		logger("login").Info("Logged in to cameras", "succeeded", loggedIn,
+			"failed", failed)
 	}
 
-	// Return the byte slice.
-	if write {
-		out.Write(image)
+	// Create the client of the object store to upload snapshots to if enabled
+	var uploadClient *minio.Client
+	if conf.S3Bucket != "" {
+		uploadClient, err = newUploadClient()
+		if err != nil {
+			fatal(logger("upload"), "Error creating S3 client", "error", err)
+		}
 	}
-}
 
-// login performs the login process for an AirCam.
-// It returns a session cookie, and any errors encountered during login.
-func login() (*http.Cookie, error) {
-	log.Printf("Login - Logging in with username \"%s\" and password \"%s\"",
-		conf.Username, conf.Password)
+	for i, c := range cameras {
+		// Discover the snapshot path of the AirCam for this session if enabled,
+		// leaving a camera which is not logged in on the configured path
+		if conf.Autodiscover && conf.Source == sourceHTTP &&
+			loginErrs[i] == nil {
+			c.path, err = c.discoverSnapshotPath(c.session.Get())
+			if err != nil {
+				fatal(c.logger("discover"), "Autodiscovery failed", "error", err)
+			}
+		}
 
-	// Make an initial request to the root of the webserver.
-	// This is the only URL which provides a session cookie.
-	initialURL := fmt.Sprintf("%s/", conf.URL)
-	log.Printf("Login - Making initial request to retrieve session cookie: %s",
-		initialURL)
-	initialRequest, err := http.NewRequest("GET", initialURL, nil)
-	initialResponse, err := client.Do(initialRequest)
+		// Verify that a snapshot can be retrieved before serving if enabled
+		if conf.StartupCheck && loginErrs[i] == nil {
+			if err := c.checkStartup(); err != nil {
+				fatal(c.logger("startup"), "Startup check failed", "error", err)
+			}
 
-	if err != nil {
-		log.Printf("Login - Error making initial request: %s", err)
-		return nil, err
-	}
+			c.logger("startup").Info("Startup check passed")
+		}
+
+		// Keepalive routine for the camera's session
+		keepalive := time.NewTicker(time.Minute *
+			time.Duration(conf.KeepalivePeriod))
+		go superviseLoop(strings.TrimPrefix(c.route("/keepalive"), "/"),
+			func() { c.keepalive(keepalive) })
+
+		// Keep the camera's capture pipeline warm in the background if enabled
+		if conf.KeepWarmInterval > 0 {
+			keepWarm := time.NewTicker(conf.KeepWarmInterval)
+			go superviseLoop(strings.TrimPrefix(c.route("/keepwarm"), "/"),
+				func() { c.keepWarm(keepWarm) })
+		}
+
+		// Refresh the camera's session in the background if enabled
+		if conf.SessionRefresh > 0 && conf.Source == sourceHTTP {
+			refresh := time.NewTicker(conf.SessionRefresh)
+			go superviseLoop(strings.TrimPrefix(c.route("/refresh"), "/"),
+				func() { c.refreshSession(refresh) })
+		}
+
+		// Log the camera's cache stats in the background if enabled
+		if conf.StatsInterval > 0 {
+			stats := time.NewTicker(conf.StatsInterval)
+			go superviseLoop(strings.TrimPrefix(c.route("/stats"), "/"),
+				func() { c.logCacheStats(stats) })
+		}
+
+		// Detect motion in the background if enabled
+		if conf.MotionWebhook != "" {
+			motion := time.NewTicker(conf.MotionInterval)
+			go superviseLoop(strings.TrimPrefix(c.route("/motion"), "/"),
+				func() { c.detectMotion(motion) })
+		}
 
-	// Locate the session cookie in the response, erroring if not found.
-	log.Printf("Login - Finding session cookie")
-	var sessionCookie *http.Cookie
-	sessionFound := false
-	for _, cookie := range initialResponse.Cookies() {
-		if cookie.Name == "AIROS_SESSIONID" {
-			log.Printf("Login - Found session cookie: %s", cookie.Value)
-			sessionCookie = cookie
-			sessionFound = true
+		// Evict the rate limiters of idle client IPs in the background if
+		// enabled
+		if conf.PerIPRate > 0 {
+			sweep := time.NewTicker(time.Minute)
+			go superviseLoop(strings.TrimPrefix(c.route("/sweep"), "/"),
+				func() { c.sweepClientLimiters(sweep) })
 		}
+
+		// Upload snapshots to the S3 bucket in the background if enabled
+		if uploadClient != nil {
+			upload := time.NewTicker(conf.S3Interval)
+			go superviseLoop(strings.TrimPrefix(c.route("/upload"), "/"),
+				func() { c.uploadSnapshots(uploadClient, upload) })
+		}
+
+		// Save snapshots to disk in the background if enabled
+		if conf.SaveDir != "" {
+			save := time.NewTicker(conf.SaveInterval)
+			go superviseLoop(strings.TrimPrefix(c.route("/save"), "/"),
+				func() { c.saveSnapshots(save) })
+		}
+	}
+
+	// Mark the cameras as ready to serve snapshots now that startup, including
+	// any startup check, has finished
+	ready.Store(true)
+	logger("server").Info("Ready")
+
+	// Notify systemd that startup has finished, and send watchdog
+	// notifications in the background if it expects them
+	if err := sdNotify("READY=1"); err != nil {
+		logger("server").Warn("Error notifying systemd", "error", err)
 	}
 
-	if !sessionFound {
-		log.Printf("Login - Could not find session cookie")
-		return nil, errors.New("Login - Could not find session cookie")
+	if interval := watchdogInterval(); interval > 0 {
+		watchdog := time.NewTicker(interval / 2)
+		go superviseLoop("watchdog", func() {
+			notifyWatchdog(watchdog, interval)
+		})
 	}
 
-	// Create a multipart form body
-	log.Print("Login - Constructing multipart form data")
+	// Wait for SIGTERM or SIGINT, then stop accepting connections and allow
+	// in-flight snapshot requests to finish before exiting.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM,
+		os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+	stop()
 
-	// Byte buffer to hold the body
-	bodyBuffer := &bytes.Buffer{}
+	logger("server").Info("Shutting down")
+	sdNotify("STOPPING=1")
 
-	// Multipart writer
-	bodyWriter := multipart.NewWriter(bodyBuffer)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(),
+		shutdownTimeout)
+	defer cancel()
 
-	// Construct map containing the form fields and their values
-	formValues := map[string]string{
-		"uri":      "/snapshot.cgi",
-		"Submit":   "Login",
-		"username": conf.Username,
-		"password": conf.Password,
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		fatal(logger("server"), "Error shutting down", "error", err)
 	}
 
-	// Write each field and value to the multipart writer
-	for field, value := range formValues {
-		err = bodyWriter.WriteField(field, value)
+	// Save the current sessions so that they are resumed by the next start
+	if conf.SessionFile != "" && conf.Source == sourceHTTP {
+		if err := saveSessions(conf.SessionFile, cameras); err != nil {
+			logger("server").Warn("Error saving sessions", "path",
+				conf.SessionFile, "error", err)
+		}
+	}
 
-		if err != nil {
-			log.Printf("Login - Error encoding field %s with value %s: %s", field,
-				value, err)
-			return nil, err
+	// Remove the Unix socket so that it is not left behind for the next start
+	if conf.UnixSocket != "" {
+		if err := os.Remove(conf.UnixSocket); err != nil &&
+			!errors.Is(err, fs.ErrNotExist) {
+			logger("server").Warn("Error removing socket", "error", err)
 		}
 	}
+}
+
+// listen creates the listener of the HTTP server, which is the Unix socket if
+// configured, otherwise the TCP listen address. Any stale socket left behind by
+// a previous run is removed first.
+// It returns the listener, and any errors encountered creating it.
+func listen() (net.Listener, error) {
+	if conf.UnixSocket == "" {
+		return net.Listen("tcp", conf.listenAddr())
+	}
 
-	bodyWriter.Close()
+	if err := os.Remove(conf.UnixSocket); err != nil &&
+		!errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
 
-	// Make the request to the login endpoint on the AirCam.
-	loginURL := fmt.Sprintf("%s/login.cgi", conf.URL)
-	log.Printf("Login - Creating login request: %s", loginURL)
+	listener, err := net.Listen("unix", conf.UnixSocket)
+	if err != nil {
+		return nil, err
+	}
 
-	// Create a new POST request to the login endpoint with the multipart buffer
-	request, err := http.NewRequest("POST", loginURL, bodyBuffer)
+	if err := os.Chmod(conf.UnixSocket, conf.UnixSocketMode); err != nil {
+		listener.Close()
+		return nil, err
+	}
 
-	// Add the session cookie retrieved earlier
-	request.AddCookie(sessionCookie)
+	return listener, nil
+}
 
-	// Dynamically set the Content-Type header to indicate the form boundary
-	request.Header.Set("Content-Type", bodyWriter.FormDataContentType())
+// registerRoutes associates the handlers of the camera with its routes on a
+// mux, see route.
+func (c *camera) registerRoutes(mux *http.ServeMux) {
+	mux.HandleFunc(c.route(conf.ServePath), cors(requireAuth(
+		requireReady(c.rateLimit(c.handleSnapshot)))))
+	mux.HandleFunc(c.route("/snapshot.json"), cors(requireAuth(
+		requireReady(c.rateLimit(c.handleSnapshotJSON)))))
+	mux.HandleFunc(c.route("/healthz"), c.handleHealth)
+	mux.HandleFunc(c.route("/ready"), c.handleReady)
+	mux.HandleFunc(c.route("/stream.mjpeg"),
+		cors(requireAuth(requireReady(c.serveMJPEG))))
+	mux.HandleFunc(c.route("/frames.zip"), requireAuth(c.handleFrames))
+
+	// Associate the admin handlers only if the proxy requires credentials, so
+	// that they are never left open
+	if conf.ProxyUser != "" {
+		mux.HandleFunc(c.route("/admin/relogin"),
+			requireAuth(c.handleRelogin))
+	}
 
-	if err != nil {
-		log.Printf("Login - Error creating login request: %s", err)
-		return nil, err
+	// Associate the passthrough handler of each other allowed AirCam path,
+	// leaving any path not on the list unhandled with a 404. The default
+	// /snapshot.cgi on the list is the snapshot itself.
+	for _, path := range conf.AllowedPaths {
+		if conf.Source == sourceHTTP && path != "/snapshot.cgi" &&
+			path != conf.ServePath {
+			mux.HandleFunc(c.route(path),
+				requireAuth(requireReady(c.handlePassthrough(path))))
+		}
 	}
 
-	// Make the login request
-	log.Print("Login - Making login request")
-	response, err := client.Do(request)
+	// Associate the WebSocket stream handler if enabled
+	if conf.EnableWS {
+		mux.HandleFunc(c.route("/ws"),
+			requireAuth(requireReady(c.serveWebSocket)))
+	}
 
-	// Check if there was an error making the request or if the server did not
-	// respond with 200
-	if err != nil {
-		log.Printf("Login - Error making login request: %s", err)
-		return nil, err
-	} else if response.StatusCode != http.StatusOK {
-		log.Printf("Login - Error making login request: HTTP %d",
-			response.StatusCode)
-		return nil, fmt.Errorf("Login - Error making login request: HTTP %d",
-			response.StatusCode)
+	// Associate the HTML viewer handler with the root of the camera alone
+	// if enabled, leaving other unknown paths unhandled
+	if conf.ViewerEnabled {
+		mux.HandleFunc("GET "+c.route("/{$}"), requireAuth(c.handleViewer))
+	}
+}
+
+// superviseLoop runs a long-running background loop, recovering from any panic
+// by logging it and restarting the loop after the configured delay, so that a
+// single bad frame can not permanently stop the loop or crash the server.
+func superviseLoop(name string, loop func()) {
+	for runLoop(name, loop) {
+		loopRestarts.WithLabelValues(name).Inc()
+		time.Sleep(conf.LoopRestartDelay)
 	}
+}
+
+// runLoop runs a background loop until it returns or panics.
+// It returns whether the loop panicked.
+func runLoop(name string, loop func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger("loop").Error("Loop panicked, restarting", "loop", name,
+				"delay", conf.LoopRestartDelay, "panic", r)
+			panicked = true
+		}
+	}()
+
+	loop()
 
-	// Return the session cookie and no error
-	return sessionCookie, nil
+	return false
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, exposed at /metrics. Series are labelled with the name of
+// the camera, or "default" for the camera defined by environment variables.
+var (
+	snapshotRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aircam_snapshot_requests_total",
+		Help: "Total number of snapshot requests received.",
+	}, []string{"camera"})
+
+	upstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aircam_snapshot_upstream_errors_total",
+		Help: "Total number of failed requests to the AirCam, by cause.",
+	}, []string{"camera", "cause"})
+
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aircam_snapshot_upstream_fetch_duration_seconds",
+		Help:    "Latency of snapshot requests to the AirCam.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"camera"})
+
+	relogins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aircam_snapshot_relogins_total",
+		Help: "Total number of logins performed to replace an expired session.",
+	}, []string{"camera"})
+
+	suspectFrames = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aircam_snapshot_suspect_frames_total",
+		Help: "Total number of images smaller than the minimum healthy size.",
+	}, []string{"camera"})
+
+	cacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aircam_snapshot_cache_hits_total",
+		Help: "Total number of frames served from the cache.",
+	}, []string{"camera"})
+
+	cacheMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aircam_snapshot_cache_misses_total",
+		Help: "Total number of frames not found fresh in the cache.",
+	}, []string{"camera"})
+
+	fetchesInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aircam_snapshot_fetches_in_flight",
+		Help: "Number of snapshot fetches from the AirCam in flight.",
+	}, []string{"camera"})
+
+	fetchLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aircam_snapshot_fetch_limit",
+		Help: "Maximum number of concurrent fetches from the AirCam, 0 if unlimited.",
+	}, []string{"camera"})
+
+	requestRateLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aircam_snapshot_rate_limit",
+		Help: "Maximum snapshot requests per second, 0 if unlimited.",
+	}, []string{"camera"})
+
+	loopRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aircam_snapshot_loop_restarts_total",
+		Help: "Total number of background loop restarts after a panic.",
+	}, []string{"loop"})
+)
+
+// Causes of upstream errors, used as the cause label of upstreamErrors.
+const (
+	causeTimeout     = "timeout"
+	causeTransport   = "transport"
+	causeNon200      = "non_200"
+	causeAuthFailure = "auth_failure"
+	causeNotJPEG     = "not_jpeg"
+)
+
+// label is the value of the camera label for the camera's metrics.
+func (c *camera) label() string {
+	if c.Name == "" {
+		return "default"
+	}
+
+	return c.Name
+}
+
+// recordLimits sets the rate limit and concurrent fetch limit gauges of the
+// camera to its limits.
+func (c *camera) recordLimits() {
+	limit, _, maxFetches := c.limits()
+	requestRateLimit.WithLabelValues(c.label()).Set(limit)
+	fetchLimit.WithLabelValues(c.label()).Set(float64(maxFetches))
+}
+
+// countUpstreamError increments the upstream error count of the camera for a
+// cause.
+func (c *camera) countUpstreamError(cause string) {
+	upstreamErrors.WithLabelValues(c.label(), cause).Inc()
+}
+
+// transportCause determines the cause label of an error returned while making
+// a request to, or reading a response from, the AirCam.
+func transportCause(err error) string {
+	if errorStatus(err) == http.StatusGatewayTimeout {
+		return causeTimeout
+	}
+
+	return causeTransport
+}
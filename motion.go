@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"net/http"
+	"time"
+)
+
+// motionPixelDelta is the smallest change in the luma of a pixel between two
+// frames which counts the pixel as changed, below which it is treated as
+// sensor noise or compression artifacts.
+const motionPixelDelta = 32
+
+// Type motionEvent represents the JSON body posted to the motion webhook.
+type motionEvent struct {
+	Camera    string    `json:"camera"`
+	Timestamp time.Time `json:"timestamp"`
+	Score     float64   `json:"score"`
+}
+
+// detectMotion runs every motion interval and compares the latest frame of the
+// camera, sharing the cache with clients, against the previous one. When the
+// ratio of changed pixels crosses the motion threshold, a motion event is
+// posted to the webhook, at most once per motion cooldown.
+func (c *camera) detectMotion(ticker *time.Ticker) {
+	var previous *image.Gray
+	var fetched, notified time.Time
+
+	for range ticker.C {
+		f, err := c.getFrame(context.Background(), nil)
+		if err != nil || f.fetched.Equal(fetched) {
+			continue
+		}
+
+		fetched = f.fetched
+
+		current, err := decodeLuma(f.image)
+		if err != nil {
+			c.logger("motion").Warn("Error decoding frame", "error", err)
+			continue
+		}
+
+		if previous == nil {
+			previous = current
+			continue
+		}
+
+		score := lumaDifference(previous, current)
+		previous = current
+
+		if score < conf.MotionThreshold ||
+			time.Since(notified) < conf.MotionCooldown {
+			continue
+		}
+
+		c.logger("motion").Info("Motion detected", "score", score)
+		notified = time.Now()
+
+		event := motionEvent{
+			Camera:    c.label(),
+			Timestamp: f.captured,
+			Score:     score,
+		}
+		if err := postMotionEvent(event); err != nil {
+			c.logger("motion").Error("Error posting motion event", "error", err)
+		}
+	}
+}
+
+// decodeLuma decodes a JPEG image into its luma, as a grayscale image.
+// It returns the grayscale image, and any errors encountered decoding it.
+func decodeLuma(frame []byte) (*image.Gray, error) {
+	decoded, err := jpeg.Decode(bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+
+	gray := image.NewGray(decoded.Bounds())
+	draw.Draw(gray, gray.Bounds(), decoded, decoded.Bounds().Min, draw.Src)
+
+	return gray, nil
+}
+
+// lumaDifference compares the luma of two frames pixel by pixel.
+// It returns the ratio of pixels which changed by more than motionPixelDelta,
+// from 0 for identical frames to 1, which is also returned if the frames have
+// different sizes.
+func lumaDifference(previous *image.Gray, current *image.Gray) float64 {
+	if previous.Bounds().Size() != current.Bounds().Size() {
+		return 1
+	}
+
+	size := previous.Bounds().Size()
+	if size.X == 0 || size.Y == 0 {
+		return 0
+	}
+
+	changed := 0
+	for y := 0; y < size.Y; y++ {
+		a := previous.Pix[y*previous.Stride : y*previous.Stride+size.X]
+		b := current.Pix[y*current.Stride : y*current.Stride+size.X]
+
+		for x := range a {
+			delta := int(a[x]) - int(b[x])
+			if delta > motionPixelDelta || delta < -motionPixelDelta {
+				changed++
+			}
+		}
+	}
+
+	return float64(changed) / float64(size.X*size.Y)
+}
+
+// postMotionEvent posts a motion event to the motion webhook as JSON.
+// It returns any errors encountered posting it, including a non-2xx status.
+func postMotionEvent(event motionEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: conf.Timeout}
+	response, err := client.Post(conf.MotionWebhook, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("Motion - Webhook responded with status %d",
+			response.StatusCode)
+	}
+
+	return nil
+}
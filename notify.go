@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state notification, such as READY=1, to the systemd
+// service manager over the NOTIFY_SOCKET datagram socket. It does nothing when
+// not running under systemd with Type=notify, where NOTIFY_SOCKET is unset.
+// It returns any errors encountered sending the notification.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// A leading @ denotes a socket in the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil,
+		&net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+
+	return err
+}
+
+// watchdogInterval returns the interval at which systemd expects watchdog
+// notifications, from the WATCHDOG_USEC set when WatchdogSec is configured.
+// It returns zero if the watchdog is not enabled for this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	// WATCHDOG_PID, if set, names the process the watchdog is meant for
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" &&
+		pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// wedgedTimeouts is the number of upstream timeouts after which a camera with
+// fetches in flight, none of which has started or finished since, is
+// considered wedged. It is far longer than a fetch takes, even with a login
+// and every retry.
+const wedgedTimeouts = 10
+
+// notifyWatchdog sends a watchdog notification to systemd every tick, as long
+// as the process is alive to send it. An AirCam which is down is not a reason
+// to skip it, as restarting would not bring it back, so only a camera whose
+// fetches are wedged skips it, letting systemd restart the instance once the
+// watchdog timeout passes.
+func notifyWatchdog(ticker *time.Ticker, interval time.Duration) {
+	for range ticker.C {
+		sendWatchdog(max(interval, wedgedTimeouts*conf.Timeout))
+	}
+}
+
+// sendWatchdog sends a single watchdog notification to systemd, unless the
+// fetches of any camera have made no progress for longer than a limit.
+func sendWatchdog(limit time.Duration) {
+	for _, c := range cameras {
+		if c.wedged(limit) {
+			c.logger("watchdog").Error("Fetches are wedged, skipping watchdog",
+				"inFlight", c.fetching.Load())
+			return
+		}
+	}
+
+	if err := sdNotify("WATCHDOG=1"); err != nil {
+		logger("watchdog").Warn("Error notifying systemd", "error", err)
+	}
+}
+
+// wedged checks whether the fetches of the camera have stopped making
+// progress, with fetches in flight but none of them starting or finishing
+// for longer than a limit. This only reads state the camera already keeps, so
+// that it never blocks on the AirCam itself.
+func (c *camera) wedged(limit time.Duration) bool {
+	if c.fetching.Load() == 0 {
+		return false
+	}
+
+	return time.Since(time.Unix(0, c.fetchProgress.Load())) > limit
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// listenNotifySocket listens on a datagram socket set as NOTIFY_SOCKET until
+// the test ends.
+// It returns the socket.
+func listenNotifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "notify.sock")
+	socket, err := net.ListenUnixgram("unixgram",
+		&net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { socket.Close() })
+
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	return socket
+}
+
+func TestSendWatchdog(t *testing.T) {
+	tests := []struct {
+		name     string
+		down     bool
+		inFlight bool
+		progress time.Duration
+		wantSent bool
+	}{
+		{name: "idle", wantSent: true},
+		{name: "camera down", down: true, wantSent: true},
+		{name: "fetch in flight", inFlight: true, wantSent: true},
+		{name: "wedged", inFlight: true, progress: -time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			socket := listenNotifySocket(t)
+
+			aircam := newFakeAirCam(t, "ubnt", "secret")
+			c := newTestCamera(t, aircam, map[string]string{
+				"SNAPSHOT_BREAKER_THRESHOLD": "1",
+			})
+			previous := cameras
+			cameras = []*camera{c}
+			t.Cleanup(func() { cameras = previous })
+
+			if tt.down {
+				aircam.Close()
+				c.fetchImage(context.Background(), nil)
+			}
+
+			if tt.inFlight {
+				release, err := c.acquireFetch(context.Background())
+				if err != nil {
+					t.Fatalf("acquireFetch() error = %v", err)
+				}
+				t.Cleanup(release)
+
+				c.fetchProgress.Store(time.Now().Add(tt.progress).UnixNano())
+			}
+
+			sendWatchdog(time.Minute)
+
+			socket.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			buffer := make([]byte, 64)
+			n, err := socket.Read(buffer)
+			if sent := err == nil; sent != tt.wantSent {
+				t.Fatalf("watchdog sent = %v, want %v", sent, tt.wantSent)
+			}
+
+			if tt.wantSent && string(buffer[:n]) != "WATCHDOG=1" {
+				t.Errorf("notification = %q, want %q", buffer[:n], "WATCHDOG=1")
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"io"
+)
+
+// oneshot logs in to the camera and writes a single image to the provided
+// writer, such as stdout, without starting the HTTP server. The RTSP source
+// does not login.
+// It returns any errors encountered during login or retrieval.
+func (c *camera) oneshot(out io.Writer) error {
+	if conf.Source == sourceRTSP {
+		return c.getImage(context.Background(), out, nil)
+	}
+
+	sessionCookie, err := c.login(context.Background())
+	if err != nil {
+		return err
+	}
+
+	c.session.Set(sessionCookie)
+
+	// Discover the snapshot path of the AirCam for this session if enabled
+	if conf.Autodiscover {
+		c.path, err = c.discoverSnapshotPath(sessionCookie)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.getImage(context.Background(), out, nil)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+	"time"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Corners of a frame the timestamp overlay can be drawn in, see
+// SNAPSHOT_TIMESTAMP_POSITION.
+const (
+	overlayTopLeft     = "top-left"
+	overlayTopRight    = "top-right"
+	overlayBottomLeft  = "bottom-left"
+	overlayBottomRight = "bottom-right"
+)
+
+// overlayLineHeight is the height of frame in pixels per pixel of the overlay
+// font, so that the timestamp is scaled up to stay legible on larger frames.
+const overlayLineHeight = 240
+
+// overlayPadding is the padding in unscaled pixels between the timestamp, its
+// background, and the edge of the frame.
+const overlayPadding = 3
+
+// overlayBackground is the translucent black drawn behind the timestamp, so
+// that it is legible on any part of the frame.
+var overlayBackground = color.NRGBA{A: 160}
+
+// parseOverlayColor parses the color of the timestamp overlay, which is a hex
+// RGB color in the form #RRGGBB.
+// It returns the color, and an error describing why it is invalid, if it is.
+func parseOverlayColor(value string) (color.RGBA, error) {
+	hex, ok := strings.CutPrefix(value, "#")
+	if !ok || len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("%q is not in the form #RRGGBB", value)
+	}
+
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("%q is not in the form #RRGGBB", value)
+	}
+
+	return color.RGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb),
+		A: 0xff}, nil
+}
+
+// drawTimestamp draws a time on an image, in the configured corner, color, and
+// format, scaled to the height of the image.
+func drawTimestamp(img *image.RGBA, t time.Time) {
+	bounds := img.Bounds()
+
+	// Draw the timestamp on its background at the size of the font, which is
+	// then scaled onto the frame
+	face := basicfont.Face7x13
+	text := t.Format(conf.TimestampFormat)
+	metrics := face.Metrics()
+	label := image.NewRGBA(image.Rect(0, 0,
+		font.MeasureString(face, text).Ceil()+2*overlayPadding,
+		metrics.Height.Ceil()+2*overlayPadding))
+	draw.Draw(label, label.Bounds(), image.NewUniform(overlayBackground),
+		image.Point{}, draw.Src)
+
+	drawer := &font.Drawer{
+		Dst:  label,
+		Src:  image.NewUniform(conf.TimestampColor),
+		Face: face,
+		Dot:  fixed.P(overlayPadding, overlayPadding+metrics.Ascent.Ceil()),
+	}
+	drawer.DrawString(text)
+
+	// Place the scaled timestamp in the configured corner, offset by the
+	// image origin
+	scale := max(1, bounds.Dy()/overlayLineHeight)
+	size := label.Bounds().Size().Mul(scale)
+	margin := overlayPadding * scale
+
+	var corner image.Point
+	switch conf.TimestampPosition {
+	case overlayTopLeft:
+		corner = image.Pt(margin, margin)
+	case overlayTopRight:
+		corner = image.Pt(bounds.Dx()-size.X-margin, margin)
+	case overlayBottomLeft:
+		corner = image.Pt(margin, bounds.Dy()-size.Y-margin)
+	default:
+		corner = image.Pt(bounds.Dx()-size.X-margin,
+			bounds.Dy()-size.Y-margin)
+	}
+
+	rect := image.Rectangle{Min: corner, Max: corner.Add(size)}.Add(bounds.Min)
+	xdraw.NearestNeighbor.Scale(img, rect, label, label.Bounds(), draw.Over,
+		nil)
+}
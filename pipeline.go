@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"strings"
+	"time"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// Names of the built-in frame processors, see SNAPSHOT_PIPELINE.
+const (
+	processorMask        = "mask"
+	processorOverlay     = "overlay"
+	processorResize      = "resize"
+	processorPassthrough = "passthrough"
+)
+
+// Type frameProcessor processes a decoded frame fetched from the camera, such
+// as by drawing on it or resizing it, as one stage of the frame pipeline.
+type frameProcessor interface {
+	// process processes a frame captured at the provided time, either in
+	// place or by returning a new image.
+	// It returns the processed image, and any errors encountered processing
+	// it.
+	process(img *image.RGBA, captured time.Time) (*image.RGBA, error)
+}
+
+// Type pipeline is the ordered list of processors applied to every frame
+// fetched from the camera before it is cached and served. The frame is decoded
+// once before the first processor, and encoded once after the last.
+type pipeline []frameProcessor
+
+// parsePipeline creates the frame pipeline from the names of its processors,
+// in order.
+// It returns the pipeline, and an error naming any unknown processor.
+func parsePipeline(names []string) (pipeline, error) {
+	var p pipeline
+
+	for _, name := range names {
+		switch name {
+		case processorMask:
+			p = append(p, maskProcessor{})
+		case processorOverlay:
+			p = append(p, overlayProcessor{})
+		case processorResize:
+			p = append(p, resizeProcessor{})
+		case processorPassthrough:
+			p = append(p, passthroughProcessor{})
+		default:
+			return nil, fmt.Errorf("unknown processor %q, must be one of %s", name,
+				strings.Join([]string{processorMask, processorOverlay,
+					processorResize, processorPassthrough}, ", "))
+		}
+	}
+
+	return p, nil
+}
+
+// apply processes a JPEG image with every processor of the pipeline, decoding
+// and encoding it only once. An empty pipeline returns the image untouched,
+// without decoding it.
+// It returns the processed JPEG, and any errors encountered decoding,
+// processing, or encoding it.
+func (p pipeline) apply(frame []byte, captured time.Time) ([]byte, error) {
+	if len(p) == 0 {
+		return frame, nil
+	}
+
+	decoded, err := jpeg.Decode(bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy the decoded image into a drawable RGBA image
+	img := image.NewRGBA(decoded.Bounds())
+	draw.Draw(img, img.Bounds(), decoded, decoded.Bounds().Min, draw.Src)
+
+	for _, processor := range p {
+		if img, err = processor.process(img, captured); err != nil {
+			return nil, err
+		}
+	}
+
+	var buffer bytes.Buffer
+	if err := jpeg.Encode(&buffer, img, nil); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// Type maskProcessor blacks out the SNAPSHOT_PRIVACY_MASK regions of a frame.
+type maskProcessor struct{}
+
+// process fills the privacy mask regions of the frame with black.
+func (maskProcessor) process(img *image.RGBA, _ time.Time) (*image.RGBA,
+	error) {
+	maskRects(img, conf.PrivacyMask)
+
+	return img, nil
+}
+
+// Type overlayProcessor draws the capture time on a frame, as configured by
+// the SNAPSHOT_TIMESTAMP_* variables.
+type overlayProcessor struct{}
+
+// process draws the capture time on the frame.
+func (overlayProcessor) process(img *image.RGBA, captured time.Time) (
+	*image.RGBA, error) {
+	drawTimestamp(img, captured)
+
+	return img, nil
+}
+
+// Type resizeProcessor resizes a frame to SNAPSHOT_RESIZE_WIDTH and
+// SNAPSHOT_RESIZE_HEIGHT, scaling a zero dimension to preserve the aspect
+// ratio.
+type resizeProcessor struct{}
+
+// process resizes the frame, returning it as-is if neither dimension is set.
+func (resizeProcessor) process(img *image.RGBA, _ time.Time) (*image.RGBA,
+	error) {
+	bounds := img.Bounds()
+	width, height := conf.ResizeWidth, conf.ResizeHeight
+	switch {
+	case width == 0 && height == 0:
+		return img, nil
+	case width == 0:
+		width = max(1, bounds.Dx()*height/bounds.Dy())
+	case height == 0:
+		height = max(1, bounds.Dy()*width/bounds.Dx())
+	}
+
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	xdraw.ApproxBiLinear.Scale(resized, resized.Bounds(), img, bounds,
+		draw.Src, nil)
+
+	return resized, nil
+}
+
+// Type passthroughProcessor leaves a frame untouched, for testing that the
+// pipeline itself works.
+type passthroughProcessor struct{}
+
+// process returns the frame as-is.
+func (passthroughProcessor) process(img *image.RGBA, _ time.Time) (
+	*image.RGBA, error) {
+	return img, nil
+}
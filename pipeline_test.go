@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestFrame encodes a white JPEG frame of a size.
+// It returns the JPEG.
+func newTestFrame(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{},
+		draw.Src)
+
+	var buffer bytes.Buffer
+	if err := jpeg.Encode(&buffer, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return buffer.Bytes()
+}
+
+func TestPrivacyMaskBlacksOutPixels(t *testing.T) {
+	setTestConfig(t, map[string]string{
+		"SNAPSHOT_URL":          "http://aircam",
+		"SNAPSHOT_USERNAME":     "ubnt",
+		"SNAPSHOT_PASSWORD":     "secret",
+		"SNAPSHOT_PRIVACY_MASK": "0,0,32,32;48,48,16,16",
+	})
+
+	processed, err := conf.pipeline.apply(newTestFrame(t, 64, 64), time.Now())
+	if err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(processed))
+	if err != nil {
+		t.Fatalf("jpeg.Decode() error = %v", err)
+	}
+
+	tests := []struct {
+		x, y   int
+		masked bool
+	}{
+		{x: 4, y: 4, masked: true},
+		{x: 28, y: 28, masked: true},
+		{x: 56, y: 56, masked: true},
+		{x: 40, y: 8, masked: false},
+		{x: 8, y: 40, masked: false},
+		{x: 40, y: 40, masked: false},
+	}
+
+	for _, tt := range tests {
+		r, g, b, _ := img.At(tt.x, tt.y).RGBA()
+		luma := (r + g + b) / 3 >> 8
+		if masked := luma < 32; masked != tt.masked {
+			t.Errorf("pixel (%d, %d) luma = %d, want masked %t", tt.x, tt.y,
+				luma, tt.masked)
+		}
+	}
+}
+
+func TestPipelineRequiresPrivacyMask(t *testing.T) {
+	tests := []struct {
+		name     string
+		pipeline string
+		wantErr  string
+	}{
+		{name: "default"},
+		{name: "mask then resize", pipeline: "mask,resize"},
+		{name: "without mask", pipeline: "resize", wantErr: "must include mask"},
+		{name: "resize then mask", pipeline: "resize,mask",
+			wantErr: "before resize"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{
+				"SNAPSHOT_URL":          "http://aircam",
+				"SNAPSHOT_USERNAME":     "ubnt",
+				"SNAPSHOT_PASSWORD":     "secret",
+				"SNAPSHOT_PRIVACY_MASK": "0,0,32,32",
+				"SNAPSHOT_PIPELINE":     tt.pipeline,
+			}
+
+			_, err := loadConfig(func(name string) string { return env[name] })
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("loadConfig() error = %v", err)
+			case tt.wantErr != "" && (err == nil ||
+				!strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("loadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTimestampOverlay(t *testing.T) {
+	tests := []struct {
+		position string
+		x, y     int
+	}{
+		{position: overlayTopLeft, x: 6, y: 6},
+		{position: overlayTopRight, x: 313, y: 6},
+		{position: overlayBottomLeft, x: 6, y: 233},
+		{position: overlayBottomRight, x: 313, y: 233},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.position, func(t *testing.T) {
+			setTestConfig(t, map[string]string{
+				"SNAPSHOT_URL":                "http://aircam",
+				"SNAPSHOT_USERNAME":           "ubnt",
+				"SNAPSHOT_PASSWORD":           "secret",
+				"SNAPSHOT_TIMESTAMP_OVERLAY":  "true",
+				"SNAPSHOT_TIMESTAMP_POSITION": tt.position,
+			})
+
+			processed, err := conf.pipeline.apply(newTestFrame(t, 320, 240),
+				time.Now())
+			if err != nil {
+				t.Fatalf("apply() error = %v", err)
+			}
+
+			img, err := jpeg.Decode(bytes.NewReader(processed))
+			if err != nil {
+				t.Fatalf("jpeg.Decode() error = %v", err)
+			}
+
+			if bounds := img.Bounds(); bounds.Dx() != 320 || bounds.Dy() != 240 {
+				t.Errorf("overlay size = %dx%d, want 320x240", bounds.Dx(),
+					bounds.Dy())
+			}
+
+			// The background of the timestamp darkens the white frame in the
+			// corner it is drawn in
+			if r, _, _, _ := img.At(tt.x, tt.y).RGBA(); r>>8 > 0xc0 {
+				t.Errorf("pixel (%d, %d) red = %#x, want the overlay", tt.x,
+					tt.y, r>>8)
+			}
+		})
+	}
+}
+
+func TestTimestampOverlayDisabled(t *testing.T) {
+	setTestConfig(t, map[string]string{
+		"SNAPSHOT_URL":      "http://aircam",
+		"SNAPSHOT_USERNAME": "ubnt",
+		"SNAPSHOT_PASSWORD": "secret",
+	})
+
+	// Without any processors the frame is served without decoding it
+	frame := newTestFrame(t, 320, 240)
+	processed, err := conf.pipeline.apply(frame, time.Now())
+	if err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+
+	if !bytes.Equal(processed, frame) {
+		t.Error("apply() re-encoded the frame, want it unchanged")
+	}
+}
+
+// Type recordingProcessor records every image it processes, replacing it with
+// a fresh copy so that the next processor can be checked to receive exactly
+// the returned image.
+type recordingProcessor struct {
+	received *[]*image.RGBA
+	returned *[]*image.RGBA
+}
+
+// process records the frame, and returns a copy of it.
+func (r recordingProcessor) process(img *image.RGBA, _ time.Time) (
+	*image.RGBA, error) {
+	*r.received = append(*r.received, img)
+
+	copied := image.NewRGBA(img.Bounds())
+	draw.Draw(copied, copied.Bounds(), img, img.Bounds().Min, draw.Src)
+	*r.returned = append(*r.returned, copied)
+
+	return copied, nil
+}
+
+func TestPipelineComposesProcessors(t *testing.T) {
+	setTestConfig(t, map[string]string{
+		"SNAPSHOT_URL":           "http://aircam",
+		"SNAPSHOT_USERNAME":      "ubnt",
+		"SNAPSHOT_PASSWORD":      "secret",
+		"SNAPSHOT_RESIZE_WIDTH":  "32",
+		"SNAPSHOT_RESIZE_HEIGHT": "16",
+	})
+
+	var received, returned []*image.RGBA
+	recorder := recordingProcessor{received: &received, returned: &returned}
+
+	p, err := parsePipeline([]string{processorPassthrough, processorResize})
+	if err != nil {
+		t.Fatalf("parsePipeline() error = %v", err)
+	}
+	p = pipeline{recorder, p[0], recorder, p[1]}
+
+	processed, err := p.apply(newTestFrame(t, 64, 64), time.Now())
+	if err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+
+	if len(received) != 2 {
+		t.Fatalf("recorded %d frames, want 2", len(received))
+	}
+
+	// Each processor receives the image returned by the one before it, rather
+	// than a frame encoded and decoded again in between
+	if received[1] != returned[0] {
+		t.Error("second recorder did not receive the image of the first")
+	}
+
+	// The frame is encoded once, from the image returned by the resize
+	resized, err := resizeProcessor{}.process(returned[1], time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buffer bytes.Buffer
+	if err := jpeg.Encode(&buffer, resized, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(processed, buffer.Bytes()) {
+		t.Error("apply() did not encode the resized image once")
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(processed))
+	if err != nil {
+		t.Fatalf("jpeg.Decode() error = %v", err)
+	}
+
+	if bounds := img.Bounds(); bounds != image.Rect(0, 0, 32, 16) {
+		t.Errorf("bounds = %v, want %v", bounds, image.Rect(0, 0, 32, 16))
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// passthroughHeaders are the AirCam response headers copied to the client by
+// the passthrough proxy, unless others are set by SNAPSHOT_PASSTHROUGH_HEADERS.
+var passthroughHeaders = []string{
+	"Content-Type",
+	"Content-Length",
+	"Last-Modified",
+	"Cache-Control",
+}
+
+// strippedHeaders are the AirCam response headers never copied to the client
+// by the passthrough proxy, even if they are passthrough headers, unless
+// others are set by SNAPSHOT_STRIP_HEADERS. The AirCam sets its session cookie
+// on some responses, which must not reach the client.
+var strippedHeaders = []string{
+	"Set-Cookie",
+	"Set-Cookie2",
+}
+
+// hopByHopHeaders are the headers of a single connection, as defined by RFC
+// 9110, which the passthrough proxy never copies to the client regardless of
+// SNAPSHOT_STRIP_HEADERS.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// handlePassthrough creates the handler function for an allowed AirCam CGI
+// endpoint, which forwards the request to the same path on the camera with the
+// session cookie and streams the response back to the client.
+func (c *camera) handlePassthrough(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.logger("proxy").DebugContext(r.Context(), "Proxying request", "path",
+			path)
+
+		// Only forward reads, as the AirCam endpoints are otherwise unsafe to
+		// retry after logging in again
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+				http.StatusMethodNotAllowed)
+			return
+		}
+
+		sessionCookie, err := c.session.Current(r.Context())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		response, err := c.openPassthrough(r, path, sessionCookie)
+		if errors.Is(err, context.Canceled) {
+			return
+		} else if err != nil {
+			writeError(w, err)
+			return
+		}
+		defer response.Body.Close()
+
+		copyPassthroughHeaders(w.Header(), response.Header, sessionCookie)
+
+		w.WriteHeader(response.StatusCode)
+
+		// Lift the write timeout of the server, which bounds single snapshots
+		// rather than continuous responses
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+		// Stream the body, flushing as it arrives so that continuous responses
+		// such as stream.cgi reach the client without buffering
+		if _, err := io.Copy(flushWriter{w}, response.Body); err != nil {
+			c.logger("proxy").DebugContext(r.Context(),
+				"Error streaming response", "path", path, "error", err)
+		}
+
+		c.recentActivity.Store(true)
+	}
+}
+
+// openPassthrough makes a request to a path on the AirCam like
+// requestPassthrough, logging in again and retrying once if the session has
+// expired. Like snapshots, the request waits for a free fetch slot and is
+// refused while the circuit breaker is open. The slot is held until the AirCam
+// responds, so that continuous responses do not hold a slot for as long as
+// they stream.
+// It returns the response, which must be closed, and any errors encountered
+// during the request.
+func (c *camera) openPassthrough(r *http.Request, path string,
+	sessionCookie *http.Cookie) (*http.Response, error) {
+	release, err := c.acquireFetch(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if !c.allowFetch() {
+		return nil, errCircuitOpen
+	}
+
+	response, err := c.requestPassthrough(r, path, sessionCookie)
+	if errors.Is(err, ErrSessionExpired) {
+		c.logger("proxy").InfoContext(r.Context(),
+			"Session expired, logging in again")
+
+		sessionCookie, err = c.session.RefreshExpired(r.Context(),
+			sessionCookie)
+		if err == nil {
+			response, err = c.requestPassthrough(r, path, sessionCookie)
+		}
+	}
+
+	c.recordFetch(err)
+
+	return response, err
+}
+
+// requestPassthrough makes a single request to a path on the AirCam using a
+// session cookie, forwarding the method and query of the client request.
+// It returns the response, which must be closed, and any errors encountered
+// during the request.
+func (c *camera) requestPassthrough(r *http.Request, path string,
+	sessionCookie *http.Cookie) (*http.Response, error) {
+	upstreamURL := c.endpoint(path, r.URL.RawQuery)
+
+	// Create the request bound to the client, so that the upstream request is
+	// abandoned when the client disconnects
+	request, err := http.NewRequestWithContext(r.Context(), r.Method,
+		upstreamURL, nil)
+	if err != nil {
+		c.logger("proxy").ErrorContext(r.Context(), "Error creating request",
+			"error", err)
+		return nil, err
+	}
+
+	// Continuous responses are not bounded by the client timeout, only
+	// connection establishment and waiting for the response headers are
+	client := withoutTimeout(c.httpClient())
+
+	response, err := c.auth.do(client, request, sessionCookie)
+	if errors.Is(err, context.Canceled) {
+		c.logger("proxy").DebugContext(r.Context(),
+			"Request cancelled by client")
+		return nil, err
+	} else if err != nil {
+		c.logger("proxy").ErrorContext(r.Context(), "Error creating response",
+			"error", err)
+		c.countUpstreamError(transportCause(err))
+		return nil, fmt.Errorf("Proxy - Error creating response: %w", err)
+	}
+
+	// Check if the AirCam redirected to the login page, which means the
+	// session has expired
+	if strings.HasSuffix(response.Request.URL.Path, "/login.cgi") {
+		response.Body.Close()
+		c.countUpstreamError(causeAuthFailure)
+		return nil, ErrSessionExpired
+	}
+
+	return response, nil
+}
+
+// copyPassthroughHeaders copies the headers of an AirCam response which are
+// relayed to the client, which are the passthrough headers other than the
+// stripped headers and hop-by-hop headers, including any named by the
+// Connection header of the response. A header containing the value of the
+// session cookie is never copied, so that the session can not leak to the
+// client under any name.
+func copyPassthroughHeaders(dst http.Header, src http.Header,
+	sessionCookie *http.Cookie) {
+	stripped := strippedHeaderNames(src)
+
+	for _, name := range conf.PassthroughHeaders {
+		if stripped[name] {
+			continue
+		}
+
+		for _, value := range src.Values(name) {
+			if sessionCookie != nil && sessionCookie.Value != "" &&
+				strings.Contains(value, sessionCookie.Value) {
+				continue
+			}
+
+			dst.Add(name, value)
+		}
+	}
+}
+
+// strippedHeaderNames determines the headers of an AirCam response which are
+// never relayed to the client, which are the stripped headers and hop-by-hop
+// headers, including any named by the Connection header of the response.
+// It returns the set of canonical header names.
+func strippedHeaderNames(src http.Header) map[string]bool {
+	stripped := map[string]bool{}
+	for _, name := range hopByHopHeaders {
+		stripped[name] = true
+	}
+
+	for _, name := range conf.StripHeaders {
+		stripped[name] = true
+	}
+
+	for _, value := range src.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			stripped[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+
+	return stripped
+}
+
+// Type flushWriter is a writer which flushes the underlying response after
+// every write, if it supports flushing.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+// Write writes to the underlying response and flushes it.
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if flusher, ok := fw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	return n, err
+}
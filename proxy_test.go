@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPassthroughAllowedPaths(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, map[string]string{
+		"SNAPSHOT_ALLOWED_PATHS": "/snapshot.cgi,/status.cgi",
+	})
+	server := newTestServer(t, c)
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{path: "/status.cgi", status: http.StatusOK, body: `{"status":"ok"}`},
+		{path: "/stall.cgi", status: http.StatusNotFound},
+		{path: "/login.cgi", status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			response, err := http.Get(server.URL + tt.path)
+			if err != nil {
+				t.Fatalf("GET %s error = %v", tt.path, err)
+			}
+			defer response.Body.Close()
+
+			if response.StatusCode != tt.status {
+				t.Errorf("GET %s status = %d, want %d", tt.path,
+					response.StatusCode, tt.status)
+			}
+
+			body, _ := io.ReadAll(response.Body)
+			if tt.body != "" && string(body) != tt.body {
+				t.Errorf("GET %s body = %q, want %q", tt.path, body, tt.body)
+			}
+		})
+	}
+}
+
+func TestPassthroughStripsSessionHeaders(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, map[string]string{
+		"SNAPSHOT_ALLOWED_PATHS":       "/status.cgi",
+		"SNAPSHOT_PASSTHROUGH_HEADERS": "Content-Type,Set-Cookie,X-Hop",
+	})
+	server := newTestServer(t, c)
+
+	response, err := http.Get(server.URL + "/status.cgi")
+	if err != nil {
+		t.Fatalf("GET /status.cgi error = %v", err)
+	}
+	defer response.Body.Close()
+
+	for _, name := range []string{"Set-Cookie", "X-Hop"} {
+		if value := response.Header.Get(name); value != "" {
+			t.Errorf("%s = %q, want none", name, value)
+		}
+	}
+
+	for name, values := range response.Header {
+		for _, value := range values {
+			if strings.Contains(value, c.session.Get().Value) {
+				t.Errorf("%s = %q contains the session cookie", name, value)
+			}
+		}
+	}
+}
+
+func TestPassthroughTimesOutWaitingForHeaders(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, map[string]string{
+		"SNAPSHOT_ALLOWED_PATHS": "/stall.cgi",
+		"SNAPSHOT_TIMEOUT":       "100ms",
+	})
+	server := newTestServer(t, c)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Get(server.URL + "/stall.cgi")
+	if err != nil {
+		t.Fatalf("GET /stall.cgi error = %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("GET /stall.cgi status = %d, want %d", response.StatusCode,
+			http.StatusGatewayTimeout)
+	}
+}
+
+func TestPassthroughStripHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		stripped    string
+		wantHeaders []string
+	}{
+		{name: "default strip list",
+			wantHeaders: []string{"Content-Type", "X-Firmware"}},
+		{name: "custom strip list", stripped: "X-Firmware",
+			wantHeaders: []string{"Content-Type"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aircam := newFakeAirCam(t, "ubnt", "secret")
+			c := newTestCamera(t, aircam, map[string]string{
+				"SNAPSHOT_ALLOWED_PATHS": "/status.cgi",
+				"SNAPSHOT_PASSTHROUGH_HEADERS": "Content-Type,Set-Cookie," +
+					"X-Firmware,X-Session",
+				"SNAPSHOT_STRIP_HEADERS": tt.stripped,
+			})
+			server := newTestServer(t, c)
+
+			response, err := http.Get(server.URL + "/status.cgi")
+			if err != nil {
+				t.Fatalf("GET /status.cgi error = %v", err)
+			}
+			defer response.Body.Close()
+
+			// Neither the session cookie, even with a custom strip list which
+			// does not name Set-Cookie, nor its echo under another header
+			// reaches the client
+			var got []string
+			for name, values := range response.Header {
+				for _, value := range values {
+					if strings.Contains(value, c.session.Get().Value) {
+						t.Errorf("%s = %q contains the session cookie", name,
+							value)
+					}
+				}
+
+				if name != "Content-Length" && name != "Date" {
+					got = append(got, name)
+				}
+			}
+
+			slices.Sort(got)
+			if !slices.Equal(got, tt.wantHeaders) {
+				t.Errorf("headers = %v, want %v", got, tt.wantHeaders)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// clientLimiterIdle is how long the rate limiter of a client IP is kept after
+// its last request, before it is evicted by the sweep.
+const clientLimiterIdle = 5 * time.Minute
+
+// Type clientLimiters holds the token bucket rate limiter of each client IP
+// making snapshot requests to a camera.
+type clientLimiters struct {
+	mutex    sync.Mutex
+	limiters map[string]*clientLimiter
+}
+
+// Type clientLimiter is the rate limiter of a single client IP, and when it was
+// last used.
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimit wraps a handler with the per-client IP and then the token bucket
+// rate limiter of the camera, responding with 429 and a Retry-After header
+// rather than forwarding requests which exceed either.
+func (c *camera) rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if conf.PerIPRate > 0 {
+			ip := clientIP(r)
+			if !c.allowRequest(w, r, c.clientLimiter(ip), "ip", ip) {
+				return
+			}
+		}
+
+		if limiter := c.rateLimiter(); limiter != nil &&
+			!c.allowRequest(w, r, limiter) {
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// rateLimiter returns the rate limiter of the camera, or nil if unlimited.
+func (c *camera) rateLimiter() *rate.Limiter {
+	c.upstreamMutex.RLock()
+	defer c.upstreamMutex.RUnlock()
+
+	return c.limiter
+}
+
+// allowRequest takes a token from a rate limiter for a request, responding
+// with 429 and a Retry-After header if none is available.
+// It returns whether the request can be handled.
+func (c *camera) allowRequest(w http.ResponseWriter, r *http.Request,
+	limiter *rate.Limiter, args ...any) bool {
+	reservation := limiter.Reserve()
+
+	// Give back a token which is not available yet, reporting how long until
+	// it is in whole seconds
+	if delay := reservation.Delay(); delay > 0 {
+		reservation.Cancel()
+
+		c.logger("ratelimit").WarnContext(r.Context(), "Rate limit exceeded",
+			append([]any{"remote", r.RemoteAddr, "path", r.URL.Path},
+				args...)...)
+		w.Header().Set("Retry-After",
+			strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests),
+			http.StatusTooManyRequests)
+		return false
+	}
+
+	return true
+}
+
+// clientLimiter retrieves the rate limiter of a client IP, creating it if the
+// client has no recent requests.
+func (c *camera) clientLimiter(ip string) *rate.Limiter {
+	l := &c.clientLimiters
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.limiters == nil {
+		l.limiters = map[string]*clientLimiter{}
+	}
+
+	client, ok := l.limiters[ip]
+	if !ok {
+		client = &clientLimiter{
+			limiter: rate.NewLimiter(rate.Limit(conf.PerIPRate),
+				conf.PerIPBurst),
+		}
+		l.limiters[ip] = client
+	}
+
+	client.lastSeen = time.Now()
+
+	return client.limiter
+}
+
+// sweepClientLimiters runs every tick and evicts the rate limiters of client
+// IPs without a request in the idle period, so that the limiters of clients
+// which have gone away do not accumulate.
+func (c *camera) sweepClientLimiters(ticker *time.Ticker) {
+	for range ticker.C {
+		l := &c.clientLimiters
+		l.mutex.Lock()
+		for ip, client := range l.limiters {
+			if time.Since(client.lastSeen) > clientLimiterIdle {
+				delete(l.limiters, ip)
+			}
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// clientIP determines the IP of the client making a request, which is the
+// address the request was received from, or the last address in its
+// X-Forwarded-For header, as added by the reverse proxy, if proxies are
+// trusted. Proxies are not trusted by default, as any client can send the
+// header.
+func clientIP(r *http.Request) string {
+	if conf.TrustProxy {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			addrs := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip := strings.TrimSpace(addrs[len(addrs)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// errFetchesBusy indicates that a snapshot was not fetched, as the maximum
+// number of concurrent fetches from the AirCam were in flight for longer than
+// the fetch was willing to wait.
+var errFetchesBusy = errors.New("Image - Too many concurrent fetches")
+
+// acquireFetch waits for one of the concurrent fetch slots of the camera to be
+// free, for no longer than the context allows and the upstream timeout, so
+// that the AirCam is not sent more requests at once than it can handle.
+// It returns a function releasing the slot, and errFetchesBusy if no slot was
+// free in time. When concurrent fetches are unlimited, the slot only counts
+// the fetch as in flight.
+func (c *camera) acquireFetch(ctx context.Context) (func(), error) {
+	// Fetches release the slot they took even if a reload replaced the slots
+	c.upstreamMutex.RLock()
+	fetches := c.fetches
+	c.upstreamMutex.RUnlock()
+
+	if fetches == nil {
+		return c.startFetch(), nil
+	}
+
+	acquired := func() func() {
+		finish := c.startFetch()
+		return func() {
+			<-fetches
+			finish()
+		}
+	}
+
+	select {
+	case fetches <- struct{}{}:
+		return acquired(), nil
+	default:
+	}
+
+	timer := time.NewTimer(conf.Timeout)
+	defer timer.Stop()
+
+	select {
+	case fetches <- struct{}{}:
+		return acquired(), nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return nil, ctx.Err()
+		}
+
+		return nil, errFetchesBusy
+	case <-timer.C:
+		return nil, errFetchesBusy
+	}
+}
+
+// startFetch counts a fetch as in flight, recording the progress for the
+// watchdog.
+// It returns a function counting the fetch as finished.
+func (c *camera) startFetch() func() {
+	inFlight := fetchesInFlight.WithLabelValues(c.label())
+	inFlight.Inc()
+	c.fetching.Add(1)
+	c.fetchProgress.Store(time.Now().UnixNano())
+
+	return func() {
+		c.fetchProgress.Store(time.Now().UnixNano())
+		c.fetching.Add(-1)
+		inFlight.Dec()
+	}
+}
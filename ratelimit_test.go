@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newConfigCameras loads the cameras defined by a JSON config file, with any
+// other environment variables.
+// It returns the cameras, and any errors encountered loading them.
+func newConfigCameras(t *testing.T, data string,
+	env map[string]string) ([]*camera, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "cameras.json")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	merged := map[string]string{"SNAPSHOT_CONFIG": path}
+	for name, value := range env {
+		merged[name] = value
+	}
+	setTestConfig(t, merged)
+
+	return newCameras()
+}
+
+func TestPerCameraLimits(t *testing.T) {
+	cameras, err := newConfigCameras(t, `[
+		{"name": "ptz", "url": "http://ptz", "username": "ubnt",
+			"password": "secret", "rateLimit": 5, "rateBurst": 10,
+			"maxConcurrentFetches": 8},
+		{"name": "fixed", "url": "http://fixed", "username": "ubnt",
+			"password": "secret"},
+		{"name": "unlimited", "url": "http://unlimited", "username": "ubnt",
+			"password": "secret", "rateLimit": 0, "maxConcurrentFetches": 0}
+	]`, map[string]string{
+		"SNAPSHOT_RATE_LIMIT":             "1",
+		"SNAPSHOT_MAX_CONCURRENT_FETCHES": "1",
+	})
+	if err != nil {
+		t.Fatalf("newCameras() error = %v", err)
+	}
+
+	ptz, fixed, unlimited := cameras[0], cameras[1], cameras[2]
+
+	tests := []struct {
+		camera     *camera
+		rateLimit  float64
+		rateBurst  int
+		maxFetches int
+	}{
+		{camera: ptz, rateLimit: 5, rateBurst: 10, maxFetches: 8},
+		{camera: fixed, rateLimit: 1, rateBurst: 1, maxFetches: 1},
+	}
+
+	for _, tt := range tests {
+		c := tt.camera
+		if c.limiter == nil || float64(c.limiter.Limit()) != tt.rateLimit ||
+			c.limiter.Burst() != tt.rateBurst {
+			t.Errorf("camera %s limiter = %v, want %v with burst %d", c.Name,
+				c.limiter, tt.rateLimit, tt.rateBurst)
+		}
+
+		if cap(c.fetches) != tt.maxFetches {
+			t.Errorf("camera %s fetch slots = %d, want %d", c.Name,
+				cap(c.fetches), tt.maxFetches)
+		}
+
+		c.recordLimits()
+		if got := testutil.ToFloat64(
+			requestRateLimit.WithLabelValues(c.Name)); got != tt.rateLimit {
+			t.Errorf("camera %s rate limit gauge = %v, want %v", c.Name, got,
+				tt.rateLimit)
+		}
+		if got := testutil.ToFloat64(
+			fetchLimit.WithLabelValues(c.Name)); got != float64(tt.maxFetches) {
+			t.Errorf("camera %s fetch limit gauge = %v, want %d", c.Name, got,
+				tt.maxFetches)
+		}
+	}
+
+	if unlimited.limiter != nil || unlimited.fetches != nil {
+		t.Errorf("camera unlimited has limiter %v and fetch slots %d, want "+
+			"none", unlimited.limiter, cap(unlimited.fetches))
+	}
+
+	// A camera with every fetch slot taken does not hold up another camera
+	releaseFixed, err := fixed.acquireFetch(context.Background())
+	if err != nil {
+		t.Fatalf("acquireFetch() error = %v", err)
+	}
+	defer releaseFixed()
+
+	releasePTZ, err := ptz.acquireFetch(context.Background())
+	if err != nil {
+		t.Fatalf("acquireFetch() error = %v, want a free slot", err)
+	}
+
+	inFlight := fetchesInFlight.WithLabelValues(ptz.Name)
+	if got := testutil.ToFloat64(inFlight); got != 1 {
+		t.Errorf("fetches in flight = %v, want 1", got)
+	}
+
+	releasePTZ()
+	if got := testutil.ToFloat64(inFlight); got != 0 {
+		t.Errorf("fetches in flight after release = %v, want 0", got)
+	}
+}
+
+func TestPerCameraLimitsValidation(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides string
+	}{
+		{name: "rateLimit", overrides: `"rateLimit": -1`},
+		{name: "rateBurst", overrides: `"rateBurst": 0`},
+		{name: "maxConcurrentFetches", overrides: `"maxConcurrentFetches": -1`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newConfigCameras(t, `[{"name": "front", `+
+				`"url": "http://front", "username": "ubnt", `+
+				`"password": "secret", `+tt.overrides+`}]`, nil)
+
+			if err == nil || !strings.Contains(err.Error(), "invalid "+tt.name) {
+				t.Errorf("newCameras() error = %v, want invalid %s", err, tt.name)
+			}
+		})
+	}
+}
+
+func TestPerClientIPRateLimit(t *testing.T) {
+	type clientRequest struct {
+		remote    string
+		forwarded string
+	}
+
+	tests := []struct {
+		name       string
+		trustProxy string
+		requests   []clientRequest
+		want       []int
+	}{
+		{
+			name: "independent buckets",
+			requests: []clientRequest{
+				{remote: "192.0.2.1:5000"}, {remote: "192.0.2.2:5000"},
+				{remote: "192.0.2.1:5001"}, {remote: "192.0.2.2:5001"},
+			},
+			want: []int{http.StatusOK, http.StatusOK,
+				http.StatusTooManyRequests, http.StatusTooManyRequests},
+		},
+		{
+			name: "forwarded ignored",
+			requests: []clientRequest{
+				{remote: "198.51.100.1:5000", forwarded: "192.0.2.1"},
+				{remote: "198.51.100.1:5001", forwarded: "192.0.2.2"},
+			},
+			want: []int{http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:       "forwarded trusted",
+			trustProxy: "true",
+			requests: []clientRequest{
+				{remote: "198.51.100.1:5000", forwarded: "192.0.2.1"},
+				{remote: "198.51.100.1:5001", forwarded: "192.0.2.2"},
+				{remote: "198.51.100.1:5002", forwarded: "192.0.2.1"},
+			},
+			want: []int{http.StatusOK, http.StatusOK,
+				http.StatusTooManyRequests},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, map[string]string{
+				"SNAPSHOT_URL":         "http://aircam.local",
+				"SNAPSHOT_USERNAME":    "ubnt",
+				"SNAPSHOT_PASSWORD":    "secret",
+				"SNAPSHOT_RATE_LIMIT":  "0",
+				"SNAPSHOT_PER_IP_RATE": "0.001",
+				"SNAPSHOT_TRUST_PROXY": tt.trustProxy,
+			})
+
+			cameras, err := newCameras()
+			if err != nil {
+				t.Fatalf("newCameras() error = %v", err)
+			}
+
+			handler := cameras[0].rateLimit(func(w http.ResponseWriter,
+				r *http.Request) {
+			})
+
+			for i, request := range tt.requests {
+				r := httptest.NewRequest(http.MethodGet, "/snapshot.cgi", nil)
+				r.RemoteAddr = request.remote
+				if request.forwarded != "" {
+					r.Header.Set("X-Forwarded-For", request.forwarded)
+				}
+
+				recorder := httptest.NewRecorder()
+				handler(recorder, r)
+				if recorder.Code != tt.want[i] {
+					t.Errorf("request %d from %s (%s) status = %d, want %d", i,
+						request.remote, request.forwarded, recorder.Code,
+						tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reloadMutex serializes reloads of the cameras and of the TLS configuration,
+// which both replace the HTTP clients of the cameras.
+var reloadMutex sync.Mutex
+
+// Type tlsReload represents the JSON body returned by the /admin/reload-tls
+// route, with the expiry of the reloaded certificates.
+type tlsReload struct {
+	ClientCertNotAfter *time.Time  `json:"clientCertNotAfter,omitempty"`
+	Cameras            []cameraTLS `json:"cameras"`
+}
+
+// Type cameraTLS represents the reloaded CA file of a single camera in the
+// JSON body returned by the /admin/reload-tls route.
+type cameraTLS struct {
+	Name       string     `json:"name"`
+	CAFile     string     `json:"caFile,omitempty"`
+	CANotAfter *time.Time `json:"caNotAfter,omitempty"`
+}
+
+// handleHangups runs every time the process receives SIGHUP, reopening the log
+// file if any, as sent by logrotate after rotating it, and reloading the
+// cameras.
+func handleHangups(file *logFile) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	for range hangup {
+		if file != nil {
+			if err := file.Reopen(); err != nil {
+				logger("log").Error("Error reopening log file", "path",
+					file.path, "error", err)
+			} else {
+				logger("log").Info("Reopened log file", "path", file.path)
+			}
+		}
+
+		reloadCameras()
+	}
+}
+
+// reloadCameras loads the configuration and cameras again, such as after the
+// SNAPSHOT_CONFIG file was edited, and applies any changed URLs, credentials,
+// TLS settings, and limits to the running cameras without restarting. Each
+// camera with a changed URL, credentials, or TLS settings logs in with them
+// first, and keeps its current ones and session if the login fails, while no
+// camera changes if the configuration is invalid. Cameras are matched by
+// name, and adding or removing cameras requires a restart, as does any other
+// setting.
+func reloadCameras() {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	logger("reload").Info("Reloading cameras")
+
+	// Load the configuration again, so that a file it names which is no longer
+	// valid rejects the reload rather than failing on the next restart. The
+	// fallback image is the only setting read from a file other than the
+	// cameras, and like the other settings it applies on restart.
+	loaded, err := loadConfig(os.Getenv)
+	if err != nil {
+		logger("reload").Error("Reload failed, keeping current cameras",
+			"error", err)
+		return
+	}
+
+	if !bytes.Equal(loaded.FallbackImage, conf.FallbackImage) {
+		logger("reload").Warn("Fallback image changed, restart to apply it")
+	}
+
+	reloaded, err := newCameras()
+	if err != nil {
+		logger("reload").Error("Reload failed, keeping current cameras",
+			"error", err)
+		return
+	}
+
+	byName := map[string]*camera{}
+	for _, next := range reloaded {
+		byName[next.Name] = next
+	}
+
+	for _, c := range cameras {
+		next, ok := byName[c.Name]
+		if !ok {
+			c.logger("reload").Warn("Camera removed, restart to stop serving it")
+			continue
+		}
+
+		delete(byName, c.Name)
+		c.reload(next)
+	}
+
+	for _, next := range byName {
+		next.logger("reload").Warn("Camera added, restart to serve it")
+	}
+}
+
+// reload applies the settings of a reloaded definition of the camera, if they
+// changed. Its limits apply immediately, and its URLs, credentials, and TLS
+// settings once a login with them succeeds, replacing the session with the new
+// one. The RTSP source does not login.
+func (c *camera) reload(next *camera) {
+	c.reloadLimits(next)
+
+	c.upstreamMutex.RLock()
+	changed := c.URL != next.URL || c.LoginURL != next.LoginURL ||
+		c.RTSPURL != next.RTSPURL || c.Username != next.Username ||
+		c.Password != next.Password || c.IgnoreSSL != next.IgnoreSSL ||
+		c.CAFile != next.CAFile
+	c.upstreamMutex.RUnlock()
+
+	if !changed {
+		return
+	}
+
+	if next.IgnoreSSL {
+		c.logger("reload").Warn(
+			"INSECURE: TLS certificate verification is disabled", "url",
+			next.URL)
+	}
+
+	sessionCookie := c.session.Get()
+	if conf.Source == sourceHTTP {
+		var err error
+		sessionCookie, err = next.login(context.Background())
+		if err != nil {
+			c.logger("reload").Error("Login with reloaded settings failed, "+
+				"keeping current settings", "error", err)
+			return
+		}
+	}
+
+	c.upstreamMutex.Lock()
+	c.URL = next.URL
+	c.LoginURL = next.LoginURL
+	c.RTSPURL = next.RTSPURL
+	c.Username = next.Username
+	c.Password = next.Password
+	c.IgnoreSSL = next.IgnoreSSL
+	c.CAFile = next.CAFile
+	c.baseURLs = next.baseURLs
+	c.baseURL = next.baseURL
+	c.urlSessions = nil
+	c.loginBaseURL = next.loginBaseURL
+	c.client = next.client
+	c.upstreamMutex.Unlock()
+
+	c.session.Set(sessionCookie)
+
+	// Close any RTSP session, so that the next frame is taken from the stream
+	// with the reloaded settings
+	c.rtsp.close()
+
+	c.logger("reload").Info("Applied reloaded settings")
+}
+
+// reloadLimits applies the rate limit, burst, and maximum concurrent fetches of
+// a reloaded definition of the camera, if they changed. The rate limiter is
+// only replaced if the rate limit or burst changed, so that it keeps its
+// tokens, and fetches in flight release their slot in the previous slots.
+func (c *camera) reloadLimits(next *camera) {
+	rateLimit, rateBurst, maxFetches := c.limits()
+	nextLimit, nextBurst, nextFetches := next.limits()
+	if rateLimit == nextLimit && rateBurst == nextBurst &&
+		maxFetches == nextFetches {
+		return
+	}
+
+	c.upstreamMutex.Lock()
+	c.RateLimit = next.RateLimit
+	c.RateBurst = next.RateBurst
+	c.MaxConcurrentFetches = next.MaxConcurrentFetches
+	if rateLimit != nextLimit || rateBurst != nextBurst {
+		c.limiter = next.limiter
+	}
+	if maxFetches != nextFetches {
+		c.fetches = next.fetches
+	}
+	c.upstreamMutex.Unlock()
+
+	c.recordLimits()
+
+	c.logger("reload").Info("Applied reloaded limits", "rateLimit", nextLimit,
+		"rateBurst", nextBurst, "maxConcurrentFetches", nextFetches)
+}
+
+// reloadTLS reads the client certificate and the CA file of every camera again,
+// such as after rotating them, and replaces the HTTP client of each camera with
+// one using them. Every file is validated before any client is replaced, and
+// the current clients are kept if any is invalid. Requests in progress complete
+// with the previous client.
+// It returns the expiry of the reloaded certificates, and any errors
+// encountered loading them.
+func reloadTLS() (tlsReload, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	result := tlsReload{Cameras: []cameraTLS{}}
+
+	certificates := conf.clientCertificates
+	if conf.ClientCert != "" {
+		certificate, err := tls.LoadX509KeyPair(conf.ClientCert, conf.ClientKey)
+		if err != nil {
+			return result, fmt.Errorf("TLS - Invalid certificate and key in "+
+				"SNAPSHOT_CLIENT_CERT and SNAPSHOT_CLIENT_KEY: %s", err)
+		}
+
+		if time.Now().After(certificate.Leaf.NotAfter) {
+			return result, fmt.Errorf("TLS - Certificate in SNAPSHOT_CLIENT_CERT "+
+				"expired at %s", certificate.Leaf.NotAfter.Format(time.RFC3339))
+		}
+
+		certificates = []tls.Certificate{certificate}
+		result.ClientCertNotAfter = &certificate.Leaf.NotAfter
+	}
+
+	// Load the CA file of every camera before replacing any client
+	ignoreSSL := make([]bool, len(cameras))
+	roots := make([]*x509.CertPool, len(cameras))
+	for i, c := range cameras {
+		c.upstreamMutex.RLock()
+		caFile := c.CAFile
+		ignoreSSL[i] = c.IgnoreSSL
+		c.upstreamMutex.RUnlock()
+
+		status := cameraTLS{Name: c.Name, CAFile: caFile}
+		if caFile != "" {
+			var notAfter time.Time
+			var err error
+			roots[i], notAfter, err = loadCAFile(caFile)
+			if err != nil {
+				return result, fmt.Errorf("TLS - Invalid CA file for camera %q: %s",
+					c.Name, err)
+			}
+
+			status.CANotAfter = &notAfter
+		}
+
+		result.Cameras = append(result.Cameras, status)
+	}
+
+	conf.clientCertificates = certificates
+
+	for i, c := range cameras {
+		client := newClient(ignoreSSL[i], roots[i])
+
+		c.upstreamMutex.Lock()
+		previous := c.client
+		c.client = client
+		c.upstreamMutex.Unlock()
+
+		if closer, ok := previous.(interface{ CloseIdleConnections() }); ok {
+			closer.CloseIdleConnections()
+		}
+
+		c.logger("reload").Info("Applied reloaded TLS configuration")
+	}
+
+	return result, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeCameraConfig writes a config file defining a single camera named front
+// for a fake AirCam, with any other fields of the camera.
+func writeCameraConfig(t *testing.T, path string, aircam *fakeAirCam,
+	fields string) {
+	t.Helper()
+
+	data := fmt.Sprintf(`[{"name": "front", "url": %q, "username": %q,
+		"password": %q%s}]`, aircam.URL, aircam.username, aircam.password,
+		fields)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadCameras(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		wantReload bool
+	}{
+		{name: "valid", wantReload: true},
+		{name: "invalid configuration", env: map[string]string{
+			"SNAPSHOT_PORT": "http",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current := newFakeAirCam(t, "ubnt", "secret")
+			replacement := newFakeAirCam(t, "ubnt", "rotated")
+
+			path := filepath.Join(t.TempDir(), "cameras.json")
+			writeCameraConfig(t, path, current, "")
+
+			t.Setenv("SNAPSHOT_CONFIG", path)
+			setTestConfig(t, map[string]string{"SNAPSHOT_CONFIG": path})
+
+			loaded, err := newCameras()
+			if err != nil {
+				t.Fatalf("newCameras() error = %v", err)
+			}
+			previous := cameras
+			cameras = loaded
+			t.Cleanup(func() { cameras = previous })
+
+			c := cameras[0]
+			sessionCookie, err := c.login(context.Background())
+			if err != nil {
+				t.Fatalf("login() error = %v", err)
+			}
+			c.session.Set(sessionCookie)
+
+			currentLimit, _, currentFetches := c.limits()
+
+			writeCameraConfig(t, path, replacement,
+				`, "rateLimit": 5, "rateBurst": 2, "maxConcurrentFetches": 7`)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			reloadCameras()
+
+			if _, _, err := c.fetchImage(context.Background(), nil); err != nil {
+				t.Fatalf("fetchImage() error = %v", err)
+			}
+
+			wantCurrent, wantReplacement := 1, 0
+			if tt.wantReload {
+				wantCurrent, wantReplacement = 0, 1
+			}
+
+			if _, snapshots := current.counts(); snapshots != wantCurrent {
+				t.Errorf("current AirCam snapshots = %d, want %d", snapshots,
+					wantCurrent)
+			}
+			if _, snapshots := replacement.counts(); snapshots != wantReplacement {
+				t.Errorf("reloaded AirCam snapshots = %d, want %d", snapshots,
+					wantReplacement)
+			}
+
+			rateLimit, rateBurst, maxFetches := c.limits()
+			wantLimit, wantBurst, wantFetches := 5.0, 2, 7
+			if !tt.wantReload {
+				wantLimit, wantBurst, wantFetches = currentLimit, 1, currentFetches
+			}
+
+			if rateLimit != wantLimit || rateBurst != wantBurst ||
+				maxFetches != wantFetches || cap(c.fetches) != wantFetches {
+				t.Errorf("limits = %v, %d, %d, want %v, %d, %d", rateLimit,
+					rateBurst, maxFetches, wantLimit, wantBurst, wantFetches)
+			}
+		})
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/pion/rtp"
+)
+
+// Snapshot sources, see SNAPSHOT_SOURCE. The HTTP source logs in to the AirCam
+// and requests its snapshot endpoint, while the RTSP source takes a frame from
+// its RTSP stream without logging in.
+const (
+	sourceHTTP = "http"
+	sourceRTSP = "rtsp"
+)
+
+// rtspIdleTimeout is how long the RTSP session of a camera is kept open after
+// a frame was last taken from it, so that a camera which is no longer
+// requested is not streamed from indefinitely.
+const rtspIdleTimeout = time.Minute
+
+// errNoVideo indicates that the RTSP stream has neither an M-JPEG nor an H.264
+// track, which are the formats frames can be taken from.
+var errNoVideo = errors.New("RTSP - Stream has no M-JPEG or H.264 track")
+
+// Type rtspSession represents the RTSP session of a camera, which is kept open
+// between snapshots and holds the most recent frame of the stream. M-JPEG
+// frames are kept as they are, while for H.264 the most recent IDR access unit
+// is kept, and only decoded once a snapshot is taken from it.
+type rtspSession struct {
+	mutex   sync.Mutex
+	running bool
+	client  *gortsplib.Client
+	stop    chan struct{}
+	err     error
+
+	// Most recent frame, and IDR access unit it was decoded from if any, of
+	// which there are none until the first arrives. The updated channel is
+	// closed, and replaced, when the first arrives or the session ends.
+	frame    []byte
+	idr      [][]byte
+	sequence int64
+	updated  chan struct{}
+	used     time.Time
+
+	// Serializes decoding IDR access units, so that concurrent snapshots
+	// decode each one once
+	decodeMutex sync.Mutex
+}
+
+// fetchRTSPFrame takes the most recent frame from the RTSP stream of the
+// camera, opening the RTSP session and waiting for the first frame if it is
+// not already open. The session is kept open for later snapshots until none
+// are taken for rtspIdleTimeout.
+// It returns a byte slice with the frame, no headers, and any errors
+// encountered opening or reading the stream.
+func (c *camera) fetchRTSPFrame(ctx context.Context) ([]byte, http.Header,
+	error) {
+	ctx, cancel := context.WithTimeout(ctx, conf.Timeout)
+	defer cancel()
+
+	s := &c.rtsp
+	waited := false
+	for {
+		s.mutex.Lock()
+
+		// A session which failed while waiting for its first frame fails the
+		// snapshot, while one which was closed is opened again
+		if !s.running && waited && s.err != nil {
+			err := s.err
+			s.mutex.Unlock()
+			return nil, nil, err
+		}
+
+		if !s.running {
+			s.running = true
+			s.err = nil
+			s.stop = make(chan struct{})
+			s.updated = make(chan struct{})
+			go c.streamRTSP(s.stop)
+		}
+
+		s.used = time.Now()
+		frame, idr, sequence, updated := s.frame, s.idr, s.sequence, s.updated
+		s.mutex.Unlock()
+
+		if frame != nil {
+			return frame, nil, nil
+		}
+
+		if idr != nil {
+			frame, err := c.decodeRTSPFrame(ctx, idr, sequence)
+			return frame, nil, err
+		}
+
+		select {
+		case <-updated:
+			waited = true
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return nil, nil, ctx.Err()
+			}
+
+			c.countUpstreamError(causeTimeout)
+			return nil, nil, fmt.Errorf(
+				"RTSP - Timed out waiting for a frame: %w", ctx.Err())
+		}
+	}
+}
+
+// streamRTSP runs the RTSP session of the camera until it fails, is idle, or
+// is stopped, then discards its frames so that the next snapshot opens it
+// again.
+func (c *camera) streamRTSP(stop chan struct{}) {
+	err := c.readRTSP(stop)
+	if err != nil {
+		c.logger("rtsp").Warn("RTSP session failed", "error", err)
+	}
+
+	s := &c.rtsp
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.running = false
+	s.client = nil
+	s.err = err
+	s.frame = nil
+	s.idr = nil
+	close(s.updated)
+}
+
+// readRTSP connects to the RTSP stream of the camera and keeps the most
+// recent frame of its M-JPEG track, or IDR access unit of its H.264 track,
+// until the session fails, no frame is taken for rtspIdleTimeout, or stop is
+// closed. The camera username and password are used unless the RTSP URL has
+// credentials of its own.
+// It returns any errors encountered reading the stream, and nil if the
+// session was closed.
+func (c *camera) readRTSP(stop chan struct{}) error {
+	c.upstreamMutex.RLock()
+	rtspURL := c.RTSPURL
+	c.upstreamMutex.RUnlock()
+
+	streamURL, err := base.ParseURL(rtspURL)
+	if err != nil {
+		return fmt.Errorf("RTSP - Invalid stream URL: %w", err)
+	}
+
+	if username, password := c.credentials(); streamURL.User == nil &&
+		username != "" {
+		streamURL.User = url.UserPassword(username, password)
+	}
+
+	// Log the events of the long-lived session with the other logs, rather
+	// than the standard logger
+	rtspLogger := c.logger("rtsp")
+	client := &gortsplib.Client{
+		ReadTimeout:  conf.Timeout,
+		WriteTimeout: conf.Timeout,
+		OnTransportSwitch: func(err error) {
+			rtspLogger.Info("Switching RTSP transport", "reason", err)
+		},
+		OnPacketLost: func(err error) {
+			rtspLogger.Debug("RTSP packets lost", "error", err)
+		},
+		OnDecodeError: func(err error) {
+			rtspLogger.Debug("Error decoding RTSP packet", "error", err)
+		},
+	}
+	if err := client.Start(streamURL.Scheme, streamURL.Host); err != nil {
+		c.countUpstreamError(transportCause(err))
+		return fmt.Errorf("RTSP - Error connecting: %w", err)
+	}
+	defer client.Close()
+
+	s := &c.rtsp
+	s.mutex.Lock()
+	s.client = client
+	s.mutex.Unlock()
+
+	description, _, err := client.Describe(streamURL)
+	if err != nil {
+		c.countUpstreamError(transportCause(err))
+		return fmt.Errorf("RTSP - Error describing stream: %w", err)
+	}
+
+	// Keep the frames reassembled from the RTP packets of the M-JPEG track if
+	// any, otherwise the IDR access units of the H.264 track, ignoring packets
+	// received before the start of a frame
+	var mjpeg *format.MJPEG
+	var h264Format *format.H264
+	var track format.Format
+	var onPacket func(*rtp.Packet)
+	media := description.FindFormat(&mjpeg)
+	if media != nil {
+		decoder, err := mjpeg.CreateDecoder()
+		if err != nil {
+			return fmt.Errorf("RTSP - Error creating decoder: %w", err)
+		}
+
+		track = mjpeg
+		onPacket = func(packet *rtp.Packet) {
+			if frame, err := decoder.Decode(packet); err == nil {
+				s.store(client, frame, nil)
+			}
+		}
+	} else if media = description.FindFormat(&h264Format); media != nil {
+		decoder, err := h264Format.CreateDecoder()
+		if err != nil {
+			return fmt.Errorf("RTSP - Error creating decoder: %w", err)
+		}
+
+		track = h264Format
+		onPacket = func(packet *rtp.Packet) {
+			accessUnit, err := decoder.Decode(packet)
+			if err == nil && h264.IDRPresent(accessUnit) {
+				s.store(client, nil, withParameterSets(accessUnit, h264Format))
+			}
+		}
+	} else {
+		return errNoVideo
+	}
+
+	if _, err := client.Setup(description.BaseURL, media, 0, 0); err != nil {
+		c.countUpstreamError(transportCause(err))
+		return fmt.Errorf("RTSP - Error setting up stream: %w", err)
+	}
+
+	client.OnPacketRTP(media, track, onPacket)
+
+	if _, err := client.Play(nil); err != nil {
+		c.countUpstreamError(transportCause(err))
+		return fmt.Errorf("RTSP - Error playing stream: %w", err)
+	}
+
+	failed := make(chan error, 1)
+	go func() { failed <- client.Wait() }()
+
+	idle := time.NewTicker(rtspIdleTimeout / 4)
+	defer idle.Stop()
+
+	for {
+		select {
+		case err := <-failed:
+			c.countUpstreamError(transportCause(err))
+			return fmt.Errorf("RTSP - Error reading stream: %w", err)
+		case <-stop:
+			return nil
+		case <-idle.C:
+			s.mutex.Lock()
+			used := s.used
+			s.mutex.Unlock()
+
+			if time.Since(used) > rtspIdleTimeout {
+				rtspLogger.Debug("Closing idle RTSP session")
+				return nil
+			}
+		}
+	}
+}
+
+// store keeps the most recent frame or IDR access unit of an RTSP session,
+// unless the session has since ended, waking any snapshots waiting for the
+// first one.
+func (s *rtspSession) store(client *gortsplib.Client, frame []byte,
+	idr [][]byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.client != client {
+		return
+	}
+
+	if s.frame == nil && s.idr == nil {
+		close(s.updated)
+		s.updated = make(chan struct{})
+	}
+
+	s.frame = frame
+	s.idr = idr
+	s.sequence++
+}
+
+// close closes the RTSP session of the camera, if it is open, such as after
+// its settings were reloaded, so that the next snapshot opens it again.
+func (s *rtspSession) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.running && s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+// decodeRTSPFrame decodes an IDR access unit of the RTSP session to a JPEG
+// frame, keeping the frame for later snapshots until the next IDR access
+// unit arrives.
+// It returns a byte slice with the frame, and any errors encountered decoding
+// it.
+func (c *camera) decodeRTSPFrame(ctx context.Context, idr [][]byte,
+	sequence int64) ([]byte, error) {
+	s := &c.rtsp
+	s.decodeMutex.Lock()
+	defer s.decodeMutex.Unlock()
+
+	// Another snapshot may have decoded the access unit while this one waited
+	s.mutex.Lock()
+	if s.sequence == sequence && s.frame != nil {
+		frame := s.frame
+		s.mutex.Unlock()
+		return frame, nil
+	}
+	s.mutex.Unlock()
+
+	frame, err := decodeH264(ctx, idr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	if s.sequence == sequence {
+		s.frame = frame
+	}
+	s.mutex.Unlock()
+
+	return frame, nil
+}
+
+// decodeH264 decodes an H.264 IDR access unit to a JPEG image with the ffmpeg
+// command, see SNAPSHOT_FFMPEG, as it can be decoded on its own without any
+// earlier frames.
+// It returns a byte slice with the image, and any errors encountered decoding
+// it.
+func decodeH264(ctx context.Context, accessUnit [][]byte) ([]byte, error) {
+	data, err := h264.AnnexBMarshal(accessUnit)
+	if err != nil {
+		return nil, fmt.Errorf("RTSP - Invalid H.264 access unit: %w", err)
+	}
+
+	command := exec.CommandContext(ctx, conf.FFmpeg, "-hide_banner",
+		"-loglevel", "error", "-f", "h264", "-i", "pipe:0", "-frames:v", "1",
+		"-f", "image2pipe", "-c:v", "mjpeg", "pipe:1")
+	command.Stdin = bytes.NewReader(data)
+
+	var stderr bytes.Buffer
+	command.Stderr = &stderr
+
+	frame, err := command.Output()
+	if err != nil {
+		return nil, fmt.Errorf("RTSP - Error decoding H.264 frame: %w: %s", err,
+			bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	if !bytes.HasPrefix(frame, jpegSOI) {
+		return nil, errors.New("RTSP - Decoded H.264 frame is not a JPEG image")
+	}
+
+	return frame, nil
+}
+
+// withParameterSets adds the SPS and PPS of an H.264 track from the stream
+// description to an access unit which does not carry its own, as cameras
+// often only send them out of band, and the access unit can not be decoded
+// without them.
+// It returns the access unit.
+func withParameterSets(accessUnit [][]byte, track *format.H264) [][]byte {
+	for _, nalu := range accessUnit {
+		if len(nalu) > 0 && h264.NALUType(nalu[0]&0x1f) == h264.NALUTypeSPS {
+			return accessUnit
+		}
+	}
+
+	sps, pps := track.SafeParams()
+	if sps == nil || pps == nil {
+		return accessUnit
+	}
+
+	return append([][]byte{sps, pps}, accessUnit...)
+}
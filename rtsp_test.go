@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+)
+
+// Parameter sets and IDR slice of the H.264 stream of the fake RTSP server,
+// which are never decoded, as the fake ffmpeg only records them
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1f, 0xd9, 0x00, 0x78, 0x02, 0x27,
+		0xe5, 0x84, 0x00, 0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00,
+		0xf0, 0x3c, 0x60, 0xc9, 0x20}
+	testPPS = []byte{0x68, 0xcb, 0x83, 0xcb, 0x20}
+	testIDR = []byte{0x65, 0x88, 0x84, 0x00, 0x33, 0xff}
+)
+
+// Type fakeRTSPServer is an RTSP server streaming an H.264 track, like the
+// AirCam, which sends its parameter sets out of band in the stream
+// description and an IDR frame every few milliseconds.
+type fakeRTSPServer struct {
+	server *gortsplib.Server
+	stream *gortsplib.ServerStream
+	URL    string
+
+	mutex     sync.Mutex
+	describes int
+}
+
+// newFakeRTSPServer starts a fake RTSP server, which is closed when the test
+// ends.
+func newFakeRTSPServer(t *testing.T) *fakeRTSPServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	s := &fakeRTSPServer{URL: "rtsp://" + address + "/live"}
+	s.server = &gortsplib.Server{Handler: s, RTSPAddress: address}
+	if err := s.server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.server.Close)
+
+	track := &format.H264{PayloadTyp: 96, SPS: testSPS, PPS: testPPS,
+		PacketizationMode: 1}
+	media := &description.Media{Type: description.MediaTypeVideo,
+		Formats: []format.Format{track}}
+	s.stream = gortsplib.NewServerStream(s.server,
+		&description.Session{Medias: []*description.Media{media}})
+	t.Cleanup(s.stream.Close)
+
+	encoder, err := track.CreateEncoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+
+		for timestamp := uint32(0); ; timestamp += 900 {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			packets, err := encoder.Encode([][]byte{testIDR})
+			if err != nil {
+				return
+			}
+
+			for _, packet := range packets {
+				packet.Timestamp = timestamp
+				s.stream.WritePacketRTP(media, packet)
+			}
+		}
+	}()
+
+	return s
+}
+
+// OnDescribe counts the DESCRIBE requests, and describes the stream.
+func (s *fakeRTSPServer) OnDescribe(
+	_ *gortsplib.ServerHandlerOnDescribeCtx) (*base.Response,
+	*gortsplib.ServerStream, error) {
+	s.mutex.Lock()
+	s.describes++
+	s.mutex.Unlock()
+
+	return &base.Response{StatusCode: base.StatusOK}, s.stream, nil
+}
+
+// OnSetup sets up the stream.
+func (s *fakeRTSPServer) OnSetup(
+	_ *gortsplib.ServerHandlerOnSetupCtx) (*base.Response,
+	*gortsplib.ServerStream, error) {
+	return &base.Response{StatusCode: base.StatusOK}, s.stream, nil
+}
+
+// OnPlay plays the stream.
+func (s *fakeRTSPServer) OnPlay(
+	_ *gortsplib.ServerHandlerOnPlayCtx) (*base.Response, error) {
+	return &base.Response{StatusCode: base.StatusOK}, nil
+}
+
+// writeFakeFFmpeg writes a script standing in for ffmpeg, which records the
+// H.264 stream it reads and writes testJPEG as the decoded frame.
+// It returns the path of the script, and of the recorded stream.
+func writeFakeFFmpeg(t *testing.T) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	frame := filepath.Join(dir, "frame.jpg")
+	if err := os.WriteFile(frame, testJPEG, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	input := filepath.Join(dir, "input.h264")
+	script := filepath.Join(dir, "ffmpeg")
+	data := fmt.Sprintf("#!/bin/sh\ncat > %q\ncat %q\n", input, frame)
+	if err := os.WriteFile(script, []byte(data), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	return script, input
+}
+
+func TestRTSPFrameFromH264(t *testing.T) {
+	server := newFakeRTSPServer(t)
+	ffmpeg, input := writeFakeFFmpeg(t)
+
+	setTestConfig(t, map[string]string{
+		"SNAPSHOT_SOURCE":   sourceRTSP,
+		"SNAPSHOT_RTSP_URL": server.URL,
+		"SNAPSHOT_USERNAME": "ubnt",
+		"SNAPSHOT_PASSWORD": "secret",
+		"SNAPSHOT_FFMPEG":   ffmpeg,
+	})
+
+	cameras, err := newCameras()
+	if err != nil {
+		t.Fatalf("newCameras() error = %v", err)
+	}
+	c := cameras[0]
+	t.Cleanup(c.rtsp.close)
+
+	for range 3 {
+		frame, _, err := c.fetchRTSPFrame(context.Background())
+		if err != nil {
+			t.Fatalf("fetchRTSPFrame() error = %v", err)
+		}
+
+		if !bytes.Equal(frame, testJPEG) {
+			t.Errorf("fetchRTSPFrame() = %x, want %x", frame, testJPEG)
+		}
+	}
+
+	server.mutex.Lock()
+	describes := server.describes
+	server.mutex.Unlock()
+
+	if describes != 1 {
+		t.Errorf("DESCRIBE requests = %d, want 1 for a session kept open",
+			describes)
+	}
+
+	// The IDR frame is decoded with the parameter sets from the description
+	want, err := h264.AnnexBMarshal([][]byte{testSPS, testPPS, testIDR})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("ffmpeg input = %x, want %x", got, want)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// saveTimeFormat is the layout of the timestamped file names of saved
+// snapshots, avoiding colons so that the names are valid on every filesystem.
+const saveTimeFormat = "2006-01-02T15-04-05"
+
+// saveSnapshots fetches a frame from the camera every save interval and writes
+// it to the save directory, under a subdirectory named after the camera when
+// multiple cameras are configured. Failures are logged rather than fatal, so
+// that a full disk does not stop the server.
+func (c *camera) saveSnapshots(ticker *time.Ticker) {
+	dir := filepath.Join(conf.SaveDir, c.Name)
+
+	for now := range ticker.C {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			c.logger("save").Error("Error creating save directory", "dir", dir,
+				"error", err)
+			continue
+		}
+
+		f, err := c.getFrame(context.Background(), nil)
+		if err != nil {
+			continue
+		}
+
+		path := filepath.Join(dir, now.Format(saveTimeFormat)+".jpg")
+		if err := os.WriteFile(path, f.image, 0644); err != nil {
+			c.logger("save").Error("Error saving snapshot", "path", path,
+				"error", err)
+			continue
+		}
+
+		c.logger("save").Debug("Saved snapshot", "path", path)
+	}
+}
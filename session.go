@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Type session holds the session cookie of a camera, which is read by
+// concurrent handlers and replaced by logging in again when it expires.
+type session struct {
+	mutex  sync.RWMutex
+	cookie *http.Cookie
+
+	// Time at which the current session cookie was obtained
+	obtained time.Time
+
+	// Time of the most recent failed login, zero if the last login succeeded
+	failed time.Time
+
+	// Function performing the login process for the camera
+	login func(ctx context.Context) (*http.Cookie, error)
+}
+
+// Get retrieves the current session cookie.
+func (s *session) Get() *http.Cookie {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.cookie
+}
+
+// Current retrieves the current session cookie, logging in first if the camera
+// has no session, such as after its login failed at startup, or if the session
+// is older than SNAPSHOT_SESSION_MAX_AGE. Unlike the session refresh, the
+// maximum age is a hard cap, so an expired session is never used even if
+// logging in again fails.
+// It returns the session cookie, and an error wrapping ErrNotLoggedIn if the
+// login failed.
+func (s *session) Current(ctx context.Context) (*http.Cookie, error) {
+	s.mutex.RLock()
+	cookie, obtained := s.cookie, s.obtained
+	s.mutex.RUnlock()
+
+	if cookie != nil && (conf.SessionMaxAge == 0 ||
+		time.Since(obtained) < conf.SessionMaxAge) {
+		return cookie, nil
+	}
+
+	cookie, err := s.RefreshExpired(ctx, cookie)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNotLoggedIn, err)
+	}
+
+	return cookie, nil
+}
+
+// Set replaces the current session cookie, such as after the initial login.
+func (s *session) Set(cookie *http.Cookie) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.cookie = cookie
+	s.obtained = time.Now()
+}
+
+// Swap replaces the current session cookie with the one returned by a function
+// of it, under the write lock, such as when switching to the session of
+// another URL of the camera, unless the function reports that it kept the
+// current one. The replacement is a session of its own, so any failed login of
+// the current one no longer applies, even if neither has a cookie.
+func (s *session) Swap(swap func(current *http.Cookie) (*http.Cookie, bool)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cookie, swapped := swap(s.cookie)
+	if !swapped {
+		return
+	}
+
+	s.cookie = cookie
+	s.obtained = time.Now()
+	s.failed = time.Time{}
+}
+
+// SetObtained replaces the time at which the current session cookie was
+// obtained, such as for a session resumed after a restart.
+func (s *session) SetObtained(obtained time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.obtained = obtained
+}
+
+// Obtained retrieves the time at which the current session cookie was obtained,
+// which is zero if there is none.
+func (s *session) Obtained() time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.obtained
+}
+
+// Failed retrieves the time of the most recent failed login, which is zero if
+// the last login succeeded.
+func (s *session) Failed() time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.failed
+}
+
+// Refresh logs in again and replaces the current session cookie. The login is
+// performed under the write lock, so handlers wait for the new cookie rather
+// than using the old one.
+// It returns any errors encountered during login, keeping the current cookie.
+func (s *session) Refresh(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.refresh(ctx)
+}
+
+// RefreshExpired refreshes the session if the expired cookie is still the
+// current one. If another handler has already replaced the expired cookie, the
+// login is skipped so that concurrent handlers share a single refresh. Within
+// the re-login cooldown of a failed login, the login is also skipped, so that
+// every request to a failing camera does not attempt its own login.
+// It returns the current session cookie, and any errors encountered during
+// login.
+func (s *session) RefreshExpired(ctx context.Context,
+	expired *http.Cookie) (*http.Cookie, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.cookie != expired {
+		return s.cookie, nil
+	}
+
+	if !s.failed.IsZero() && time.Since(s.failed) < conf.ReloginCooldown {
+		return nil, ErrLoginCooldown
+	}
+
+	if err := s.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	return s.cookie, nil
+}
+
+// refresh logs in and replaces the current session cookie, and must be called
+// with the write lock held.
+func (s *session) refresh(ctx context.Context) error {
+	cookie, err := s.login(ctx)
+	if err != nil {
+		s.failed = time.Now()
+		return err
+	}
+
+	s.cookie = cookie
+	s.obtained = time.Now()
+	s.failed = time.Time{}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentSessionRefresh fetches from many goroutines at once after the
+// session expired, and is meant to be run with -race to catch unguarded access
+// to the session cookie.
+func TestConcurrentSessionRefresh(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, nil)
+
+	sessionCookie, err := c.login(context.Background())
+	if err != nil {
+		t.Fatalf("login() error = %v", err)
+	}
+	c.session.Set(sessionCookie)
+
+	aircam.expireSessions()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for range 20 {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			_, _, err := c.fetchImage(context.Background(), nil)
+			errs <- err
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			c.session.Get()
+			c.session.Obtained()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("fetchImage() error = %v", err)
+		}
+	}
+
+	// Every fetch finding the expired session shares a single login
+	if logins, snapshots := aircam.counts(); logins != 2 || snapshots < 20 {
+		t.Errorf("logins, snapshots = %d, %d, want 2, at least 20", logins,
+			snapshots)
+	}
+
+	if c.session.Get() == sessionCookie {
+		t.Error("session cookie was not replaced after expiring")
+	}
+}
+
+func TestReloginCooldown(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, map[string]string{
+		"SNAPSHOT_FETCH_RETRIES":    "0",
+		"SNAPSHOT_RELOGIN_COOLDOWN": "10s",
+	})
+	server := newTestServer(t, c)
+
+	// Reject the credentials of the camera, as if those of the AirCam were
+	// rotated, so that logging in again fails
+	c.Password = "rotated"
+	aircam.expireSessions()
+
+	for i := range 5 {
+		response, err := http.Get(server.URL + "/snapshot.cgi")
+		if err != nil {
+			t.Fatalf("GET /snapshot.cgi error = %v", err)
+		}
+		response.Body.Close()
+
+		// Only the first request attempts to log in, and fails with the
+		// rejected credentials, while the rest fail fast
+		want := http.StatusServiceUnavailable
+		if i == 0 {
+			want = http.StatusBadGateway
+		}
+
+		if response.StatusCode != want {
+			t.Errorf("GET /snapshot.cgi %d status = %d, want %d", i,
+				response.StatusCode, want)
+		}
+	}
+
+	aircam.mutex.Lock()
+	attempts := aircam.attempts
+	aircam.mutex.Unlock()
+
+	// The initial login, and a single login again within the cooldown
+	if attempts != 2 {
+		t.Errorf("login attempts = %d, want 2", attempts)
+	}
+}
+
+func TestSessionMaxAge(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	c := newTestCamera(t, aircam, map[string]string{
+		"SNAPSHOT_SESSION_MAX_AGE": "100ms",
+		"SNAPSHOT_FETCH_RETRIES":   "0",
+	})
+
+	sessionCookie, err := c.login(context.Background())
+	if err != nil {
+		t.Fatalf("login() error = %v", err)
+	}
+	c.session.Set(sessionCookie)
+
+	if _, _, err := c.fetchImage(context.Background(), nil); err != nil {
+		t.Fatalf("fetchImage() error = %v", err)
+	}
+
+	if c.session.Get() != sessionCookie {
+		t.Error("session cookie was replaced before reaching its maximum age")
+	}
+
+	// The AirCam still accepts the session, but it is replaced regardless once
+	// it reaches its maximum age
+	time.Sleep(150 * time.Millisecond)
+
+	if _, _, err := c.fetchImage(context.Background(), nil); err != nil {
+		t.Fatalf("fetchImage() after maximum age error = %v", err)
+	}
+
+	rotated := c.session.Get()
+	if rotated == sessionCookie || rotated.Value == sessionCookie.Value {
+		t.Error("session cookie was not rotated after reaching its maximum age")
+	}
+
+	if logins, _ := aircam.counts(); logins != 2 {
+		t.Errorf("logins = %d, want 2", logins)
+	}
+
+	// As a hard cap, an expired session is not used if logging in again fails
+	c.Password = "rotated"
+	time.Sleep(150 * time.Millisecond)
+
+	if _, _, err := c.fetchImage(context.Background(),
+		nil); !errors.Is(err, ErrNotLoggedIn) {
+		t.Errorf("fetchImage() error = %v, want %v", err, ErrNotLoggedIn)
+	}
+}
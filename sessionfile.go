@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Type savedSession represents the session cookie of a camera saved to the
+// SNAPSHOT_SESSION_FILE, so that it can be reused after a restart.
+type savedSession struct {
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Obtained time.Time `json:"obtained"`
+}
+
+// loadSessions reads the session cookies saved to the session file, keyed by
+// the label of each camera.
+// It returns the saved sessions, which are empty if the file does not exist,
+// and any errors encountered reading or decoding the file.
+func loadSessions(path string) (map[string]savedSession, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]savedSession{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var sessions map[string]savedSession
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// saveSessions writes the current session cookie of each camera to the session
+// file, readable only by the owner as the cookies grant access to the cameras.
+// The file is replaced atomically, so that an interrupted write does not lose
+// the previous sessions. Cameras without a session cookie, including those
+// authenticated by Digest, are left out.
+// It returns any errors encountered writing the file.
+func saveSessions(path string, cameras []*camera) error {
+	sessions := map[string]savedSession{}
+	for _, c := range cameras {
+		cookie := c.session.Get()
+		if cookie == nil || cookie == digestSession {
+			continue
+		}
+
+		sessions[c.label()] = savedSession{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Obtained: c.session.Obtained(),
+		}
+	}
+
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
+
+// resumeSession validates a saved session cookie of the camera with a snapshot
+// request, setting it as the current session if the AirCam accepts it. A
+// session older than SNAPSHOT_SESSION_MAX_AGE is not resumed, and a resumed
+// session keeps its age from before the restart.
+// It returns whether the saved session was resumed.
+func (c *camera) resumeSession(saved savedSession) bool {
+	if conf.SessionMaxAge > 0 && !saved.Obtained.IsZero() &&
+		time.Since(saved.Obtained) >= conf.SessionMaxAge {
+		c.logger("login").Info("Saved session exceeded maximum age, logging in")
+		return false
+	}
+
+	cookie := &http.Cookie{Name: saved.Name, Value: saved.Value}
+	if _, _, err := c.requestImage(context.Background(), cookie,
+		nil); err != nil {
+		c.logger("login").Info("Saved session is no longer valid, logging in",
+			"error", err)
+		return false
+	}
+
+	c.session.Set(cookie)
+	if !saved.Obtained.IsZero() {
+		c.session.SetObtained(saved.Obtained)
+	}
+	c.logger("login").Info("Resumed saved session")
+
+	return true
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResumeSavedSession(t *testing.T) {
+	tests := []struct {
+		name       string
+		save       bool
+		expire     bool
+		data       string
+		wantLogins int
+	}{
+		{name: "valid", save: true, wantLogins: 1},
+		{name: "expired", save: true, expire: true, wantLogins: 2},
+		{name: "no file", wantLogins: 1},
+		{name: "corrupt file", data: "{", wantLogins: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "sessions.json")
+			if tt.data != "" {
+				if err := os.WriteFile(path, []byte(tt.data), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			aircam := newFakeAirCam(t, "ubnt", "secret")
+			env := map[string]string{
+				"SNAPSHOT_SESSION_FILE":  path,
+				"SNAPSHOT_LOGIN_RETRIES": "0",
+			}
+
+			// Save the session of a camera before a restart
+			var saved string
+			if tt.save {
+				before := newTestCamera(t, aircam, env)
+				sessionCookie, err := before.login(context.Background())
+				if err != nil {
+					t.Fatalf("login() error = %v", err)
+				}
+				before.session.Set(sessionCookie)
+				saved = sessionCookie.Value
+
+				if err := saveSessions(path, []*camera{before}); err != nil {
+					t.Fatalf("saveSessions() error = %v", err)
+				}
+			}
+
+			if tt.expire {
+				aircam.expireSessions()
+			}
+
+			// Start again, resuming the saved session if it is still valid
+			c := newTestCamera(t, aircam, env)
+			if errs := loginCameras([]*camera{c}); errs[0] != nil {
+				t.Fatalf("loginCameras() error = %v", errs[0])
+			}
+
+			if logins, _ := aircam.counts(); logins != tt.wantLogins {
+				t.Errorf("logins = %d, want %d", logins, tt.wantLogins)
+			}
+
+			resumed := c.session.Get().Value == saved
+			if wantResumed := tt.save && !tt.expire; resumed != wantResumed {
+				t.Errorf("session %s resumed = %t, want %t",
+					c.session.Get().Value, resumed, wantResumed)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"time"
+)
+
+// serveMJPEG streams frames from the camera to the client as a motion JPEG,
+// using a multipart/x-mixed-replace response with one JPEG part per frame at the
+// configured stream FPS, until the client disconnects.
+func (c *camera) serveMJPEG(w http.ResponseWriter, r *http.Request) {
+	c.logger("stream").InfoContext(r.Context(), "Client connected", "remote",
+		r.RemoteAddr)
+
+	parts := multipart.NewWriter(w)
+	w.Header().Set("Content-Type",
+		fmt.Sprintf("multipart/x-mixed-replace; boundary=%s", parts.Boundary()))
+	w.Header().Set("Cache-Control", "no-store")
+
+	flusher, canFlush := w.(http.Flusher)
+
+	// Lift the write timeout of the server, which bounds single snapshots
+	// rather than continuous streams
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	frames := time.NewTicker(time.Second / time.Duration(conf.StreamFPS))
+	defer frames.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			c.logger("stream").InfoContext(r.Context(), "Client disconnected",
+				"remote", r.RemoteAddr)
+			return
+		case <-frames.C:
+			// Retrieve the frame, skipping it if the fetch failed
+			f, err := c.getFrame(r.Context(), nil)
+			if err != nil {
+				continue
+			}
+
+			part, err := parts.CreatePart(textproto.MIMEHeader{
+				"Content-Type":   {"image/jpeg"},
+				"Content-Length": {strconv.Itoa(len(f.image))},
+			})
+			if err == nil {
+				_, err = part.Write(f.image)
+			}
+
+			if err != nil {
+				c.logger("stream").ErrorContext(r.Context(),
+					"Error writing frame", "error", err)
+				return
+			}
+
+			if canFlush {
+				flusher.Flush()
+			}
+
+			c.recentActivity.Store(true)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+// maxTransformSize is the largest width or height a snapshot can be resized
+// to.
+const maxTransformSize = 10000
+
+// maxTransformPixels is the largest area a snapshot can be resized to, unless
+// the snapshot itself is larger, rejecting sizes which would exhaust memory as
+// every pixel is held in memory while resizing.
+const maxTransformPixels = 1920 * 1080
+
+// errTransformTooLarge indicates that a snapshot was not transformed, as the
+// requested size exceeds the pixel budget of a transform.
+var errTransformTooLarge = errors.New("Transform - Requested size is too large")
+
+// Output formats of a transformed snapshot.
+const (
+	formatJPEG = "jpeg"
+	formatPNG  = "png"
+)
+
+// Type transform represents the resizing and transcoding requested by the w, h,
+// and format query parameters of a snapshot request. A zero width or height is
+// scaled to preserve the aspect ratio, or left as-is if both are zero.
+type transform struct {
+	width  int
+	height int
+	format string
+}
+
+// parseTransform parses the transform query parameters of a snapshot request.
+// It returns the transform, which is empty if no parameters are present, and an
+// error if any parameters are invalid.
+func parseTransform(query url.Values) (transform, error) {
+	var t transform
+
+	for param, size := range map[string]*int{"w": &t.width, "h": &t.height} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxTransformSize {
+			return t, fmt.Errorf("Transform - Invalid %s: must be 1 to %d", param,
+				maxTransformSize)
+		}
+
+		*size = parsed
+	}
+
+	switch t.format = query.Get("format"); t.format {
+	case "", formatJPEG, formatPNG:
+	default:
+		return t, fmt.Errorf("Transform - Invalid format: must be %s or %s",
+			formatJPEG, formatPNG)
+	}
+
+	return t, nil
+}
+
+// empty checks whether the transform leaves the image untouched.
+func (t transform) empty() bool {
+	return t.width == 0 && t.height == 0 && t.format == ""
+}
+
+// contentType gets the content type of an image output by the transform.
+func (t transform) contentType() string {
+	if t.format == formatPNG {
+		return "image/png"
+	}
+
+	return "image/jpeg"
+}
+
+// apply resizes a JPEG image and encodes it in the output format. The area of
+// the resized image may not exceed the larger of the image itself and
+// maxTransformPixels, which is checked before the image is decoded.
+// It returns the transformed image, errTransformTooLarge if the requested size
+// is too large, and any errors encountered decoding or encoding it.
+func (t transform) apply(frame []byte) ([]byte, error) {
+	config, err := jpeg.DecodeConfig(bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+
+	// Fill in a missing dimension from the aspect ratio of the image
+	width, height := t.width, t.height
+	switch {
+	case width == 0 && height == 0:
+		width, height = config.Width, config.Height
+	case width == 0:
+		width = max(1, config.Width*height/config.Height)
+	case height == 0:
+		height = max(1, config.Height*width/config.Width)
+	}
+
+	if width*height > max(config.Width*config.Height, maxTransformPixels) {
+		return nil, fmt.Errorf("%w: %dx%d", errTransformTooLarge, width, height)
+	}
+
+	decoded, err := jpeg.Decode(bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+	bounds := decoded.Bounds()
+
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(resized, resized.Bounds(), decoded, bounds,
+		draw.Src, nil)
+
+	var buffer bytes.Buffer
+	if t.format == formatPNG {
+		err = png.Encode(&buffer, resized)
+	} else {
+		err = jpeg.Encode(&buffer, resized, nil)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// getTransformedImage retrieves an image from the camera like getImage, and
+// writes it to the provided writer after applying a transform.
+// It returns any errors encountered during retrieval or transformation.
+func (c *camera) getTransformedImage(ctx context.Context, out io.Writer,
+	query url.Values, t transform) error {
+	f, err := c.getFrameOrStale(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	image, err := t.apply(f.image)
+	if errors.Is(err, errTransformTooLarge) {
+		return err
+	} else if err != nil {
+		c.logger("image").ErrorContext(ctx, "Error transforming image", "error",
+			err)
+		return err
+	}
+
+	return writeFrame(out, f, image, t.contentType())
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image/jpeg"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestTransformPixelBudget(t *testing.T) {
+	frame := newTestFrame(t, 64, 48)
+
+	tests := []struct {
+		name       string
+		query      string
+		wantWidth  int
+		wantHeight int
+		wantErr    error
+	}{
+		{name: "downscale", query: "w=32", wantWidth: 32, wantHeight: 24},
+		{name: "upscale within budget", query: "w=1280&h=720",
+			wantWidth: 1280, wantHeight: 720},
+		{name: "both axes", query: "w=10000&h=10000",
+			wantErr: errTransformTooLarge},
+		{name: "scaled axis", query: "w=10000", wantErr: errTransformTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			transform, err := parseTransform(query)
+			if err != nil {
+				t.Fatalf("parseTransform() error = %v", err)
+			}
+
+			transformed, err := transform.apply(frame)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("apply() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("apply() error = %v", err)
+			}
+
+			config, err := jpeg.DecodeConfig(bytes.NewReader(transformed))
+			if err != nil {
+				t.Fatalf("jpeg.DecodeConfig() error = %v", err)
+			}
+
+			if config.Width != tt.wantWidth || config.Height != tt.wantHeight {
+				t.Errorf("size = %dx%d, want %dx%d", config.Width, config.Height,
+					tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestTransformTooLargeIsBadRequest(t *testing.T) {
+	aircam := newFakeAirCam(t, "ubnt", "secret")
+	aircam.setImage(newTestFrame(t, 64, 48))
+	c := newTestCamera(t, aircam, nil)
+	server := newTestServer(t, c)
+
+	response, err := http.Get(server.URL + "/snapshot.cgi?w=10000&h=10000")
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", response.StatusCode,
+			http.StatusBadRequest)
+	}
+}
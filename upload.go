@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Bounds of the retries of a failed snapshot upload, after which the snapshot
+// is skipped until the next upload interval.
+const (
+	uploadAttempts = 3
+	uploadBackoff  = 2 * time.Second
+)
+
+// newUploadClient creates the client of the S3-compatible object store which
+// snapshots are uploaded to, from the scheme and host of SNAPSHOT_S3_ENDPOINT.
+// The client makes a single attempt per upload, as uploads are retried by
+// uploadFrame.
+// It returns the client, and any errors encountered creating it.
+func newUploadClient() (*minio.Client, error) {
+	endpoint, err := url.Parse(conf.S3Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return minio.New(endpoint.Host, &minio.Options{
+		Creds: credentials.NewStaticV4(conf.S3AccessKey, conf.S3SecretKey,
+			""),
+		Secure:     endpoint.Scheme == "https",
+		Region:     conf.S3Region,
+		MaxRetries: 1,
+	})
+}
+
+// uploadSnapshots fetches a frame from the camera every upload interval and
+// uploads it to the S3 bucket, under a timestamped key prefixed by
+// SNAPSHOT_S3_PREFIX and the name of the camera when multiple cameras are
+// configured. Failed uploads are retried a bounded number of times, then logged
+// rather than fatal, so that an unavailable object store does not stop the
+// server.
+func (c *camera) uploadSnapshots(client *minio.Client, ticker *time.Ticker) {
+	for now := range ticker.C {
+		f, err := c.getFrame(context.Background(), nil)
+		if err != nil {
+			continue
+		}
+
+		key := path.Join(conf.S3Prefix, c.Name,
+			now.Format(saveTimeFormat)+".jpg")
+		if err := c.uploadFrame(client, key, f.image); err != nil {
+			c.logger("upload").Error("Error uploading snapshot", "bucket",
+				conf.S3Bucket, "key", key, "error", err)
+			continue
+		}
+
+		c.logger("upload").Debug("Uploaded snapshot", "bucket", conf.S3Bucket,
+			"key", key)
+	}
+}
+
+// uploadFrame puts an image to the S3 bucket under a key, retrying failed
+// uploads with a linear backoff up to uploadAttempts times.
+// It returns the error of the last attempt if every attempt failed.
+func (c *camera) uploadFrame(client *minio.Client, key string,
+	image []byte) error {
+	var err error
+
+	for attempt := 1; attempt <= uploadAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), conf.Timeout)
+		_, err = client.PutObject(ctx, conf.S3Bucket, key,
+			bytes.NewReader(image), int64(len(image)),
+			minio.PutObjectOptions{ContentType: "image/jpeg"})
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+
+		if attempt < uploadAttempts {
+			c.logger("upload").Warn("Upload failed, retrying", "key", key,
+				"attempt", attempt, "error", err)
+			time.Sleep(time.Duration(attempt) * uploadBackoff)
+		}
+	}
+
+	return fmt.Errorf("Upload - Failed after %d attempts: %w", uploadAttempts,
+		err)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Type fakeS3 is an HTTP server emulating the PutObject call of an
+// S3-compatible object store, failing the first failures of them with 503.
+type fakeS3 struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	failures int
+	objects  map[string][]byte
+	types    map[string]string
+}
+
+// newFakeS3 starts a fake S3 endpoint, which is closed when the test ends.
+func newFakeS3(t *testing.T, failures int) *fakeS3 {
+	t.Helper()
+
+	s := &fakeS3{failures: failures, objects: map[string][]byte{},
+		types: map[string]string{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handlePut))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// handlePut stores the body of an object put to a path-style bucket and key.
+func (s *fakeS3) handlePut(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err == nil && strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"),
+		"STREAMING-") {
+		body, err = decodeChunked(body)
+	}
+
+	if err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.failures > 0 {
+		s.failures--
+		http.Error(w, "SlowDown", http.StatusServiceUnavailable)
+		return
+	}
+
+	s.objects[r.URL.Path] = body
+	s.types[r.URL.Path] = r.Header.Get("Content-Type")
+	w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+}
+
+// decodeChunked decodes a body with the aws-chunked encoding of a streaming
+// signed upload, where each chunk is preceded by its hex size and signature.
+// It returns the decoded body, and any errors encountered decoding it.
+func decodeChunked(body []byte) ([]byte, error) {
+	var decoded []byte
+	for {
+		header, rest, ok := bytes.Cut(body, []byte("\r\n"))
+		if !ok {
+			return nil, errors.New("missing chunk header")
+		}
+
+		sizeHex, _, _ := bytes.Cut(header, []byte(";"))
+		size, err := strconv.ParseInt(string(sizeHex), 16, 64)
+		if err != nil || int64(len(rest)) < size {
+			return nil, errors.New("invalid chunk size")
+		}
+
+		if size == 0 {
+			return decoded, nil
+		}
+
+		decoded = append(decoded, rest[:size]...)
+		body = bytes.TrimPrefix(rest[size:], []byte("\r\n"))
+	}
+}
+
+func TestUploadFrame(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+	}{
+		{name: "upload"},
+		{name: "transient failure", failures: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3 := newFakeS3(t, tt.failures)
+			setTestConfig(t, map[string]string{
+				"SNAPSHOT_URL":           "http://aircam.local",
+				"SNAPSHOT_USERNAME":      "ubnt",
+				"SNAPSHOT_PASSWORD":      "secret",
+				"SNAPSHOT_S3_ENDPOINT":   s3.URL,
+				"SNAPSHOT_S3_BUCKET":     "snapshots",
+				"SNAPSHOT_S3_REGION":     "us-east-1",
+				"SNAPSHOT_S3_ACCESS_KEY": "access",
+				"SNAPSHOT_S3_SECRET_KEY": "secret",
+			})
+
+			cameras, err := newCameras()
+			if err != nil {
+				t.Fatalf("newCameras() error = %v", err)
+			}
+
+			client, err := newUploadClient()
+			if err != nil {
+				t.Fatalf("newUploadClient() error = %v", err)
+			}
+
+			if err := cameras[0].uploadFrame(client, "front/2026.jpg",
+				testJPEG); err != nil {
+				t.Fatalf("uploadFrame() error = %v", err)
+			}
+
+			s3.mutex.Lock()
+			defer s3.mutex.Unlock()
+
+			key := "/snapshots/front/2026.jpg"
+			if got := s3.objects[key]; !bytes.Equal(got, testJPEG) {
+				t.Errorf("object = %x, want %x", got, testJPEG)
+			}
+
+			if got := s3.types[key]; got != "image/jpeg" {
+				t.Errorf("Content-Type = %q, want %q", got, "image/jpeg")
+			}
+		})
+	}
+}
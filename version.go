@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Build information, injected at build time with:
+//
+//	go build -ldflags "-X main.version=1.0.0 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+// Type versionInfo represents the build information of the running binary.
+type versionInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Date    string `json:"date"`
+}
+
+// String formats the build information as printed by the -version flag.
+func (info versionInfo) String() string {
+	return fmt.Sprintf("aircam-snapshot %s (commit %s, built %s)", info.Version,
+		info.Commit, info.Date)
+}
+
+// buildInfo retrieves the build information of the running binary.
+func buildInfo() versionInfo {
+	return versionInfo{Version: version, Commit: commit, Date: date}
+}
+
+// handleVersion is the handler function for the /version route, responding
+// with the build information as JSON.
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildInfo())
+}
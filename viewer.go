@@ -0,0 +1,36 @@
+package main
+
+import (
+	_ "embed"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// viewerPage is the HTML viewer served at the root of each camera, which
+// refreshes the snapshot every second.
+//
+//go:embed viewer.html
+var viewerPage string
+
+var viewerTemplate = template.Must(template.New("viewer").Parse(viewerPage))
+
+// handleViewer is the handler function for the root of the camera, serving a
+// page which displays its live snapshot for quick verification in a browser.
+func (c *camera) handleViewer(w http.ResponseWriter, r *http.Request) {
+	title := "AirCam"
+	if c.Name != "" {
+		title += " - " + c.Name
+	}
+
+	// The snapshot is requested relative to the page, so that it is fetched
+	// from the route of the camera
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	viewerTemplate.Execute(w, struct {
+		Title     string
+		ServePath string
+	}{
+		Title:     title,
+		ServePath: strings.TrimPrefix(conf.ServePath, "/"),
+	})
+}
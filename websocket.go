@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket liveness and write timing. Pings are sent slightly more often than
+// the pong wait so that a healthy client always responds in time.
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+// wsUpgrader upgrades requests to the /ws route to WebSocket connections.
+var wsUpgrader = websocket.Upgrader{}
+
+// serveWebSocket upgrades a request to a WebSocket connection and pushes a
+// binary JPEG frame from the camera to the client at the configured stream FPS,
+// until the client closes the connection, stops responding to pings, or falls
+// too far behind. Frames are shared with every other client, see broadcaster.
+func (c *camera) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		c.logger("websocket").ErrorContext(r.Context(),
+			"Error upgrading connection", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	c.logger("websocket").InfoContext(r.Context(), "Client connected", "remote",
+		r.RemoteAddr)
+
+	// Extend the read deadline whenever the client answers a ping
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	// Read and discard client messages so that control frames are processed,
+	// signalling when the client closes the connection or times out.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	frames := c.subscribe()
+	defer c.unsubscribe(frames)
+
+	pings := time.NewTicker(wsPingPeriod)
+	defer pings.Stop()
+
+	for {
+		select {
+		case <-closed:
+			c.logger("websocket").InfoContext(r.Context(),
+				"Client disconnected", "remote", r.RemoteAddr)
+			return
+		case <-pings.C:
+			err := conn.WriteControl(websocket.PingMessage, nil,
+				time.Now().Add(wsWriteWait))
+			if err != nil {
+				c.logger("websocket").ErrorContext(r.Context(),
+					"Error sending ping", "error", err)
+				return
+			}
+		case frame, ok := <-frames:
+			if !ok {
+				c.logger("websocket").InfoContext(r.Context(),
+					"Client dropped for falling behind", "remote", r.RemoteAddr)
+				return
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			err := conn.WriteMessage(websocket.BinaryMessage, frame)
+			if err != nil {
+				c.logger("websocket").ErrorContext(r.Context(),
+					"Error sending frame", "error", err)
+				return
+			}
+		}
+	}
+}